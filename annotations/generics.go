@@ -0,0 +1,27 @@
+//go:build go1.18
+// +build go1.18
+
+package annotations
+
+import "go/ast"
+
+// isGeneric returns true if the function has type parameters or is a method
+// of a generic type. Generic functions cannot be registered without
+// instantiating them.
+func (f *Function) isGeneric() bool {
+	if f.Decl.Type.TypeParams != nil && len(f.Decl.Type.TypeParams.List) > 0 {
+		return true
+	}
+	if f.Decl.Recv == nil || len(f.Decl.Recv.List) == 0 {
+		return false
+	}
+	typ := f.Decl.Recv.List[0].Type
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+	switch typ.(type) {
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,9 @@
+//go:build !go1.18
+// +build !go1.18
+
+package annotations
+
+// isGeneric returns false as Go versions before 1.18 cannot parse generic functions.
+func (f *Function) isGeneric() bool {
+	return false
+}
@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package annotations
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseGenerics(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @test
+func queryTest[T any]() {}
+
+// @fixture
+func newStore[K comparable, V any]() map[K]V { return nil }
+
+type suite[T any] struct{}
+
+// @test
+func (s *suite[T]) methodTest() {}
+
+func test_generic[T any]() {}
+
+// @test
+func concreteTest() {
+	queryTest[int]()
+}
+`, true)
+
+	if assert.Len(t, res.Tests, 1) {
+		assert.Equal(t, "concreteTest", res.Tests[0].Name())
+	}
+	assert.Empty(t, res.Fixtures)
+	if assert.Len(t, res.Warnings, 3) {
+		assert.Contains(t, res.Warnings[0], "@test is not supported on generic function 'queryTest'")
+		assert.Contains(t, res.Warnings[1], "@fixture is not supported on generic function 'newStore'")
+		assert.Contains(t, res.Warnings[2], "@test is not supported on generic function 'methodTest'")
+	}
+}
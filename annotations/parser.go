@@ -3,11 +3,17 @@ package annotations
 import (
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
@@ -27,9 +33,45 @@ const (
 	// AfterTestAnnotation used to label a function as a after test hook
 	AfterTestAnnotation = "@afterTest"
 
+	// BeforeAllAnnotation used to label a function as a hook called once before all tests
+	BeforeAllAnnotation = "@beforeAll"
+
+	// AfterAllAnnotation used to label a function as a hook called once after all tests
+	AfterAllAnnotation = "@afterAll"
+
 	// TestLabelAnnotation used to introduce a new test Label.
 	TestLabelAnnotation = "@testLabel"
 
+	// TimeoutAnnotation used to set a timeout on a test.
+	TimeoutAnnotation = "@timeout"
+
+	// RetryAnnotation used to set the number of retries of a test.
+	RetryAnnotation = "@retry"
+
+	// EnvAnnotation used to set environment variables while a test runs.
+	EnvAnnotation = "@env"
+
+	// ExampleAnnotation used to label a function as a testable example.
+	ExampleAnnotation = "@example"
+
+	// XFailAnnotation used to mark a test as expected to fail.
+	XFailAnnotation = "@xfail"
+
+	// CaptureAnnotation used to write the output of a failed test to a file.
+	CaptureAnnotation = "@capture"
+
+	// ParallelismAnnotation used to limit the number of parallel tests of labels.
+	ParallelismAnnotation = "@parallelism"
+
+	// ModuleAnnotation used to group a fixture into a module.
+	ModuleAnnotation = "@module"
+
+	// DefaultLabelAnnotation sets the label of tests without labels.
+	DefaultLabelAnnotation = "@defaultLabel"
+
+	// NoDefaultLabelsAnnotation removes the default labels unit, integration and regression.
+	NoDefaultLabelsAnnotation = "@noDefaultLabels"
+
 	// DisableAutoLabellingAnnotation can be used to toggle the auto matching of tests.
 	DisableAutoLabellingAnnotation = "@disableAutoLabelling"
 
@@ -38,6 +80,9 @@ const (
 	integrationTestLabel = "integration"
 
 	DefaultTestLabel = unitTestLabel
+
+	// DefaultWeight is the weight of tests without @test(weight=N).
+	DefaultWeight = 1
 )
 
 var (
@@ -50,99 +95,408 @@ var (
 )
 
 var (
-	fixtureRegexp              = annotationRegexp(FixtureAnnotation)
-	onceFixtureRegexp          = annotationRegexp(OnceFixtureAnnotation)
+	fixtureRegexp              = annotationWithOptionalParamsRegexp(FixtureAnnotation)
+	onceFixtureRegexp          = annotationWithOptionalParamsRegexp(OnceFixtureAnnotation)
 	testRegexp                 = annotationWithOptionalParamsRegexp(TestAnnotation)
-	beforeTestRegexp           = annotationRegexp(BeforeTestAnnotation)
-	afterTestRegexp            = annotationRegexp(AfterTestAnnotation)
-	testLabelRegexp            = annotationWithParamsRegexp(TestLabelAnnotation)
+	beforeTestRegexp           = annotationWithOptionalParamsRegexp(BeforeTestAnnotation)
+	afterTestRegexp            = annotationWithOptionalParamsRegexp(AfterTestAnnotation)
+	beforeAllRegexp            = annotationRegexp(BeforeAllAnnotation)
+	afterAllRegexp             = annotationRegexp(AfterAllAnnotation)
+	exampleRegexp              = annotationWithOptionalParamsRegexp(ExampleAnnotation)
+	testLabelRegexp            = annotationWithCustomParamsRegexp(TestLabelAnnotation, labelMatcherRegexp)
+	timeoutRegexp              = annotationWithParamsRegexp(TimeoutAnnotation)
+	moduleRegexp               = annotationWithParamsRegexp(ModuleAnnotation)
+	parallelismRegexp          = annotationWithParamsRegexp(ParallelismAnnotation)
+	retryRegexp                = annotationWithParamsRegexp(RetryAnnotation)
+	xfailRegexp                = annotationRegexp(XFailAnnotation)
+	captureRegexp              = annotationRegexp(CaptureAnnotation)
+	envRegexp                  = regexp.MustCompile(`(?m)^[ \t]*` + EnvAnnotation + `\(([^()\n]*)\)[ \t]*$`)
+	envKeyRegexp               = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
 	disableAutoLabellingRegexp = annotationRegexp(DisableAutoLabellingAnnotation)
+	noDefaultLabelsRegexp      = annotationRegexp(NoDefaultLabelsAnnotation)
+	defaultLabelRegexp         = annotationWithParamsRegexp(DefaultLabelAnnotation)
 )
 
 func annotationRegexp(annotation string) *regexp.Regexp {
 	return regexp.MustCompile(fmt.Sprint(`(^|\n)\s*`, annotation, `\s*($|\n)`))
 }
 
+// quotedParamRegexp matches a parameter quoted like a Go string literal, like
+// "my-label", which may contain any character but line breaks.
+const quotedParamRegexp = `"(?:[^"\\\n]|\\.)*"`
+
+// paramRegexp matches a single annotation parameter which is either a word, a
+// key=value pair or a quoted parameter.
+const paramRegexp = `(?:\w+(?:=[\w.-]+)?|` + quotedParamRegexp + `)`
+
+// labelMatcherRegexp matches a parameter of @testLabel which is either a word
+// or a /regexp/ matching the function names of the label, or a quoted name or
+// "description" of the label.
+const labelMatcherRegexp = `(?:` + paramRegexp + `|/[^/,\n]+/)`
+
 func annotationWithParamsRegexp(annotation string) *regexp.Regexp {
-	return regexp.MustCompile(fmt.Sprint(`(?:^|\n)\s*`, annotation, `\((\w+(?:,\s*\w+)*)\)\s*(?:$|\n)`))
+	return annotationWithCustomParamsRegexp(annotation, paramRegexp)
+}
+
+// The parameters may be surrounded by spaces and tabs, like @test( a ,b ).
+func annotationWithCustomParamsRegexp(annotation, param string) *regexp.Regexp {
+	return regexp.MustCompile(fmt.Sprint(`(?:^|\n)\s*`, annotation, `\([ \t]*(`, param, `(?:[ \t]*,\s*`, param, `)*)[ \t]*\)\s*(?:$|\n)`))
 }
 
 func annotationWithOptionalParamsRegexp(annotation string) *regexp.Regexp {
-	return regexp.MustCompile(fmt.Sprint(`(?:^|\n)\s*`, annotation, `(?:\((\w+(?:,\s*\w+)*)\))?\s*(?:$|\n)`))
+	return regexp.MustCompile(fmt.Sprint(`(?:^|\n)\s*`, annotation, `(?:\([ \t]*(`, paramRegexp, `(?:[ \t]*,\s*`, paramRegexp, `)*)[ \t]*\))?\s*(?:$|\n)`))
 }
 
 func getParams(annotation *regexp.Regexp, cmt string) ([]string, bool) {
-	res := annotation.FindStringSubmatch(cmt)
-	if len(res) != 2 {
+	res, ok := getRawParams(annotation, cmt)
+	for i, param := range res {
+		res[i] = unquoteParam(param)
+	}
+	return res, ok
+}
+
+// getRawParams returns the parameters like getParams, keeping the quotes of
+// quoted parameters.
+func getRawParams(annotation *regexp.Regexp, cmt string) ([]string, bool) {
+	match := annotation.FindStringSubmatch(cmt)
+	if len(match) != 2 {
 		return nil, false
 	}
-	if len(res[1]) > 0 {
-		res = strings.Split(res[1], ",")
-		for i := range res {
-			res[i] = strings.TrimSpace(strings.TrimLeft(res[i], ","))
+
+	// Commas within quoted parameters do not separate parameters.
+	var res []string
+	start, quoted := 0, false
+	for i := 0; i < len(match[1]); i++ {
+		switch match[1][i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				res = append(res, strings.TrimSpace(match[1][start:i]))
+				start = i + 1
+			}
 		}
-	} else {
-		res = nil
+	}
+	if len(match[1]) > 0 {
+		res = append(res, strings.TrimSpace(match[1][start:]))
 	}
 	return res, true
 }
 
+// unquoteParam returns the parameter without its quotes and with its escape
+// sequences replaced, like "my-label" for my-label; the parameter as is if it
+// is not quoted.
+func unquoteParam(param string) string {
+	if !isDescription(param) {
+		return param
+	}
+	if res, err := strconv.Unquote(param); err == nil {
+		return res
+	}
+	return param
+}
+
+// splitParam splits a key=value parameter. The value is empty if the parameter has no value.
+func splitParam(param string) (string, string) {
+	if idx := strings.Index(param, "="); idx >= 0 {
+		return param[:idx], param[idx+1:]
+	}
+	return param, ""
+}
+
 // ParseResult holds the package and functions parsed.
 type ParseResult struct {
 	Package *ast.Package
 
 	DefaultTestLabel string
-	// Label name => prefix.
-	TestLabels   map[string][]string
-	Fixtures     []*Function
-	OnceFixtures []*Function
-	Tests        []*LabelFunction
-	BeforeTests  []*Function
-	AfterTests   []*Function
+	// Label name => prefixes and /regexp/ matchers of function names.
+	TestLabels map[string][]string
+	// Label name => number of parallel tests of the label running at the same time.
+	LabelParallelism map[string]int
+	// Label name => description given by @testLabel(name, "description").
+	LabelDescriptions map[string]string
+	Fixtures          []*FixtureFunction
+	OnceFixtures      []*FixtureFunction
+	// TypeFixtures are struct types annotated as fixtures, provided by their zero value.
+	TypeFixtures []*TypeDecl
+	// Suites are the struct types with annotated methods not annotated as fixtures themselves.
+	Suites      []*TypeDecl
+	Tests       []*LabelFunction
+	Examples    []*ExampleFunction
+	BeforeTests []*HookFunction
+	AfterTests  []*HookFunction
+	BeforeAll   []*Function
+	AfterAll    []*Function
+	// Module name => fixtures of the module.
+	Modules map[string]*Module
 
 	Warnings []string
+	// Decisions tell for every function why it was registered as a test,
+	// fixture or hook, or why it was skipped; printed by generate -v.
+	Decisions []string
+}
+
+// Module holds the fixtures grouped by a @module annotation.
+type Module struct {
+	Fixtures     []*FixtureFunction
+	OnceFixtures []*FixtureFunction
+}
+
+// FixtureFunction is a fixture together with the parameters of its annotation.
+type FixtureFunction struct {
+	*Function
+	// Group is the value group the fixture provides its values to.
+	Group string
+	// As are the interfaces the fixture additionally provides its value as.
+	As []*Type
+	// Locked is true if the value of the fixture is guarded by a mutex.
+	Locked bool
+	// PerLabel is true if a once fixture creates a value for every set of labels of the tests.
+	PerLabel bool
+	// TestScope is true if the fixture creates one value for every root test, shared by its subtests.
+	TestScope bool
+	// Eager is true if the tests create the values of the fixture even if they do not depend on them.
+	Eager bool
+	// Priority decides which fixture provides an interface of As if several do; the default is 0.
+	Priority int
+}
+
+// Type is a type referenced by an annotation parameter.
+type Type struct {
+	// Expr is the type as written in the annotation, like io.Writer.
+	Expr string
+	// ImportName and ImportPath of the package qualifying the type. Both are
+	// empty for types of the parsed package.
+	ImportName string
+	ImportPath string
+}
+
+// HookFunction is a before or after test hook together with the parameters of its annotation.
+type HookFunction struct {
+	*Function
+	// Order decides when the hook is called relative to the other hooks; the default is 0.
+	Order int
+	// Labels limits the hook to the tests having one of the labels; all tests if empty.
+	Labels []string
 }
 
 type LabelFunction struct {
+	*Function
+	Labels  []string
+	Timeout time.Duration
+	Retries int
+	// Weight is the weight given by @test(weight=N); tests with a higher weight
+	// are started first. It is DefaultWeight unless given.
+	Weight int
+	// ExpectFailure is true if the test is expected to fail.
+	ExpectFailure bool
+	// Capture is true if the output of the test is written to a file when it fails.
+	Capture bool
+	// Env are the KEY=value environment variables set while the test runs.
+	Env []string
+}
+
+// ExampleFunction is a testable example together with the output it must print.
+type ExampleFunction struct {
 	*Function
 	Labels []string
+	// Output is the expected output of the example from its "Output:" comment.
+	Output string
+	// Unordered is true if the output is compared ignoring the order of lines.
+	Unordered bool
+}
+
+// Options changes how a package is parsed.
+type Options struct {
+	// Include are glob patterns of additional files of the package to scan,
+	// like non-test files declaring fixtures.
+	Include []string
+	// TestLabels are label matchers added to the ones declared by @testLabel.
+	TestLabels map[string][]string
+	// DefaultTestLabel is the label of tests without labels, taking precedence
+	// over @defaultLabel; DefaultTestLabel if both are empty.
+	DefaultTestLabel string
+	// Tags are the build tags which are set, like the -tags of go build. If
+	// not nil, files whose build constraints are not satisfied are skipped;
+	// all files are scanned if nil.
+	Tags []string
+	// WarnUnmatched warns about the functions which look like tests, having a
+	// *testing.T or *tedi.T parameter, but are skipped as they are neither
+	// annotated nor match a label when labelling automatically.
+	WarnUnmatched bool
+	// NoWarnUnsatisfiable does not warn about the parameters of tests which
+	// no fixture provides, like when the fixtures are registered by hand.
+	NoWarnUnsatisfiable bool
 }
 
 // Parse returns the parsed result of the package.
 func Parse(pkgDir string, filePrefix string, autoLabel bool) (*ParseResult, error) {
-	parseResult, err := parsePackage(pkgDir, filePrefix)
+	return ParseWithOptions(pkgDir, filePrefix, autoLabel, Options{})
+}
+
+// ParseWithOptions returns the parsed result of the package like Parse, changed by the options.
+func ParseWithOptions(pkgDir string, filePrefix string, autoLabel bool, o Options) (*ParseResult, error) {
+	matches := []func(name string) bool{func(name string) bool {
+		return strings.HasSuffix(name, filePrefix)
+	}}
+	for _, pattern := range o.Include {
+		pattern := pattern
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+		}
+		matches = append(matches, func(name string) bool {
+			ok, _ := filepath.Match(pattern, name)
+			return ok
+		})
+	}
+
+	parseResult, err := parsePackage(pkgDir, o.Tags, matches...)
 	if err != nil {
 		return nil, err
 	}
 
-	return parse(parseResult, autoLabel)
+	return parse(parseResult, autoLabel, o)
+}
+
+// ParseFiles returns the parsed result of a package given by the sources of
+// its files keyed by file name, like Parse without reading the file system.
+func ParseFiles(files map[string][]byte, autoLabel bool) (*ParseResult, error) {
+	fileNames := make([]string, 0, len(files))
+	for fileName := range files {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	fset := token.NewFileSet()
+	pkgs := map[string]*ast.Package{}
+	for _, fileName := range fileNames {
+		file, err := parser.ParseFile(fset, fileName, files[fileName], parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse file %s: %w", fileName, err)
+		}
+		pkg, ok := pkgs[file.Name.Name]
+		if !ok {
+			pkg = &ast.Package{Name: file.Name.Name, Files: map[string]*ast.File{}}
+			pkgs[file.Name.Name] = pkg
+		}
+		pkg.Files[fileName] = file
+	}
+
+	return parse(parsePackages(pkgs, fset), autoLabel, Options{})
 }
 
-func parse(parseResult *parseResult, autoLabel bool) (*ParseResult, error) {
+func parse(parseResult *parseResult, autoLabel bool, o Options) (*ParseResult, error) {
 	res := &ParseResult{
 		DefaultTestLabel: DefaultTestLabel,
-		TestLabels: map[string][]string{
-			unitTestLabel:        unitTestMatcher,
-			integrationTestLabel: integrationTestMatcher,
-			regressionTestLabel:  regressionTestMatcher,
-		},
+		TestLabels:       map[string][]string{},
+	}
+	if o.DefaultTestLabel != "" {
+		res.DefaultTestLabel = o.DefaultTestLabel
+	}
+
+	warn := func(pos token.Position, format string, args ...interface{}) {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("%s:%d: %s", pos.Filename, pos.Line, fmt.Sprintf(format, args...)))
+	}
+	decide := func(fn *Function, format string, args ...interface{}) {
+		pos := fn.Position()
+		res.Decisions = append(res.Decisions, fmt.Sprintf("%s:%d: %s: %s", pos.Filename, pos.Line, fn.Name(), fmt.Sprintf(format, args...)))
+	}
+
+	// The default labels are removed before any @testLabel is applied, no
+	// matter the order of the comments.
+	noDefaultLabels := false
+	for _, c := range parseResult.comments {
+		if noDefaultLabelsRegexp.MatchString(c.text) {
+			noDefaultLabels = true
+		}
+	}
+	if !noDefaultLabels {
+		res.TestLabels[unitTestLabel] = unitTestMatcher
+		res.TestLabels[integrationTestLabel] = integrationTestMatcher
+		res.TestLabels[regressionTestLabel] = regressionTestMatcher
 	}
 
-	for _, cmt := range parseResult.comments {
+	// Label name => position of its @parallelism, to warn about unknown labels.
+	parallelismPos := map[string]token.Position{}
+	// Compiled /regexp/ matchers of the labels.
+	labelRegexps := map[string]*regexp.Regexp{}
+	for label, matchers := range o.TestLabels {
+		for _, matcher := range matchers {
+			if isRegexpMatcher(matcher) {
+				re, err := regexp.Compile(matcher[1 : len(matcher)-1])
+				if err != nil {
+					return nil, fmt.Errorf("matcher %s of label '%s' is not a valid regexp: %w", matcher, label, err)
+				}
+				labelRegexps[matcher] = re
+			}
+			res.TestLabels[label] = append(res.TestLabels[label], matcher)
+		}
+	}
+	for _, c := range parseResult.comments {
+		cmt := c.text
 		if testLabelRegexp.MatchString(cmt) {
-			params, ok := getParams(testLabelRegexp, cmt)
+			params, ok := getRawParams(testLabelRegexp, cmt)
 			if !ok {
-				res.Warnings = append(res.Warnings, fmt.Sprintf("@testLabel parameters could not be parsed '%s'", cmt))
+				warn(c.pos, "@testLabel parameters could not be parsed '%s'", cmt)
 				continue
 			}
 
 			if len(params) < 1 {
-				res.Warnings = append(res.Warnings, fmt.Sprintf("@testLabel must have one argument '%s'", cmt))
+				warn(c.pos, "@testLabel must have one argument '%s'", cmt)
+				continue
+			}
+
+			// The name may be quoted, like a label with a hyphen.
+			Label := unquoteParam(params[0])
+			if Label == "" {
+				warn(c.pos, "@testLabel must start with the name of the label '%s'", cmt)
 				continue
 			}
+			for i, matcher := range params[1:] {
+				if isDescription(matcher) {
+					if i > 0 {
+						warn(c.pos, "@testLabel description %s must follow the name of the label", matcher)
+						continue
+					}
+					if res.LabelDescriptions == nil {
+						res.LabelDescriptions = map[string]string{}
+					}
+					res.LabelDescriptions[Label] = unquoteParam(matcher)
+					if _, ok := res.TestLabels[Label]; !ok {
+						res.TestLabels[Label] = nil
+					}
+					continue
+				}
+				if isRegexpMatcher(matcher) {
+					re, err := regexp.Compile(matcher[1 : len(matcher)-1])
+					if err != nil {
+						warn(c.pos, "@testLabel matcher %s is not a valid regexp: %s", matcher, err)
+						continue
+					}
+					labelRegexps[matcher] = re
+				}
+				res.TestLabels[Label] = append(res.TestLabels[Label], matcher)
+			}
+		}
 
-			Label := params[0]
-			res.TestLabels[Label] = append(res.TestLabels[Label], params[1:]...)
+		if params, ok := getParams(parallelismRegexp, cmt); ok {
+			for _, param := range params {
+				label, value := splitParam(param)
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					warn(c.pos, "@parallelism must have label=<positive number> arguments '%s'", cmt)
+					continue
+				}
+				if res.LabelParallelism == nil {
+					res.LabelParallelism = map[string]int{}
+				}
+				res.LabelParallelism[label] = n
+				parallelismPos[label] = c.pos
+			}
 		}
 
 		if disableAutoLabellingRegexp.MatchString(cmt) {
@@ -150,27 +504,256 @@ func parse(parseResult *parseResult, autoLabel bool) (*ParseResult, error) {
 		}
 	}
 
-	// Ensure that the default test label exists.
-	if _, ok := res.TestLabels[res.DefaultTestLabel]; !ok {
+	// The first @defaultLabel sets the default label unless the options do.
+	defaultLabel, defaultLabelPos := "", token.Position{}
+	for _, c := range parseResult.comments {
+		params, ok := getParams(defaultLabelRegexp, c.text)
+		if !ok {
+			continue
+		}
+		if len(params) != 1 {
+			warn(c.pos, "@defaultLabel must have one argument '%s'", c.text)
+			continue
+		}
+		if defaultLabel != "" {
+			if params[0] != defaultLabel {
+				warn(c.pos, "conflicting @defaultLabel(%s); using '%s' of %s:%d", params[0], defaultLabel, defaultLabelPos.Filename, defaultLabelPos.Line)
+			}
+			continue
+		}
+		defaultLabel, defaultLabelPos = params[0], c.pos
+		if o.DefaultTestLabel == "" {
+			res.DefaultTestLabel = defaultLabel
+		}
+	}
+
+	// Ensure that the default test label exists. Without the default labels it
+	// is only added once a test without labels needs it.
+	if _, ok := res.TestLabels[res.DefaultTestLabel]; !ok && !noDefaultLabels {
 		res.TestLabels[res.DefaultTestLabel] = nil
 	}
 
-	parseLabels := func(regex *regexp.Regexp, fn *Function, defaultLabels []string) ([]string, bool) {
-		labels, ok := getParams(regex, fn.Comment())
+	// parseLabels returns the labels of a test or example, and its key=value
+	// parameters like weight=5, which are not labels.
+	parseLabels := func(regex *regexp.Regexp, fn *Function, defaultLabels []string) ([]string, []string, bool) {
+		params, ok := getRawParams(regex, fn.Comment())
 		if !ok {
-			return nil, ok
+			return nil, nil, ok
+		}
+		var labels, options []string
+		for _, param := range params {
+			if !isDescription(param) && strings.Contains(param, "=") {
+				options = append(options, param)
+			} else {
+				labels = append(labels, unquoteParam(param))
+			}
 		}
 		if len(labels) == 0 {
 			labels = defaultLabels
+			if _, ok := res.TestLabels[res.DefaultTestLabel]; !ok {
+				warn(fn.Position(), "default label '%s' is not declared by @testLabel; using it for tests without labels", res.DefaultTestLabel)
+			}
+		}
+		for _, label := range labels {
+			if _, ok := res.TestLabels[label]; !ok {
+				res.TestLabels[label] = nil
+			}
+		}
+
+		return labels, options, ok
+	}
+
+	addFixture := func(fn *Function, regex *regexp.Regexp, once bool) {
+		fixture := &FixtureFunction{Function: fn}
+		if regex != nil {
+			params, _ := getParams(regex, fn.Comment())
+			for _, param := range params {
+				switch key, value := splitParam(param); key {
+				case "group":
+					fixture.Group = value
+				case "locked":
+					fixture.Locked = true
+				case "eager":
+					fixture.Eager = true
+				case "perLabel":
+					if !once {
+						warn(fn.Position(), "perLabel is only supported by @onceFixture '%s'", fn.Comment())
+						continue
+					}
+					fixture.PerLabel = true
+				case "scope":
+					if value != "test" {
+						warn(fn.Position(), "unknown fixture scope '%s' in '%s'", value, fn.Comment())
+						continue
+					}
+					if once {
+						warn(fn.Position(), "scope=test is only supported by @fixture '%s'", fn.Comment())
+						continue
+					}
+					fixture.TestScope = true
+				case "as":
+					typ, err := fn.resolveType(value)
+					if err != nil {
+						warn(fn.Position(), "%s in '%s'", err, fn.Comment())
+						continue
+					}
+					fixture.As = append(fixture.As, typ)
+				case "priority":
+					priority, err := strconv.Atoi(value)
+					if err != nil {
+						warn(fn.Position(), "priority must be a number '%s'", fn.Comment())
+						continue
+					}
+					fixture.Priority = priority
+				default:
+					warn(fn.Position(), "unknown fixture parameter '%s' in '%s'", param, fn.Comment())
+				}
+			}
+		}
+
+		if fixture.Eager && fixture.Group != "" {
+			warn(fn.Position(), "eager is not supported by fixtures of a group '%s'", fn.Comment())
+			fixture.Eager = false
+		}
+		if fixture.Priority != 0 && len(fixture.As) == 0 {
+			warn(fn.Position(), "priority only applies to the interfaces given by as= '%s'", fn.Comment())
+		}
+
+		fixtures, onceFixtures := &res.Fixtures, &res.OnceFixtures
+		if params, ok := getParams(moduleRegexp, fn.Comment()); ok {
+			if len(params) != 1 {
+				warn(fn.Position(), "@module must have one argument '%s'", fn.Comment())
+			} else {
+				if res.Modules == nil {
+					res.Modules = map[string]*Module{}
+				}
+				module, ok := res.Modules[params[0]]
+				if !ok {
+					module = &Module{}
+					res.Modules[params[0]] = module
+				}
+				fixtures, onceFixtures = &module.Fixtures, &module.OnceFixtures
+			}
+		}
+
+		if once {
+			*onceFixtures = append(*onceFixtures, fixture)
 		} else {
-			for _, label := range labels {
-				if _, ok := res.TestLabels[label]; !ok {
-					res.TestLabels[label] = nil
+			*fixtures = append(*fixtures, fixture)
+		}
+	}
+
+	addHook := func(hooks *[]*HookFunction, fn *Function, regex *regexp.Regexp) {
+		hook := &HookFunction{Function: fn}
+		if regex != nil {
+			params, _ := getParams(regex, fn.Comment())
+			for _, param := range params {
+				switch key, value := splitParam(param); key {
+				case "order":
+					order, err := strconv.Atoi(value)
+					if err != nil {
+						warn(fn.Position(), "order must be a number '%s'", fn.Comment())
+						continue
+					}
+					hook.Order = order
+				case param:
+					hook.Labels = append(hook.Labels, param)
+					if _, ok := res.TestLabels[param]; !ok {
+						res.TestLabels[param] = nil
+					}
+				default:
+					warn(fn.Position(), "unknown hook parameter '%s' in '%s'", param, fn.Comment())
+				}
+			}
+		}
+		*hooks = append(*hooks, hook)
+	}
+
+	addTest := func(fn *Function, labels, options []string) {
+		test := &LabelFunction{Function: fn, Labels: labels, Weight: DefaultWeight}
+		for _, option := range options {
+			switch key, value := splitParam(option); key {
+			case "weight":
+				weight, err := strconv.Atoi(value)
+				if err != nil || weight < 1 {
+					warn(fn.Position(), "weight must be a positive number '%s'", fn.Comment())
+					continue
+				}
+				test.Weight = weight
+			default:
+				warn(fn.Position(), "unknown @test parameter '%s' in '%s'", option, fn.Comment())
+			}
+		}
+		if params, ok := getParams(timeoutRegexp, fn.Comment()); ok {
+			timeout, err := time.ParseDuration(params[0])
+			if err != nil || len(params) != 1 {
+				warn(fn.Position(), "@timeout must have one duration argument '%s'", fn.Comment())
+			} else {
+				test.Timeout = timeout
+			}
+		}
+		if params, ok := getParams(retryRegexp, fn.Comment()); ok {
+			retries, err := strconv.Atoi(params[0])
+			if err != nil || len(params) != 1 || retries < 0 {
+				warn(fn.Position(), "@retry must have one non-negative number argument '%s'", fn.Comment())
+			} else {
+				test.Retries = retries
+			}
+		}
+		test.ExpectFailure = xfailRegexp.MatchString(fn.Comment())
+		test.Capture = captureRegexp.MatchString(fn.Comment())
+		for _, match := range envRegexp.FindAllStringSubmatch(fn.Comment(), -1) {
+			for _, param := range strings.Split(match[1], ",") {
+				param = strings.TrimSpace(param)
+				if key, _ := splitParam(param); !strings.Contains(param, "=") || !envKeyRegexp.MatchString(key) {
+					warn(fn.Position(), "@env parameter must be KEY=value '%s'", param)
+					continue
 				}
+				test.Env = append(test.Env, param)
+			}
+		}
+		res.Tests = append(res.Tests, test)
+	}
+
+	addExample := func(fn *Function, labels []string) {
+		if strings.HasPrefix(fn.Name(), "Example") {
+			warn(fn.Position(), "@example on '%s' is ignored; go test already runs Example functions", fn.Name())
+			return
+		}
+		if fn.Decl.Recv != nil || fn.Decl.Type.Params.NumFields() > 0 || fn.Decl.Type.Results.NumFields() > 0 {
+			warn(fn.Position(), "@example must be a function without parameters and results '%s'", fn.Name())
+			return
+		}
+		output, unordered, ok := fn.exampleOutput()
+		if !ok {
+			warn(fn.Position(), "@example has no output comment '%s'; an example without output is never run", fn.Name())
+			return
+		}
+		res.Examples = append(res.Examples, &ExampleFunction{Function: fn, Labels: labels, Output: output, Unordered: unordered})
+	}
+
+	for _, typ := range parseResult.types {
+		switch {
+		case typ.commentMatches(fixtureRegexp):
+			if _, ok := typ.Spec.Type.(*ast.StructType); !ok {
+				warn(typ.Position(), "@fixture is only supported on struct types '%s'", typ.Name())
+				continue
 			}
+			res.TypeFixtures = append(res.TypeFixtures, typ)
+		case typ.commentMatches(onceFixtureRegexp):
+			warn(typ.Position(), "@onceFixture is not supported on types '%s'", typ.Name())
 		}
+	}
 
-		return labels, ok
+	structs := map[string]*TypeDecl{}
+	for _, typ := range parseResult.types {
+		if _, ok := typ.Spec.Type.(*ast.StructType); ok {
+			structs[typ.Name()] = typ
+		}
+	}
+	typeFixtures := map[string]bool{}
+	for _, typ := range res.TypeFixtures {
+		typeFixtures[typ.Name()] = true
 	}
 
 funcLoop:
@@ -179,72 +762,411 @@ funcLoop:
 			res.Package = fn.Package
 		}
 
+		annotations := fn.kindAnnotations()
+		if len(annotations) > 1 {
+			warn(fn.Position(), "conflicting annotations %s on '%s'; using %s", strings.Join(annotations, ", "), fn.Name(), annotations[0])
+		}
+
+		// Generic functions must be instantiated to be registered, so the
+		// generated code would not compile.
+		if fn.isGeneric() {
+			if len(annotations) > 0 {
+				warn(fn.Position(), "%s is not supported on generic function '%s'; annotate a function calling an instantiation of it", annotations[0], fn.Name())
+			}
+			decide(fn, "skipped, generic function")
+			continue funcLoop
+		}
+
+		// Methods are only annotated on suites, which are struct types of the package.
+		// Examples warn about receivers themselves.
+		if fn.Decl.Recv != nil && len(annotations) > 0 && annotations[0] != ExampleAnnotation {
+			switch annotations[0] {
+			case TestAnnotation, FixtureAnnotation, BeforeTestAnnotation, AfterTestAnnotation:
+			default:
+				warn(fn.Position(), "%s is not supported on methods '%s'", annotations[0], fn.Name())
+				decide(fn, "skipped, %s is not supported on methods", annotations[0])
+				continue funcLoop
+			}
+			suite, ok := structs[fn.Receiver()]
+			if !ok {
+				warn(fn.Position(), "%s on '%s' must have a struct type of the package as receiver", annotations[0], fn.Name())
+				decide(fn, "skipped, the receiver is not a struct type of the package")
+				continue funcLoop
+			}
+			if !typeFixtures[suite.Name()] {
+				typeFixtures[suite.Name()] = true
+				res.Suites = append(res.Suites, suite)
+			}
+		}
+
 		// Check function annotations
+		if len(annotations) > 0 {
+			decide(fn, "registered by annotation %s", annotations[0])
+		}
 		switch {
 		case fn.HasTestAnnotation():
-			labels, ok := parseLabels(testRegexp, fn, []string{res.DefaultTestLabel})
+			labels, options, ok := parseLabels(testRegexp, fn, []string{res.DefaultTestLabel})
+			if ok {
+				addTest(fn, labels, options)
+			} else {
+				warn(fn.Position(), "@test parameters could not be parsed '%s'", fn.Comment())
+			}
+			continue funcLoop
+		case fn.HasExampleAnnotation():
+			labels, options, ok := parseLabels(exampleRegexp, fn, []string{res.DefaultTestLabel})
+			for _, option := range options {
+				warn(fn.Position(), "unknown @example parameter '%s' in '%s'", option, fn.Comment())
+			}
 			if ok {
-				res.Tests = append(res.Tests, &LabelFunction{Function: fn, Labels: labels})
+				addExample(fn, labels)
 			} else {
-				res.Warnings = append(res.Warnings, fmt.Sprintf("@test parameters could not be parsed '%s'", fn.Comment()))
+				warn(fn.Position(), "@example parameters could not be parsed '%s'", fn.Comment())
 			}
 			continue funcLoop
 		case fn.HasFixtureAnnotation():
-			res.Fixtures = append(res.Fixtures, fn)
+			addFixture(fn, fixtureRegexp, false)
 			continue funcLoop
 		case fn.HasOnceFixtureAnnotation():
-			res.OnceFixtures = append(res.OnceFixtures, fn)
+			addFixture(fn, onceFixtureRegexp, true)
 			continue funcLoop
 		case fn.HasBeforeTestAnnotation():
-			res.BeforeTests = append(res.BeforeTests, fn)
+			addHook(&res.BeforeTests, fn, beforeTestRegexp)
 			continue funcLoop
 		case fn.HasAfterTestAnnotation():
-			res.AfterTests = append(res.AfterTests, fn)
+			addHook(&res.AfterTests, fn, afterTestRegexp)
+			continue funcLoop
+		case fn.HasBeforeAllAnnotation():
+			res.BeforeAll = append(res.BeforeAll, fn)
+			continue funcLoop
+		case fn.HasAfterAllAnnotation():
+			res.AfterAll = append(res.AfterAll, fn)
 			continue funcLoop
 		}
 
-		if autoLabel {
+		if autoLabel && fn.Decl.Recv == nil {
 			// Check auto grouping
 			for _, prefix := range fixtureMatcher {
 				if prefixMatch(fn.Name(), prefix) {
-					res.Fixtures = append(res.Fixtures, fn)
+					decide(fn, "fixture by matched prefix %s", prefix)
+					addFixture(fn, nil, false)
 					continue funcLoop
 				}
 			}
 
 			for _, prefix := range beforeTestMatcher {
 				if prefixMatch(fn.Name(), prefix) {
-					res.BeforeTests = append(res.BeforeTests, fn)
+					decide(fn, "before test hook by matched prefix %s", prefix)
+					addHook(&res.BeforeTests, fn, nil)
 					continue funcLoop
 				}
 			}
 
 			for _, prefix := range afterTestMatcher {
 				if prefixMatch(fn.Name(), prefix) {
-					res.AfterTests = append(res.AfterTests, fn)
+					decide(fn, "after test hook by matched prefix %s", prefix)
+					addHook(&res.AfterTests, fn, nil)
 					continue funcLoop
 				}
 			}
 
 			var labels []string
+			// matched holds the matcher of every label.
+			matched := map[string]string{}
 		labelLoop:
-			for label, prefixes := range res.TestLabels {
-				for _, prefix := range prefixes {
-					if strings.HasPrefix(fn.Name(), prefix) {
+			for label, matchers := range res.TestLabels {
+				for _, matcher := range matchers {
+					if re, ok := labelRegexps[matcher]; ok && re.MatchString(fn.Name()) || !ok && strings.HasPrefix(fn.Name(), matcher) {
 						labels = append(labels, label)
+						matched[label] = matcher
 						continue labelLoop
 					}
 				}
 			}
 			if len(labels) > 0 {
-				res.Tests = append(res.Tests, &LabelFunction{Function: fn, Labels: labels})
+				sort.Strings(labels)
+				reasons := make([]string, len(labels))
+				for i, label := range labels {
+					kind := "prefix"
+					if _, ok := labelRegexps[matched[label]]; ok {
+						kind = "regexp"
+					}
+					reasons[i] = fmt.Sprintf("%s by label %s %s", label, kind, matched[label])
+				}
+				decide(fn, "test with labels %s", strings.Join(reasons, ", "))
+				addTest(fn, labels, nil)
+				continue funcLoop
+			}
+			if o.WarnUnmatched && fn.looksLikeTest() {
+				warn(fn.Position(), "'%s' looks like a test but matches no label; annotate it with @test or rename it", fn.Name())
 			}
+			decide(fn, "skipped, matches no prefix or label")
+			continue funcLoop
+		}
+		decide(fn, "skipped, not annotated")
+	}
+
+	for _, label := range sortedLabels(res.LabelParallelism) {
+		if _, ok := res.TestLabels[label]; !ok {
+			warn(parallelismPos[label], "@parallelism of unknown label '%s'", label)
+		}
+	}
+
+	// Without tests the fixtures are used by tests registered by hand, if at all.
+	if len(res.Tests) > 0 {
+		warnUnusedFixtures(res, parseResult, warn)
+		if !o.NoWarnUnsatisfiable {
+			warnUnsatisfiableTests(res, parseResult, warn)
 		}
 	}
 
 	return res, nil
 }
 
+// warnUnusedFixtures warns about the fixtures providing no type which is a
+// parameter of a test, a hook, a fixture or a function literal, like a subtest
+// passed to t.Run. Types are compared as written, and the fields of dig.In
+// structs declared in the package count as parameters. Fixtures of a group are
+// not checked.
+func warnUnusedFixtures(res *ParseResult, parseResult *parseResult, warn func(token.Position, string, ...interface{})) {
+	structs := map[string]*ast.StructType{}
+	for _, typ := range parseResult.types {
+		if s, ok := typ.Spec.Type.(*ast.StructType); ok {
+			structs[typ.Spec.Name.Name] = s
+		}
+	}
+
+	used := map[string]bool{}
+	var useFields func(fields *ast.FieldList)
+	useFields = func(fields *ast.FieldList) {
+		if fields == nil {
+			return
+		}
+		for _, field := range fields.List {
+			typ := field.Type
+			if ellipsis, ok := typ.(*ast.Ellipsis); ok {
+				typ = ellipsis.Elt
+			}
+			used[types.ExprString(typ)] = true
+			// Structs are expanded once, so recursive structs end.
+			if ident, ok := typ.(*ast.Ident); ok && structs[ident.Name] != nil && embedsDigIn(structs[ident.Name]) {
+				s := structs[ident.Name]
+				delete(structs, ident.Name)
+				useFields(s.Fields)
+			}
+		}
+	}
+	for _, fn := range parseResult.functions {
+		// The receiver of a method is provided by the fixture of its suite.
+		useFields(fn.Decl.Recv)
+		useFields(fn.Decl.Type.Params)
+		if fn.Decl.Body == nil {
+			continue
+		}
+		ast.Inspect(fn.Decl.Body, func(node ast.Node) bool {
+			if lit, ok := node.(*ast.FuncLit); ok {
+				useFields(lit.Type.Params)
+			}
+			return true
+		})
+	}
+
+	fixtures := append(append([]*FixtureFunction{}, res.Fixtures...), res.OnceFixtures...)
+	for _, name := range sortedModules(res.Modules) {
+		fixtures = append(fixtures, res.Modules[name].Fixtures...)
+		fixtures = append(fixtures, res.Modules[name].OnceFixtures...)
+	}
+	for _, fixture := range fixtures {
+		if fixture.Group != "" {
+			continue
+		}
+
+		provided := providedTypes(fixture)
+		isUsed := len(provided) == 0
+		for _, typ := range provided {
+			isUsed = isUsed || used[typ]
+		}
+		if !isUsed {
+			warn(fixture.Position(), "fixture '%s' provides %s which is not used by any test, hook or fixture", fixture.Name(), strings.Join(provided, ", "))
+		}
+	}
+
+	for _, typ := range res.TypeFixtures {
+		if !used["*"+typ.Name()] {
+			warn(typ.Position(), "fixture '%s' provides *%s which is not used by any test, hook or fixture", typ.Name(), typ.Name())
+		}
+	}
+}
+
+// providedTypes returns the types the fixture provides as written, like
+// func(func(*Database)) for locked fixtures.
+func providedTypes(fixture *FixtureFunction) []string {
+	var res []string
+	for _, typ := range fixture.As {
+		res = append(res, typ.Expr)
+	}
+	if results := fixture.Decl.Type.Results; results != nil {
+		for _, field := range results.List {
+			typ := types.ExprString(field.Type)
+			if typ == "error" {
+				continue
+			}
+			if fixture.Locked {
+				typ = "func(func(" + typ + "))"
+			}
+			res = append(res, typ)
+		}
+	}
+	return res
+}
+
+// tediImportPath is the import path of the tedi package.
+const tediImportPath = "github.com/jstroem/tedi"
+
+// builtinParams are the types tedi provides to every test, by the import path
+// of their package and the type with %s in place of the name of the package.
+var builtinParams = []struct {
+	path, typ string
+}{
+	{"testing", "*%s.T"},
+	{"testing", "%s.TB"},
+	{"context", "%s.Context"},
+	{"math/rand", "*%s.Rand"},
+	{tediImportPath, "*%s.T"},
+	{tediImportPath, "%s.TestInfo"},
+	{tediImportPath, "%s.Cleanup"},
+	{tediImportPath, "*%s.Logger"},
+	{tediImportPath, "%s.TempDir"},
+	{tediImportPath, "*%s.Tedi"},
+	{"github.com/stretchr/testify/assert", "*%s.Assertions"},
+	{"github.com/stretchr/testify/require", "*%s.Assertions"},
+}
+
+// warnUnsatisfiableTests warns about the parameters of tests which neither a
+// fixture nor tedi provides, as the test would fail to be invoked. Types are
+// compared as written, so a fixture providing an alias or an interface the
+// parameter type is satisfied by is not recognized. Parameters which are
+// variadic or dig.In structs declared in the package are not checked, and the
+// fields of dig.Out structs declared in the package are provided.
+func warnUnsatisfiableTests(res *ParseResult, parseResult *parseResult, warn func(token.Position, string, ...interface{})) {
+	structs := map[string]*ast.StructType{}
+	for _, typ := range parseResult.types {
+		if s, ok := typ.Spec.Type.(*ast.StructType); ok {
+			structs[typ.Spec.Name.Name] = s
+		}
+	}
+
+	provided := map[string]bool{}
+	fixtures := append(append([]*FixtureFunction{}, res.Fixtures...), res.OnceFixtures...)
+	for _, name := range sortedModules(res.Modules) {
+		fixtures = append(fixtures, res.Modules[name].Fixtures...)
+		fixtures = append(fixtures, res.Modules[name].OnceFixtures...)
+	}
+	for _, fixture := range fixtures {
+		for _, typ := range providedTypes(fixture) {
+			s := structs[typ]
+			if s == nil || !embedsDigOut(s) {
+				provided[typ] = true
+				continue
+			}
+			for _, field := range s.Fields.List {
+				if len(field.Names) > 0 {
+					provided[types.ExprString(field.Type)] = true
+				}
+			}
+		}
+	}
+	for _, typ := range res.TypeFixtures {
+		provided["*"+typ.Name()] = true
+	}
+
+	for _, test := range res.Tests {
+		// The builtin types are written with the names their packages are
+		// imported with, which are their default names if not renamed.
+		builtin := map[string]bool{}
+		for _, param := range builtinParams {
+			builtin[fmt.Sprintf(param.typ, param.path[strings.LastIndex(param.path, "/")+1:])] = true
+		}
+		if file := test.Package.Files[test.File]; file != nil {
+			for _, imp := range file.Imports {
+				path, err := strconv.Unquote(imp.Path.Value)
+				if err != nil {
+					continue
+				}
+				name := path[strings.LastIndex(path, "/")+1:]
+				if imp.Name != nil {
+					name = imp.Name.Name
+				}
+				for _, param := range builtinParams {
+					if param.path == path {
+						builtin[fmt.Sprintf(param.typ, name)] = true
+					}
+				}
+			}
+		}
+
+		for _, field := range test.Decl.Type.Params.List {
+			if _, ok := field.Type.(*ast.Ellipsis); ok {
+				continue
+			}
+			if ident, ok := field.Type.(*ast.Ident); ok && structs[ident.Name] != nil && embedsDigIn(structs[ident.Name]) {
+				continue
+			}
+			typ := types.ExprString(field.Type)
+			if !provided[typ] && !builtin[typ] {
+				warn(test.Position(), "test '%s' depends on %s which is not provided by any fixture", test.Name(), typ)
+			}
+		}
+	}
+}
+
+// sortedModules returns the names of the modules in a stable order.
+func sortedModules(modules map[string]*Module) []string {
+	res := make([]string, 0, len(modules))
+	for name := range modules {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// embedsDigIn returns true if the struct embeds dig.In, so dig injects its fields.
+func embedsDigIn(s *ast.StructType) bool {
+	return embedsDig(s, "In")
+}
+
+// embedsDigOut returns true if the struct embeds dig.Out, so dig provides its fields.
+func embedsDigOut(s *ast.StructType) bool {
+	return embedsDig(s, "Out")
+}
+
+func embedsDig(s *ast.StructType, name string) bool {
+	for _, field := range s.Fields.List {
+		if sel, ok := field.Type.(*ast.SelectorExpr); ok && len(field.Names) == 0 && sel.Sel.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedLabels(labels map[string]int) []string {
+	res := make([]string, 0, len(labels))
+	for label := range labels {
+		res = append(res, label)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// isRegexpMatcher returns true if the @testLabel matcher is a /regexp/.
+func isRegexpMatcher(matcher string) bool {
+	return len(matcher) > 2 && strings.HasPrefix(matcher, "/") && strings.HasSuffix(matcher, "/")
+}
+
+// isDescription returns true if the @testLabel parameter is a quoted description.
+func isDescription(param string) bool {
+	return len(param) >= 2 && strings.HasPrefix(param, `"`) && strings.HasSuffix(param, `"`)
+}
+
 func prefixMatch(str, prefix string) bool {
 	if !strings.HasPrefix(str, prefix) {
 		return false
@@ -259,12 +1181,21 @@ func prefixMatch(str, prefix string) bool {
 // Function represents a function declaration.
 type Function struct {
 	File    string
+	Fset    *token.FileSet
 	Package *ast.Package
 	Decl    *ast.FuncDecl
 }
 
 func (f *Function) String() string {
-	return fmt.Sprintf(`{"file":"%s","line":%d,"name":"%s", "comment":"%s"}`, f.File, f.Decl.Pos(), f.Decl.Name, f.Decl.Doc.Text())
+	return fmt.Sprintf(`{"file":"%s","line":%d,"name":"%s", "comment":"%s"}`, f.File, f.Position().Line, f.Decl.Name, f.Decl.Doc.Text())
+}
+
+// Position returns the position of the function declaration.
+func (f *Function) Position() token.Position {
+	if f.Fset == nil {
+		return token.Position{Filename: f.File}
+	}
+	return f.Fset.Position(f.Decl.Pos())
 }
 
 // HasTestAnnotation returns true if the function has a test annotation.
@@ -272,6 +1203,11 @@ func (f *Function) HasTestAnnotation() bool {
 	return f.commentMatches(testRegexp)
 }
 
+// HasExampleAnnotation returns true if the function has an example annotation.
+func (f *Function) HasExampleAnnotation() bool {
+	return f.commentMatches(exampleRegexp)
+}
+
 // HasFixtureAnnotation returns true if the function has a fixture annotation.
 func (f *Function) HasFixtureAnnotation() bool {
 	return f.commentMatches(fixtureRegexp)
@@ -292,51 +1228,342 @@ func (f *Function) HasAfterTestAnnotation() bool {
 	return f.commentMatches(afterTestRegexp)
 }
 
+// HasBeforeAllAnnotation returns true if the function has a beforeAll annotation.
+func (f *Function) HasBeforeAllAnnotation() bool {
+	return f.commentMatches(beforeAllRegexp)
+}
+
+// HasAfterAllAnnotation returns true if the function has a afterAll annotation.
+func (f *Function) HasAfterAllAnnotation() bool {
+	return f.commentMatches(afterAllRegexp)
+}
+
+// kindAnnotations returns the annotations of the function deciding what kind
+// of function it is, in the order they take precedence.
+func (f *Function) kindAnnotations() []string {
+	var res []string
+	for _, kind := range []struct {
+		annotation string
+		regexp     *regexp.Regexp
+	}{
+		{TestAnnotation, testRegexp},
+		{ExampleAnnotation, exampleRegexp},
+		{FixtureAnnotation, fixtureRegexp},
+		{OnceFixtureAnnotation, onceFixtureRegexp},
+		{BeforeTestAnnotation, beforeTestRegexp},
+		{AfterTestAnnotation, afterTestRegexp},
+		{BeforeAllAnnotation, beforeAllRegexp},
+		{AfterAllAnnotation, afterAllRegexp},
+	} {
+		if f.commentMatches(kind.regexp) {
+			res = append(res, kind.annotation)
+		}
+	}
+	return res
+}
+
 func (f *Function) commentMatches(regex *regexp.Regexp) bool {
 	return regex.MatchString(f.Comment())
 }
 
+// resolveType resolves the package of a type expression, like io.Writer, from
+// the imports of the file declaring the function.
+func (f *Function) resolveType(expr string) (*Type, error) {
+	idx := strings.Index(expr, ".")
+	if idx < 0 {
+		return &Type{Expr: expr}, nil
+	}
+
+	name := expr[:idx]
+	if file, ok := f.Package.Files[f.File]; ok {
+		for _, imp := range file.Imports {
+			path, err := strconv.Unquote(imp.Path.Value)
+			if err != nil {
+				continue
+			}
+			importName := path[strings.LastIndex(path, "/")+1:]
+			if imp.Name != nil {
+				importName = imp.Name.Name
+			}
+			if importName == name {
+				return &Type{Expr: expr, ImportName: name, ImportPath: path}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("package '%s' of type '%s' is not imported", name, expr)
+}
+
+// looksLikeTest returns true if the function has a *testing.T or *tedi.T
+// parameter, but is not run by go test itself like TestXxx functions.
+func (f *Function) looksLikeTest() bool {
+	if name := f.Name(); strings.HasPrefix(name, "Test") && (len(name) == 4 || !unicode.IsLower(rune(name[4]))) {
+		return false
+	}
+	for _, field := range f.Decl.Type.Params.List {
+		star, ok := field.Type.(*ast.StarExpr)
+		if !ok {
+			continue
+		}
+		sel, ok := star.X.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "T" {
+			continue
+		}
+		// The packages are known by their default names if the imports are missing.
+		if typ, err := f.resolveType(types.ExprString(sel)); err == nil {
+			if typ.ImportPath == "testing" || typ.ImportPath == tediImportPath {
+				return true
+			}
+		} else if pkg := types.ExprString(sel.X); pkg == "testing" || pkg == "tedi" {
+			return true
+		}
+	}
+	return false
+}
+
+// outputPrefix matches the start of the output comment of an example, like go test does.
+var outputPrefix = regexp.MustCompile(`(?i)^[[:space:]]*(unordered )?output:`)
+
+// exampleOutput returns the expected output from the last comment in the body
+// of the function and false if the function has no output comment.
+func (f *Function) exampleOutput() (string, bool, bool) {
+	file, ok := f.Package.Files[f.File]
+	if !ok || f.Decl.Body == nil {
+		return "", false, false
+	}
+
+	var last *ast.CommentGroup
+	for _, cmt := range file.Comments {
+		if cmt.Pos() > f.Decl.Body.Lbrace && cmt.End() < f.Decl.Body.Rbrace {
+			last = cmt
+		}
+	}
+	if last == nil {
+		return "", false, false
+	}
+
+	text := last.Text()
+	loc := outputPrefix.FindStringSubmatchIndex(text)
+	if loc == nil {
+		return "", false, false
+	}
+	unordered := loc[2] >= 0
+	return strings.TrimSpace(text[loc[1]:]), unordered, true
+}
+
+// Name returns the name of the function, or suite.method for methods.
 func (f *Function) Name() string {
+	if receiver := f.Receiver(); receiver != "" {
+		return receiver + "." + f.Decl.Name.String()
+	}
+	return f.Decl.Name.String()
+}
+
+// Receiver returns the name of the receiver type of a method; empty for functions.
+func (f *Function) Receiver() string {
+	if f.Decl.Recv == nil || len(f.Decl.Recv.List) == 0 {
+		return ""
+	}
+	typ := f.Decl.Recv.List[0].Type
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+	if ident, ok := typ.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+// Expr returns the expression referencing the function, which is the method
+// expression (*suite).method for methods, taking the suite pointer as first parameter.
+func (f *Function) Expr() string {
+	if receiver := f.Receiver(); receiver != "" {
+		return fmt.Sprintf("(*%s).%s", receiver, f.Decl.Name)
+	}
 	return f.Decl.Name.String()
 }
 
 func (f *Function) Comment() string {
-	return f.Decl.Doc.Text()
+	return commentText(f.Decl.Doc)
+}
+
+// TypeDecl represents a type declaration.
+type TypeDecl struct {
+	File    string
+	Fset    *token.FileSet
+	Package *ast.Package
+	Spec    *ast.TypeSpec
+	// Doc is the comment of the type spec, or of its declaration if the spec is not grouped.
+	Doc *ast.CommentGroup
+}
+
+// Position returns the position of the type declaration.
+func (t *TypeDecl) Position() token.Position {
+	if t.Fset == nil {
+		return token.Position{Filename: t.File}
+	}
+	return t.Fset.Position(t.Spec.Pos())
+}
+
+func (t *TypeDecl) commentMatches(regex *regexp.Regexp) bool {
+	return regex.MatchString(t.Comment())
+}
+
+func (t *TypeDecl) Name() string {
+	return t.Spec.Name.String()
+}
+
+func (t *TypeDecl) Comment() string {
+	return commentText(t.Doc)
+}
+
+// commentText returns the text of the comment group like CommentGroup.Text. Lines
+// of block comments decorated with a leading * are undecorated, so annotations
+// can be written as
+//
+//	/*
+//	 * @test
+//	 */
+func commentText(doc *ast.CommentGroup) string {
+	if doc == nil || !hasBlockComment(doc) {
+		return doc.Text()
+	}
+
+	lines := strings.Split(doc.Text(), "\n")
+	for i, line := range lines {
+		if trimmed := strings.TrimLeft(line, " \t"); strings.HasPrefix(trimmed, "*") {
+			lines[i] = strings.TrimLeft(trimmed[1:], " \t")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func hasBlockComment(doc *ast.CommentGroup) bool {
+	for _, cmt := range doc.List {
+		if strings.HasPrefix(cmt.Text, "/*") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameLineDoc returns the block comment group ending on the line of pos before
+// it, like /* @test */ func foo(), which go/parser does not associate as doc.
+func sameLineDoc(fset *token.FileSet, file *ast.File, pos token.Pos) *ast.CommentGroup {
+	line := fset.Position(pos).Line
+	for _, cmt := range file.Comments {
+		if cmt.End() <= pos && fset.Position(cmt.End()).Line == line {
+			return cmt
+		}
+	}
+	return nil
 }
 
 type parseResult struct {
 	functions []*Function
-	comments  []string
+	types     []*TypeDecl
+	comments  []comment
+}
+
+type comment struct {
+	text string
+	pos  token.Position
+}
+
+func sortedKeys(pkgs map[string]*ast.Package) []string {
+	res := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// typeDecls returns the type declarations of decl.
+func typeDecls(decl *ast.GenDecl, pkg *ast.Package, fileName string, fset *token.FileSet) []*TypeDecl {
+	if decl.Tok != token.TYPE {
+		return nil
+	}
+
+	var res []*TypeDecl
+	for _, spec := range decl.Specs {
+		spec := spec.(*ast.TypeSpec)
+		doc := spec.Doc
+		if doc == nil && !decl.Lparen.IsValid() {
+			doc = decl.Doc
+		}
+		res = append(res, &TypeDecl{Package: pkg, File: fileName, Fset: fset, Spec: spec, Doc: doc})
+	}
+	return res
+}
+
+// addFile adds the functions, types and comments of the file of pkg.
+func (res *parseResult) addFile(pkg *ast.Package, fileName string, file *ast.File, fset *token.FileSet) {
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Doc == nil {
+				decl.Doc = sameLineDoc(fset, file, decl.Pos())
+			}
+			res.functions = append(res.functions, &Function{Package: pkg, File: fileName, Fset: fset, Decl: decl})
+		case *ast.GenDecl:
+			if decl.Doc == nil {
+				decl.Doc = sameLineDoc(fset, file, decl.Pos())
+			}
+			res.types = append(res.types, typeDecls(decl, pkg, fileName, fset)...)
+		}
+	}
+	for _, cmt := range file.Comments {
+		res.comments = append(res.comments, comment{text: commentText(cmt), pos: fset.Position(cmt.Pos())})
+	}
 }
 
-func parsePackage(pkg string, filePrefix string) (*parseResult, error) {
+// parsePackage parses the files of the package matching any of matches. If
+// tags is not nil, only the files whose build constraints are satisfied by the
+// tags are parsed.
+func parsePackage(pkg string, tags []string, matches ...func(name string) bool) (*parseResult, error) {
 	fset := token.NewFileSet()
 
+	// parser.ParseDir does not apply build constraints, so they are matched
+	// like go build would with the tags set.
+	ctx := build.Default
+	ctx.BuildTags = tags
+
 	pkgs, err := parser.ParseDir(fset, pkg, func(fi os.FileInfo) bool {
-		return strings.HasSuffix(fi.Name(), filePrefix)
+		if tags != nil {
+			if ok, err := ctx.MatchFile(pkg, fi.Name()); err == nil && !ok {
+				return false
+			}
+		}
+		for _, match := range matches {
+			if match(fi.Name()) {
+				return true
+			}
+		}
+		return false
 	}, parser.ParseComments)
 
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to parse package %s: %w", pkg, err)
 	}
+	return parsePackages(pkgs, fset), nil
+}
 
+// parsePackages collects the functions, types and comments of the parsed packages.
+func parsePackages(pkgs map[string]*ast.Package, fset *token.FileSet) *parseResult {
 	res := &parseResult{}
 
-	for pkgName := range pkgs {
+	// Iterate in a stable order so the generated file does not change between runs.
+	for _, pkgName := range sortedKeys(pkgs) {
 		pkg := pkgs[pkgName]
-		for fileName, file := range pkg.Files {
+		fileNames := make([]string, 0, len(pkg.Files))
+		for fileName := range pkg.Files {
+			fileNames = append(fileNames, fileName)
+		}
+		sort.Strings(fileNames)
 
-			for _, decl := range file.Decls {
-				switch decl := decl.(type) {
-				case *ast.FuncDecl:
-					res.functions = append(res.functions, &Function{Package: pkg, File: fileName, Decl: decl})
-				}
-			}
-			for _, cmt := range file.Comments {
-				res.comments = append(res.comments, cmt.Text())
-			}
+		for _, fileName := range fileNames {
+			res.addFile(pkg, fileName, pkg.Files[fileName], fset)
 		}
 	}
-
-	return res, nil
+	return res
 }
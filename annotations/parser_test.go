@@ -1,10 +1,15 @@
 package annotations
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_annotationRegexp(t *testing.T) {
@@ -30,6 +35,7 @@ func Test_annotationWithParamsRegexp(t *testing.T) {
 some other comment`))
 	assert.True(t, regexp.MatchString(`some other comment
 @foo(foo, bar, baz)`))
+	assert.True(t, regexp.MatchString("@foo(foo=bar, baz)"))
 	assert.False(t, regexp.MatchString("@foo"))
 }
 func Test_annotationWithOptionalParamsRegexp(t *testing.T) {
@@ -88,6 +94,30 @@ func Test_getParams(t *testing.T) {
 			ok:     true,
 			res:    []string{"foo", "bar", "baz"},
 		},
+		{
+			in:     "@foo( foo ,bar  ,  baz )",
+			regexp: annotationWithParamsRegexp("@foo"),
+			ok:     true,
+			res:    []string{"foo", "bar", "baz"},
+		},
+		{
+			in:     "@test( a ,b )",
+			regexp: annotationWithOptionalParamsRegexp("@test"),
+			ok:     true,
+			res:    []string{"a", "b"},
+		},
+		{
+			in:     `@test("my-label", unit)`,
+			regexp: annotationWithOptionalParamsRegexp("@test"),
+			ok:     true,
+			res:    []string{"my-label", "unit"},
+		},
+		{
+			in:     `@foo("a, b", "say \"hi\"")`,
+			regexp: annotationWithParamsRegexp("@foo"),
+			ok:     true,
+			res:    []string{"a, b", `say "hi"`},
+		},
 	}
 
 	for _, test := range tests {
@@ -99,3 +129,1026 @@ func Test_getParams(t *testing.T) {
 		})
 	}
 }
+
+func parseSource(t *testing.T, src string, autoLabel bool) *ParseResult {
+	res, err := ParseFiles(map[string][]byte{"source_test.go": []byte(src)}, autoLabel)
+	require.NoError(t, err)
+	return res
+}
+
+func Test_parseTimeout(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @test
+// @timeout(1m30s)
+func withTimeout() {}
+
+// @test
+// @timeout(soon)
+func invalidTimeout() {}
+`, false)
+
+	if assert.Len(t, res.Tests, 2) {
+		assert.Equal(t, 90*time.Second, res.Tests[0].Timeout)
+		assert.Equal(t, time.Duration(0), res.Tests[1].Timeout)
+	}
+	assert.Len(t, res.Warnings, 1)
+}
+
+func Test_parseRetry(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @test
+// @retry(2)
+func withRetry() {}
+
+// @test
+// @retry(often)
+func invalidRetry() {}
+`, false)
+
+	if assert.Len(t, res.Tests, 2) {
+		assert.Equal(t, 2, res.Tests[0].Retries)
+		assert.Equal(t, 0, res.Tests[1].Retries)
+	}
+	assert.Len(t, res.Warnings, 1)
+}
+
+func Test_parseWeight(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @test(integration, weight=5)
+func heavyTest() {}
+
+// @test(weight=2)
+func defaultLabelTest() {}
+
+// @test
+func lightTest() {}
+
+// @test(weight=0, size=big)
+func invalidTest() {}
+`, false)
+
+	if assert.Len(t, res.Tests, 4) {
+		assert.Equal(t, []string{"integration"}, res.Tests[0].Labels)
+		assert.Equal(t, 5, res.Tests[0].Weight)
+		assert.Equal(t, []string{"unit"}, res.Tests[1].Labels)
+		assert.Equal(t, 2, res.Tests[1].Weight)
+		assert.Equal(t, DefaultWeight, res.Tests[2].Weight)
+		assert.Equal(t, DefaultWeight, res.Tests[3].Weight)
+	}
+	assert.NotContains(t, res.TestLabels, "weight=5")
+	if assert.Len(t, res.Warnings, 2) {
+		assert.Contains(t, res.Warnings[0], "weight must be a positive number")
+		assert.Contains(t, res.Warnings[1], "unknown @test parameter 'size=big'")
+	}
+}
+
+func Test_parseBlockComments(t *testing.T) {
+	res := parseSource(t, `package foo
+
+/* @test */
+func blockTest() {}
+
+/*
+ * @test(integration)
+ * @timeout(1m)
+ */
+func decoratedTest() {}
+
+/* @fixture */ func newDB() *DB {}
+
+// queryTest checks the queries.
+//
+// It is labeled after its description:
+// @test(regression)
+func queryTest(db *DB, c *client) {}
+
+/* @testLabel(e2e, /^e2e/) */
+
+/* @fixture */ type client struct{}
+`, false)
+
+	if assert.Len(t, res.Tests, 3) {
+		assert.Equal(t, "blockTest", res.Tests[0].Name())
+		assert.Equal(t, []string{"unit"}, res.Tests[0].Labels)
+		assert.Equal(t, "decoratedTest", res.Tests[1].Name())
+		assert.Equal(t, []string{"integration"}, res.Tests[1].Labels)
+		assert.Equal(t, time.Minute, res.Tests[1].Timeout)
+		assert.Equal(t, []string{"regression"}, res.Tests[2].Labels)
+	}
+	if assert.Len(t, res.Fixtures, 1) {
+		assert.Equal(t, "newDB", res.Fixtures[0].Name())
+	}
+	assert.Len(t, res.TypeFixtures, 1)
+	assert.Contains(t, res.TestLabels, "e2e")
+	assert.Empty(t, res.Warnings)
+}
+
+func Test_parseDefaultLabel(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @defaultLabel(integration)
+
+// @defaultLabel(integration)
+
+// @defaultLabel(regression)
+
+// @test
+func queryTest() {}
+
+// @test(unit)
+func unitTest() {}
+`, false)
+
+	assert.Equal(t, "integration", res.DefaultTestLabel)
+	if assert.Len(t, res.Tests, 2) {
+		assert.Equal(t, []string{"integration"}, res.Tests[0].Labels)
+		assert.Equal(t, []string{"unit"}, res.Tests[1].Labels)
+	}
+	if assert.Len(t, res.Warnings, 1) {
+		assert.Contains(t, res.Warnings[0], "source_test.go:7: conflicting @defaultLabel(regression); using 'integration' of source_test.go:3")
+	}
+
+	// A label only declared by @defaultLabel is added to the labels.
+	res = parseSource(t, `package foo
+
+// @defaultLabel(smoke)
+
+// @test
+func smokeTest() {}
+`, false)
+	assert.Contains(t, res.TestLabels, "smoke")
+	if assert.Len(t, res.Tests, 1) {
+		assert.Equal(t, []string{"smoke"}, res.Tests[0].Labels)
+	}
+	assert.Empty(t, res.Warnings)
+}
+
+func Test_parseEnv(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @test
+// @env(DB_HOST=localhost, DB_URL=postgres://db:5432/test)
+// @env(DEBUG=)
+// @env(MISSING, 1KEY=value)
+func withEnv() {}
+`, false)
+
+	if assert.Len(t, res.Tests, 1) {
+		assert.Equal(t, []string{"DB_HOST=localhost", "DB_URL=postgres://db:5432/test", "DEBUG="}, res.Tests[0].Env)
+	}
+	if assert.Len(t, res.Warnings, 2) {
+		assert.Contains(t, res.Warnings[0], "@env parameter must be KEY=value 'MISSING'")
+		assert.Contains(t, res.Warnings[1], "'1KEY=value'")
+	}
+}
+
+func Test_parseModule(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @fixture
+// @module(db)
+func newDB() {}
+
+// @onceFixture
+// @module(db)
+func newPool() {}
+
+// @module(db)
+func fixConn() {}
+
+// @fixture
+func newA() {}
+`, true)
+
+	assert.Len(t, res.Fixtures, 1)
+	if assert.Contains(t, res.Modules, "db") {
+		assert.Len(t, res.Modules["db"].Fixtures, 2)
+		assert.Len(t, res.Modules["db"].OnceFixtures, 1)
+	}
+}
+
+func Test_parseFixtureGroup(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @fixture(group=handlers)
+func newHandler() {}
+
+// @onceFixture(group=handlers, locked)
+func newOnceHandler() {}
+
+// @fixture(unknown)
+func newA() {}
+`, false)
+
+	if assert.Len(t, res.Fixtures, 2) {
+		assert.Equal(t, "handlers", res.Fixtures[0].Group)
+		assert.Equal(t, "", res.Fixtures[1].Group)
+	}
+	if assert.Len(t, res.OnceFixtures, 1) {
+		assert.Equal(t, "handlers", res.OnceFixtures[0].Group)
+		assert.True(t, res.OnceFixtures[0].Locked)
+	}
+	assert.Len(t, res.Warnings, 1)
+}
+
+func Test_parseWarningPosition(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @test
+// @timeout(soon)
+func invalidTimeout() {}
+`, false)
+
+	if assert.Len(t, res.Warnings, 1) {
+		assert.Contains(t, res.Warnings[0], "source_test.go:5: @timeout")
+	}
+	if assert.Len(t, res.Tests, 1) {
+		assert.Contains(t, res.Tests[0].String(), `"line":5`)
+	}
+}
+
+func Test_parseFixtureAs(t *testing.T) {
+	res := parseSource(t, `package foo
+
+import (
+	"io"
+	pb "example.com/proto/v2"
+)
+
+// @fixture(as=io.Writer, as=Handler)
+func newBuffer() {}
+
+// @fixture(as=pb.Client)
+func newClient() {}
+
+// @fixture(as=http.Handler)
+func newServer() {}
+`, false)
+
+	if assert.Len(t, res.Fixtures, 3) {
+		assert.Equal(t, []*Type{{Expr: "io.Writer", ImportName: "io", ImportPath: "io"}, {Expr: "Handler"}}, res.Fixtures[0].As)
+		assert.Equal(t, []*Type{{Expr: "pb.Client", ImportName: "pb", ImportPath: "example.com/proto/v2"}}, res.Fixtures[1].As)
+		assert.Empty(t, res.Fixtures[2].As)
+	}
+	if assert.Len(t, res.Warnings, 1) {
+		assert.Contains(t, res.Warnings[0], "package 'http' of type 'http.Handler' is not imported")
+	}
+}
+
+func Test_parseFixturePriority(t *testing.T) {
+	res := parseSource(t, `package foo
+
+import "io"
+
+// @fixture(as=io.Writer, priority=10)
+func newBuffer() {}
+
+// @fixture(as=io.Writer)
+func newFile() {}
+
+// @fixture(priority=high)
+func newClient() {}
+
+// @fixture(priority=5)
+func newServer() {}
+`, false)
+
+	if assert.Len(t, res.Fixtures, 4) {
+		assert.Equal(t, 10, res.Fixtures[0].Priority)
+		assert.Equal(t, 0, res.Fixtures[1].Priority)
+		assert.Equal(t, 0, res.Fixtures[2].Priority)
+		assert.Equal(t, 5, res.Fixtures[3].Priority)
+	}
+	if assert.Len(t, res.Warnings, 2) {
+		assert.Contains(t, res.Warnings[0], "priority must be a number")
+		assert.Contains(t, res.Warnings[1], "priority only applies to the interfaces given by as=")
+	}
+}
+
+func Test_parseFixtureEager(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @fixture(eager)
+func startServer() {}
+
+// @onceFixture(eager)
+func startDB() {}
+
+// @fixture(group=servers, eager)
+func startOther() {}
+`, false)
+
+	if assert.Len(t, res.Fixtures, 2) {
+		assert.True(t, res.Fixtures[0].Eager)
+		assert.False(t, res.Fixtures[1].Eager)
+	}
+	if assert.Len(t, res.OnceFixtures, 1) {
+		assert.True(t, res.OnceFixtures[0].Eager)
+	}
+	if assert.Len(t, res.Warnings, 1) {
+		assert.Contains(t, res.Warnings[0], "eager is not supported by fixtures of a group")
+	}
+}
+
+func Test_parseXFail(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @test
+// @xfail
+func knownBug() {}
+
+// @test
+// @capture
+func working() {}
+`, false)
+
+	if assert.Len(t, res.Tests, 2) {
+		assert.True(t, res.Tests[0].ExpectFailure)
+		assert.False(t, res.Tests[0].Capture)
+		assert.False(t, res.Tests[1].ExpectFailure)
+		assert.True(t, res.Tests[1].Capture)
+	}
+}
+
+func Test_parseNoDefaultLabels(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @testLabel(smoke, smoke)
+// @noDefaultLabels
+
+// @test(smoke)
+func checkHealth() {}
+
+func smokeLogin() {}
+
+func testSomething() {}
+`, true)
+
+	assert.Equal(t, map[string][]string{"smoke": {"smoke"}}, res.TestLabels)
+	if assert.Len(t, res.Tests, 2) {
+		assert.Equal(t, "checkHealth", res.Tests[0].Name())
+		assert.Equal(t, "smokeLogin", res.Tests[1].Name())
+	}
+	assert.Empty(t, res.Warnings)
+
+	res = parseSource(t, `package foo
+
+// @noDefaultLabels
+
+// @test
+func unlabelled() {}
+`, true)
+
+	assert.Equal(t, map[string][]string{DefaultTestLabel: nil}, res.TestLabels)
+	if assert.Len(t, res.Warnings, 1) {
+		assert.Contains(t, res.Warnings[0], "default label 'unit' is not declared")
+	}
+}
+
+func Test_parseTypeFixture(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @fixture
+type client struct{}
+
+type (
+	// @fixture
+	server struct {
+		addr string
+	}
+
+	// not a fixture
+	handler struct{}
+)
+
+// @fixture
+type port int
+
+// @onceFixture
+type pool struct{}
+
+type unannotated struct{}
+`, true)
+
+	var names []string
+	for _, typ := range res.TypeFixtures {
+		names = append(names, typ.Name())
+	}
+	assert.Equal(t, []string{"client", "server"}, names)
+	if assert.Len(t, res.Warnings, 2) {
+		assert.Contains(t, res.Warnings[0], "source_test.go:17: @fixture is only supported on struct types 'port'")
+		assert.Contains(t, res.Warnings[1], "@onceFixture is not supported on types 'pool'")
+	}
+}
+
+func Test_parseConflictingAnnotations(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @fixture
+// @beforeTest
+func newA() {}
+`, false)
+
+	assert.Len(t, res.Fixtures, 1)
+	assert.Empty(t, res.BeforeTests)
+	if assert.Len(t, res.Warnings, 1) {
+		assert.Contains(t, res.Warnings[0], "conflicting annotations @fixture, @beforeTest on 'newA'; using @fixture")
+	}
+}
+
+func Test_parseHookOrder(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @beforeTest(order=10)
+func startServer() {}
+
+// @beforeTest(order=-5)
+func openDB() {}
+
+func preTest() {}
+
+// @afterTest(order=10)
+func stopServer() {}
+
+// @afterTest(order=soon)
+func closeDB() {}
+`, true)
+
+	if assert.Len(t, res.BeforeTests, 3) {
+		assert.Equal(t, 10, res.BeforeTests[0].Order)
+		assert.Equal(t, -5, res.BeforeTests[1].Order)
+		assert.Equal(t, 0, res.BeforeTests[2].Order)
+	}
+	if assert.Len(t, res.AfterTests, 2) {
+		assert.Equal(t, 10, res.AfterTests[0].Order)
+		assert.Equal(t, 0, res.AfterTests[1].Order)
+	}
+	assert.Len(t, res.Warnings, 1)
+}
+
+func Test_parseExample(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @example
+func hello() {
+	fmt.Println("hello")
+	// Output:
+	// hello
+	// world
+}
+
+// @example(integration)
+func unordered() {
+	fmt.Println("b")
+	fmt.Println("a")
+	// Unordered output:
+	// a
+	// b
+}
+
+// @example
+func noOutput() {
+	fmt.Println("hello")
+}
+
+// @example
+func withParams(t *tedi.T) {
+	// Output: hello
+}
+
+// @example
+func ExampleHello() {
+	// Output: hello
+}
+`, false)
+
+	if assert.Len(t, res.Examples, 2) {
+		assert.Equal(t, "hello", res.Examples[0].Name())
+		assert.Equal(t, []string{"unit"}, res.Examples[0].Labels)
+		assert.Equal(t, "hello\nworld", res.Examples[0].Output)
+		assert.False(t, res.Examples[0].Unordered)
+
+		assert.Equal(t, []string{"integration"}, res.Examples[1].Labels)
+		assert.Equal(t, "a\nb", res.Examples[1].Output)
+		assert.True(t, res.Examples[1].Unordered)
+	}
+	if assert.Len(t, res.Warnings, 3) {
+		assert.Contains(t, res.Warnings[0], "no output comment 'noOutput'")
+		assert.Contains(t, res.Warnings[1], "without parameters and results 'withParams'")
+		assert.Contains(t, res.Warnings[2], "go test already runs Example functions")
+	}
+}
+
+func Test_parseHookLabels(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @beforeTest(integration)
+func startServer() {}
+
+// @afterTest(integration, smoke, order=2)
+func stopServer() {}
+`, false)
+
+	if assert.Len(t, res.BeforeTests, 1) {
+		assert.Equal(t, []string{"integration"}, res.BeforeTests[0].Labels)
+	}
+	if assert.Len(t, res.AfterTests, 1) {
+		assert.Equal(t, []string{"integration", "smoke"}, res.AfterTests[0].Labels)
+		assert.Equal(t, 2, res.AfterTests[0].Order)
+	}
+	assert.Contains(t, res.TestLabels, "smoke")
+	assert.Empty(t, res.Warnings)
+}
+
+func Test_parseTestLabelRegexp(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @testLabel(slow, /Slow$/, slow_)
+
+// @testLabel(broken, /[a-/)
+
+func testQuerySlow() {}
+
+func slow_query() {}
+
+func testQuery() {}
+`, true)
+
+	if assert.Len(t, res.Tests, 3) {
+		assert.Equal(t, []string{"slow", "unit"}, res.Tests[0].Labels)
+		assert.Equal(t, []string{"slow"}, res.Tests[1].Labels)
+		assert.Equal(t, []string{"unit"}, res.Tests[2].Labels)
+	}
+	assert.Equal(t, []string{"/Slow$/", "slow_"}, res.TestLabels["slow"])
+	if assert.Len(t, res.Warnings, 1) {
+		assert.Contains(t, res.Warnings[0], "@testLabel matcher /[a-/ is not a valid regexp")
+	}
+}
+
+func Test_parseTestLabelDescription(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @testLabel(slow, "Long running tests", /Slow$/, reg_)
+
+// @testLabel(flaky, "Tests failing at times")
+
+// @testLabel(misplaced, misplaced_, "Not a description")
+
+func testQuerySlow() {}
+
+func misplaced_query() {}
+`, true)
+
+	assert.Equal(t, map[string]string{"slow": "Long running tests", "flaky": "Tests failing at times"}, res.LabelDescriptions)
+	assert.Equal(t, []string{"/Slow$/", "reg_"}, res.TestLabels["slow"])
+	assert.Contains(t, res.TestLabels, "flaky")
+	assert.Equal(t, []string{"misplaced_"}, res.TestLabels["misplaced"])
+	if assert.Len(t, res.Warnings, 1) {
+		assert.Contains(t, res.Warnings[0], `@testLabel description "Not a description" must follow the name of the label`)
+	}
+}
+
+func Test_parseQuotedLabels(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @testLabel("my-label", "Tests of \"my\" label", my_)
+
+// @test("my-label", unit)
+func testQuery() {}
+
+func my_query() {}
+`, true)
+
+	assert.Equal(t, []string{"my_"}, res.TestLabels["my-label"])
+	assert.Equal(t, map[string]string{"my-label": `Tests of "my" label`}, res.LabelDescriptions)
+	if assert.Len(t, res.Tests, 2) {
+		assert.Equal(t, []string{"my-label", "unit"}, res.Tests[0].Labels)
+		assert.Equal(t, []string{"my-label"}, res.Tests[1].Labels)
+	}
+	assert.Empty(t, res.Warnings)
+}
+
+func Test_parseParallelism(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @parallelism(integration=2, unknown=1)
+
+// @parallelism(unit=none)
+
+// @test(integration)
+func testQuery() {}
+`, false)
+
+	assert.Equal(t, map[string]int{"integration": 2, "unknown": 1}, res.LabelParallelism)
+	if assert.Len(t, res.Warnings, 2) {
+		assert.Contains(t, res.Warnings[0], "@parallelism must have label=<positive number> arguments")
+		assert.Contains(t, res.Warnings[1], "@parallelism of unknown label 'unknown'")
+	}
+}
+
+func Test_parseFixturePerLabel(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @onceFixture(perLabel)
+func newDB() {}
+
+// @fixture(perLabel)
+func newClient() {}
+`, false)
+
+	if assert.Len(t, res.OnceFixtures, 1) {
+		assert.True(t, res.OnceFixtures[0].PerLabel)
+	}
+	if assert.Len(t, res.Fixtures, 1) {
+		assert.False(t, res.Fixtures[0].PerLabel)
+	}
+	if assert.Len(t, res.Warnings, 1) {
+		assert.Contains(t, res.Warnings[0], "perLabel is only supported by @onceFixture")
+	}
+}
+
+func Test_parseFixtureScope(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @fixture(scope=test)
+func newSession() {}
+
+// @onceFixture(scope=test)
+func newDB() {}
+
+// @fixture(scope=package)
+func newClient() {}
+`, false)
+
+	if assert.Len(t, res.Fixtures, 2) {
+		assert.True(t, res.Fixtures[0].TestScope)
+		assert.False(t, res.Fixtures[1].TestScope)
+	}
+	if assert.Len(t, res.OnceFixtures, 1) {
+		assert.False(t, res.OnceFixtures[0].TestScope)
+	}
+	if assert.Len(t, res.Warnings, 2) {
+		assert.Contains(t, res.Warnings[0], "scope=test is only supported by @fixture")
+		assert.Contains(t, res.Warnings[1], "unknown fixture scope 'package'")
+	}
+}
+
+func Test_parseSuiteMethods(t *testing.T) {
+	res := parseSource(t, `package foo
+
+type suite struct{}
+
+// @fixture
+type client struct{}
+
+// @test
+func (s *suite) queryTest() {}
+
+// @fixture
+func (s suite) newDB() *DB {}
+
+// @beforeTest
+func (s *suite) openDB() {}
+
+// @test
+func (c *client) getTest() {}
+
+// @onceFixture
+func (s *suite) newCache() *Cache {}
+
+// @test
+func (d *DB) closeTest() {}
+
+func (s *suite) testHelper() {}
+`, true)
+
+	if assert.Len(t, res.Tests, 2) {
+		assert.Equal(t, "suite.queryTest", res.Tests[0].Name())
+		assert.Equal(t, "(*suite).queryTest", res.Tests[0].Expr())
+		assert.Equal(t, "client.getTest", res.Tests[1].Name())
+	}
+	if assert.Len(t, res.Fixtures, 1) {
+		assert.Equal(t, "suite", res.Fixtures[0].Receiver())
+		assert.Equal(t, "(*suite).newDB", res.Fixtures[0].Expr())
+	}
+	assert.Len(t, res.BeforeTests, 1)
+	assert.Empty(t, res.OnceFixtures)
+	if assert.Len(t, res.Suites, 1) {
+		assert.Equal(t, "suite", res.Suites[0].Name())
+	}
+	if assert.Len(t, res.Warnings, 2) {
+		assert.Contains(t, res.Warnings[0], "@onceFixture is not supported on methods 'suite.newCache'")
+		assert.Contains(t, res.Warnings[1], "@test on 'DB.closeTest' must have a struct type of the package as receiver")
+	}
+}
+
+func Test_parseUnusedFixtures(t *testing.T) {
+	res := parseSource(t, `package foo
+
+import "go.uber.org/dig"
+
+// @fixture
+func newDB() (*DB, error) {}
+
+// @fixture
+func newConfig() Config {}
+
+// @fixture
+func newLogger(c Config) *Logger {}
+
+// @fixture
+func newMetrics() *Metrics {}
+
+// @onceFixture
+func newCache() *Cache {}
+
+// @fixture
+func newUnused() (*Unused, error) {}
+
+// @fixture(group=handlers)
+func newHandler() Handler {}
+
+type params struct {
+	dig.In
+	Metrics *Metrics
+}
+
+// @test
+func queryTest(t *tedi.T, db *DB, p params) {
+	t.Run("sub", func(l *Logger) {})
+}
+
+// @beforeAll
+func warmCache(c *Cache) {}
+`, false)
+
+	if assert.Len(t, res.Warnings, 1) {
+		assert.Contains(t, res.Warnings[0], "source_test.go:21: fixture 'newUnused' provides *Unused which is not used by any test, hook or fixture")
+	}
+}
+
+func Test_parseUnsatisfiableTests(t *testing.T) {
+	res := parseSource(t, `package foo
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/dig"
+	td "github.com/jstroem/tedi"
+)
+
+// @fixture
+func newDB() (*DB, error) {}
+
+// @fixture(as=Querier)
+func newClient() *Client {}
+
+// @fixture(locked)
+func newCounter() *Counter {}
+
+// @fixture
+type Server struct{}
+
+type params struct {
+	dig.In
+	Cache *Cache
+}
+
+type results struct {
+	dig.Out
+	Queue *Queue
+}
+
+// @fixture
+func newResults() results {}
+
+// @test
+func queryTest(t *td.T, test *testing.T, ctx context.Context, info td.TestInfo, db *DB, q Querier, p params, queue *Queue) {}
+
+// @test
+func counterTest(withCounter func(func(*Counter)), s *Server, values ...*Value) {}
+
+// @test
+func missingTest(t *tedi.T, db DB, config *Config) {}
+`, false)
+
+	var warnings []string
+	for _, warning := range res.Warnings {
+		if strings.Contains(warning, "test '") {
+			warnings = append(warnings, warning)
+		}
+	}
+	assert.Equal(t, []string{
+		"source_test.go:43: test 'missingTest' depends on DB which is not provided by any fixture",
+		"source_test.go:43: test 'missingTest' depends on *Config which is not provided by any fixture",
+	}, warnings)
+
+	// The warnings can be turned off, like when the fixtures are registered by hand.
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo_test.go"), []byte(`package foo
+
+// @test
+func missingTest(config *Config) {}
+`), 0644))
+	res, err := ParseWithOptions(dir, "_test.go", false, Options{})
+	require.NoError(t, err)
+	assert.Len(t, res.Warnings, 1)
+	res, err = ParseWithOptions(dir, "_test.go", false, Options{NoWarnUnsatisfiable: true})
+	require.NoError(t, err)
+	assert.Empty(t, res.Warnings)
+}
+
+func Test_ParseFiles(t *testing.T) {
+	for _, tc := range []struct {
+		annotation string
+		src        string
+		check      func(t *testing.T, res *ParseResult)
+	}{
+		{"@test", "// @test(integration)\nfunc queryTest() {}", func(t *testing.T, res *ParseResult) {
+			if assert.Len(t, res.Tests, 1) {
+				assert.Equal(t, []string{"integration"}, res.Tests[0].Labels)
+			}
+		}},
+		{"@example", "// @example\nfunc greeting() {\n\t// Output: hello\n}", func(t *testing.T, res *ParseResult) {
+			if assert.Len(t, res.Examples, 1) {
+				assert.Equal(t, "hello", res.Examples[0].Output)
+			}
+		}},
+		{"@fixture", "// @fixture\nfunc newDB() *DB { return nil }\n\n// @test\nfunc queryTest(db *DB) {}", func(t *testing.T, res *ParseResult) {
+			assert.Len(t, res.Fixtures, 1)
+		}},
+		{"@onceFixture", "// @onceFixture\nfunc newDB() *DB { return nil }\n\n// @test\nfunc queryTest(db *DB) {}", func(t *testing.T, res *ParseResult) {
+			assert.Len(t, res.OnceFixtures, 1)
+		}},
+		{"@beforeTest", "// @beforeTest\nfunc setup() {}", func(t *testing.T, res *ParseResult) {
+			assert.Len(t, res.BeforeTests, 1)
+		}},
+		{"@afterTest", "// @afterTest\nfunc teardown() {}", func(t *testing.T, res *ParseResult) {
+			assert.Len(t, res.AfterTests, 1)
+		}},
+		{"@beforeAll", "// @beforeAll\nfunc start() {}", func(t *testing.T, res *ParseResult) {
+			assert.Len(t, res.BeforeAll, 1)
+		}},
+		{"@afterAll", "// @afterAll\nfunc stop() {}", func(t *testing.T, res *ParseResult) {
+			assert.Len(t, res.AfterAll, 1)
+		}},
+		{"@testLabel", "// @testLabel(slow, slow_)\n\nfunc slow_query() {}", func(t *testing.T, res *ParseResult) {
+			if assert.Len(t, res.Tests, 1) {
+				assert.Equal(t, []string{"slow"}, res.Tests[0].Labels)
+			}
+		}},
+	} {
+		tc := tc
+		t.Run(tc.annotation, func(t *testing.T) {
+			res, err := ParseFiles(map[string][]byte{
+				"foo_test.go": []byte("package foo\n\n" + tc.src + "\n"),
+				"db_test.go":  []byte("package foo\n\ntype DB struct{}\n"),
+			}, true)
+			require.NoError(t, err)
+			assert.Equal(t, "foo", res.Package.Name)
+			assert.Empty(t, res.Warnings)
+			tc.check(t, res)
+		})
+	}
+
+	_, err := ParseFiles(map[string][]byte{"broken_test.go": []byte("package foo\n\nfunc {")}, true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "broken_test.go")
+	}
+}
+
+func Test_ParseWithOptionsInclude(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "helpers.go"), []byte(`package foo
+
+// @fixture
+func database() string { return "db" }
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo.go"), []byte(`package foo
+
+// @fixture
+func ignored() int { return 1 }
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo_test.go"), []byte(`package foo
+
+// @test
+func queryTest(db string) {}
+`), 0644))
+
+	res, err := Parse(dir, "_test.go", false)
+	require.NoError(t, err)
+	assert.Empty(t, res.Fixtures)
+
+	res, err = ParseWithOptions(dir, "_test.go", false, Options{Include: []string{"helper*.go"}})
+	require.NoError(t, err)
+	if assert.Len(t, res.Fixtures, 1) {
+		assert.Equal(t, "database", res.Fixtures[0].Name())
+	}
+	assert.Len(t, res.Tests, 1)
+
+	_, err = ParseWithOptions(dir, "_test.go", false, Options{Include: []string{"[helper"}})
+	assert.Error(t, err)
+}
+
+func Test_ParseWithOptionsTags(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "postgres_test.go"), []byte(`//go:build postgres
+// +build postgres
+
+package foo
+
+// @fixture
+func postgres() string { return "postgres" }
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo_test.go"), []byte(`package foo
+
+// @fixture
+func sqlite() string { return "sqlite" }
+`), 0644))
+
+	fixtureNames := func(res *ParseResult) []string {
+		var names []string
+		for _, fixture := range res.Fixtures {
+			names = append(names, fixture.Name())
+		}
+		return names
+	}
+
+	res, err := Parse(dir, "_test.go", false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"postgres", "sqlite"}, fixtureNames(res), "build constraints are not applied without tags")
+
+	res, err = ParseWithOptions(dir, "_test.go", false, Options{Tags: []string{}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sqlite"}, fixtureNames(res))
+
+	res, err = ParseWithOptions(dir, "_test.go", false, Options{Tags: []string{"postgres"}})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"postgres", "sqlite"}, fixtureNames(res))
+}
+
+func Test_ParseWithOptionsWarnUnmatched(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo_test.go"), []byte(`package foo
+
+import (
+	"testing"
+
+	td "github.com/jstroem/tedi"
+)
+
+func verifyThing(t *td.T) {}
+
+func checkOther(x int, t *testing.T) {}
+
+func TestGoTest(t *testing.T) {}
+
+func helper(t *http.T) {}
+
+func testQuery(t *td.T) {}
+
+// @test
+func annotated(t *testing.T) {}
+`), 0644))
+
+	res, err := ParseWithOptions(dir, "_test.go", true, Options{})
+	require.NoError(t, err)
+	assert.Empty(t, res.Warnings)
+
+	res, err = ParseWithOptions(dir, "_test.go", true, Options{WarnUnmatched: true})
+	require.NoError(t, err)
+	if assert.Len(t, res.Warnings, 2) {
+		assert.Contains(t, res.Warnings[0], "'verifyThing' looks like a test but matches no label")
+		assert.Contains(t, res.Warnings[1], "'checkOther' looks like a test but matches no label")
+	}
+	assert.Len(t, res.Tests, 2)
+}
+
+func Test_parseDecisions(t *testing.T) {
+	res := parseSource(t, `package foo
+
+// @testLabel(slow, /Slow$/)
+
+// @fixture
+func newValue() int { return 1 }
+
+func fixtureOther() string { return "" }
+
+func integrationQuery(t *testing.T) {}
+
+func querySlow(t *testing.T) {}
+
+func helper() {}
+`, true)
+
+	require.Len(t, res.Decisions, 5)
+	assert.Contains(t, res.Decisions[0], "newValue: registered by annotation @fixture")
+	assert.Contains(t, res.Decisions[1], "fixtureOther: fixture by matched prefix fixture")
+	assert.Contains(t, res.Decisions[2], "integrationQuery: test with labels integration by label prefix int")
+	assert.Contains(t, res.Decisions[3], "querySlow: test with labels slow by label regexp /Slow$/")
+	assert.Contains(t, res.Decisions[4], "helper: skipped, matches no prefix or label")
+}
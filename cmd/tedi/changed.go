@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// changedFlag is the git ref to compare against to find the changed packages.
+// It can be given without a value, which compares against HEAD.
+type changedFlag string
+
+func (c *changedFlag) String() string {
+	return string(*c)
+}
+
+func (c *changedFlag) Set(value string) error {
+	switch value {
+	case "true":
+		*c = "HEAD"
+	case "false":
+		*c = ""
+	default:
+		*c = changedFlag(value)
+	}
+	return nil
+}
+
+func (c *changedFlag) IsBoolFlag() bool {
+	return true
+}
+
+// git runs git in dir and returns its output. Tests replace it to fake the repository.
+var git = func(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+// changedPackageDirs returns the package dirs with files changed since ref,
+// including deleted and untracked files. A file belongs to the closest package
+// dir containing it, so changes of non-Go files like testdata count as well.
+func changedPackageDirs(dirs []string, ref string) ([]string, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+
+	out, err := git(dirs[0], "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root := evalSymlinks(strings.TrimSpace(string(out)))
+
+	diff, err := git(root, "diff", "--name-only", ref, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := git(root, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := make([]string, len(dirs))
+	for i, dir := range dirs {
+		resolved[i] = evalSymlinks(dir)
+	}
+
+	changed := map[int]bool{}
+	for _, file := range strings.Split(string(diff)+"\n"+string(untracked), "\n") {
+		if file = strings.TrimSpace(file); file == "" {
+			continue
+		}
+		if i := closestDir(resolved, filepath.Join(root, filepath.FromSlash(file))); i >= 0 {
+			changed[i] = true
+		}
+	}
+
+	var res []string
+	for i, dir := range dirs {
+		if changed[i] {
+			res = append(res, dir)
+		}
+	}
+	return res, nil
+}
+
+// closestDir returns the index of the longest dir containing file; -1 if none does.
+func closestDir(dirs []string, file string) int {
+	res := -1
+	for i, dir := range dirs {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if res < 0 || len(dir) > len(dirs[res]) {
+			res = i
+		}
+	}
+	return res
+}
+
+// evalSymlinks returns path with its symbolic links evaluated, or path if that fails.
+func evalSymlinks(path string) string {
+	if res, err := filepath.EvalSymlinks(path); err == nil {
+		return res
+	}
+	return path
+}
+
+// replacePackages replaces the local package patterns in args by dirs.
+func replacePackages(args, patterns, dirs []string) []string {
+	isPattern := map[string]bool{}
+	for _, pattern := range patterns {
+		if build.IsLocalImport(pattern) {
+			isPattern[pattern] = true
+		}
+	}
+
+	var res []string
+	replaced := false
+	for _, arg := range args {
+		if !isPattern[arg] {
+			res = append(res, arg)
+			continue
+		}
+		if !replaced {
+			res = append(res, dirs...)
+			replaced = true
+		}
+	}
+	if !replaced {
+		res = append(res, dirs...)
+	}
+	return res
+}
+
+// joinChangedRef joins the -changed flag of args with the git ref following
+// it, like -changed origin/main, into -changed=origin/main. The flag can be
+// given without a value, so the argument following it is only taken as its
+// value when it is not a flag or package pattern and git resolves it to a commit.
+func joinChangedRef(args []string) []string {
+	var res []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if (arg == "-changed" || arg == "--changed") && i+1 < len(args) && isGitRef(args[i+1]) {
+			arg += "=" + args[i+1]
+			i++
+		}
+		res = append(res, arg)
+	}
+	return res
+}
+
+// isGitRef returns true if arg is a git ref of the repository of the working
+// directory and not a flag or local package pattern.
+func isGitRef(arg string) bool {
+	if arg == "" || strings.HasPrefix(arg, "-") || build.IsLocalImport(arg) || filepath.IsAbs(arg) || strings.Contains(arg, "...") {
+		return false
+	}
+	_, err := git(".", "rev-parse", "--verify", "--quiet", arg+"^{commit}")
+	return err == nil
+}
+
+// removeBoolFlag removes the flag, which has no separate value, from args.
+func removeBoolFlag(args []string, name string) []string {
+	var res []string
+	for _, arg := range args {
+		if arg != name && !strings.HasPrefix(arg, name+"=") {
+			res = append(res, arg)
+		}
+	}
+	return res
+}
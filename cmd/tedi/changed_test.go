@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_changedPackageDirs(t *testing.T) {
+	root := evalSymlinks(t.TempDir())
+	dirs := []string{
+		filepath.Join(root, "foo"),
+		filepath.Join(root, "foo", "bar"),
+		filepath.Join(root, "baz"),
+		filepath.Join(root, "qux"),
+	}
+	for _, dir := range dirs {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+	}
+
+	defer func(orig func(string, ...string) ([]byte, error)) { git = orig }(git)
+	var refs []string
+	git = func(dir string, args ...string) ([]byte, error) {
+		switch args[0] {
+		case "rev-parse":
+			return []byte(root + "\n"), nil
+		case "diff":
+			refs = append(refs, args[2])
+			// A deleted file of bar and a changed testdata file of foo.
+			return []byte("foo/bar/deleted.go\nfoo/testdata/golden.json\nreadme.md\n"), nil
+		default:
+			return []byte("qux/new_test.go\n"), nil
+		}
+	}
+
+	res, err := changedPackageDirs(dirs, "origin/main")
+	require.NoError(t, err)
+	assert.Equal(t, []string{dirs[0], dirs[1], dirs[3]}, res)
+	assert.Equal(t, []string{"origin/main"}, refs)
+}
+
+func Test_changedFlag(t *testing.T) {
+	var c changedFlag
+	require.NoError(t, c.Set("true"))
+	assert.Equal(t, "HEAD", c.String())
+	require.NoError(t, c.Set("origin/main"))
+	assert.Equal(t, "origin/main", c.String())
+}
+
+func Test_joinChangedRef(t *testing.T) {
+	defer func(previous func(string, ...string) ([]byte, error)) { git = previous }(git)
+	git = func(dir string, args ...string) ([]byte, error) {
+		if args[len(args)-1] != "origin/main^{commit}" {
+			return nil, errors.New("unknown revision")
+		}
+		return []byte("0123abcd\n"), nil
+	}
+
+	assert.Equal(t, strings.Fields("-changed=origin/main -v ./..."), joinChangedRef(strings.Fields("-changed origin/main -v ./...")))
+	assert.Equal(t, strings.Fields("-v --changed=origin/main"), joinChangedRef(strings.Fields("-v --changed origin/main")))
+	assert.Equal(t, strings.Fields("-changed ./... -changed -v -changed=HEAD~1 -changed github.com/foo/bar"), joinChangedRef(strings.Fields("-changed ./... -changed -v -changed=HEAD~1 -changed github.com/foo/bar")))
+}
+
+func Test_replacePackages(t *testing.T) {
+	assert.Equal(t,
+		strings.Fields("-v /src/foo /src/qux -count 1"),
+		replacePackages(strings.Fields("-v ./... ./baz -count 1"), strings.Fields("./... ./baz -count 1"), strings.Fields("/src/foo /src/qux")))
+	assert.Equal(t, strings.Fields("-v /src/foo"), replacePackages([]string{"-v"}, nil, []string{"/src/foo"}))
+	assert.Equal(t, strings.Fields("-v ./..."), removeBoolFlag(strings.Fields("-changed -v -changed=HEAD~1 ./..."), "-changed"))
+}
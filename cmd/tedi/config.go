@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configFileName is the name of the optional configuration file of a package.
+const configFileName = ".tedi.json"
+
+// config is the configuration of a package read from its configuration file.
+// Values not set keep the value of the command line flag.
+type config struct {
+	Func     string  `json:"func"`
+	Prefix   *string `json:"prefix"`
+	Output   string  `json:"output"`
+	BuildTag *string `json:"buildTag"`
+	// TestLabels are label matchers like the ones declared by @testLabel.
+	TestLabels map[string][]string `json:"testLabels"`
+	// DefaultLabel is the label of tests without labels.
+	DefaultLabel string `json:"defaultLabel"`
+	// ImportPath is the import path of tedi in the generated files, like -importPath.
+	ImportPath string `json:"importPath"`
+	// Tags are the build tags the files are scanned with, like -tags.
+	Tags []string `json:"tags"`
+	// Include are the glob patterns of the other files of the package which
+	// are scanned for annotations, like -include.
+	Include []string `json:"include"`
+	// NoWarnUnsatisfiable does not warn about parameters of tests which no
+	// fixture provides, like -no-warn-unsatisfiable.
+	NoWarnUnsatisfiable bool `json:"noWarnUnsatisfiable"`
+}
+
+// readConfig reads the configuration file of dir; the empty configuration if there is none.
+func readConfig(dir string) (*config, error) {
+	file := filepath.Join(dir, configFileName)
+	src, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return &config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := &config{}
+	dec := json.NewDecoder(bytes.NewReader(src))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(res); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	return res, nil
+}
+
+// configure returns o changed by the configuration file of dir. The flags in
+// o.SetFlags were given on the command line and take precedence over the file.
+// Configuring options twice gives the same options.
+func configure(dir string, o writeTediFileOptions) (writeTediFileOptions, error) {
+	c, err := readConfig(dir)
+	if err != nil {
+		return o, err
+	}
+
+	// The entrypoints given by -entry are not changed by -func and -buildTag either.
+	if len(o.Entrypoints) == 1 && !o.SetFlags["entry"] {
+		e := o.Entrypoints[0]
+		if c.Func != "" && !o.SetFlags["func"] {
+			e.Funcname = c.Func
+		}
+		if c.BuildTag != nil && !o.SetFlags["buildTag"] {
+			e.BuildTag = *c.BuildTag
+		}
+		o.Entrypoints = []entrypoint{e}
+	}
+	if c.Prefix != nil && !o.SetFlags["prefix"] {
+		o.Prefix = *c.Prefix
+	}
+	if c.Output != "" && !o.SetFlags["output"] {
+		o.OutputFile = c.Output
+	}
+	if len(c.TestLabels) > 0 {
+		o.ParseOptions.TestLabels = c.TestLabels
+	}
+	if c.DefaultLabel != "" {
+		o.ParseOptions.DefaultTestLabel = c.DefaultLabel
+	}
+	if c.ImportPath != "" && !o.SetFlags["importPath"] {
+		o.ImportPath = c.ImportPath
+	}
+	if c.NoWarnUnsatisfiable {
+		o.ParseOptions.NoWarnUnsatisfiable = true
+	}
+	if c.Include != nil && !o.SetFlags["include"] {
+		o.ParseOptions.Include = c.Include
+	}
+	if c.Tags != nil && !o.SetFlags["tags"] {
+		o.ParseOptions.Tags = c.Tags
+	}
+	// The generated files are built with the build tags of their entrypoints,
+	// so the files constrained by these are scanned as well.
+	if o.ParseOptions.Tags != nil {
+		o.ParseOptions.Tags = entrypointTags(o.ParseOptions.Tags, o.Entrypoints)
+	}
+	return o, nil
+}
+
+// entrypointTags returns the tags together with the build tags the files of
+// the entrypoints are generated with, without duplicates.
+func entrypointTags(tags []string, entrypoints []entrypoint) []string {
+	seen := map[string]bool{}
+	res := []string{}
+	add := func(tag string) {
+		if !seen[tag] && !strings.HasPrefix(tag, "!") {
+			seen[tag] = true
+			res = append(res, tag)
+		}
+	}
+	for _, tag := range tags {
+		add(tag)
+	}
+	for _, e := range entrypoints {
+		for _, tag := range splitTags(e.BuildTag) {
+			add(tag)
+		}
+	}
+	return res
+}
+
+// setFlags returns the names of the flags of fs given on the command line.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	res := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		res[f.Name] = true
+	})
+	return res
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jstroem/tedi/annotations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_writeTediFileConfig(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo_test.go"), []byte(`package foo
+
+// @test
+func unitTest() {}
+
+func e2eCheckout() {}
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, configFileName), []byte(`{
+	"func": "tediMain",
+	"prefix": "Test",
+	"output": "zz_tedi_test.go",
+	"testLabels": {"e2e": ["/^e2e/"]}
+}`), 0644))
+
+	o := writeTediFileOptions{
+		Entrypoints: []entrypoint{{Funcname: "TestMain"}},
+		OutputFile:  "tedi_test.go",
+	}
+	_, _, err := writeTediFile(dir, o)
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "tedi_test.go"))
+	assert.True(t, os.IsNotExist(err))
+	src, err := ioutil.ReadFile(filepath.Join(dir, "zz_tedi_test.go"))
+	require.NoError(t, err)
+	assert.Contains(t, string(src), "func tediMain(m *testing.M)")
+	assert.Contains(t, string(src), `t.Test("TestunitTest", unitTest, "unit")`)
+	assert.Contains(t, string(src), `t.Test("Teste2eCheckout", e2eCheckout, "e2e")`)
+
+	// Flags given on the command line take precedence over the configuration file.
+	o.SetFlags = map[string]bool{"output": true}
+	_, _, err = writeTediFile(dir, o)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "tedi_test.go"))
+	assert.NoError(t, err)
+
+	// go test rejects an entrypoint named like a test other than TestMain.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, configFileName), []byte(`{"func": "TestTedi"}`), 0644))
+	_, _, err = writeTediFile(dir, writeTediFileOptions{
+		Entrypoints: []entrypoint{{Funcname: "TestMain"}},
+		OutputFile:  "tedi_test.go",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "TestTedi")
+}
+
+func Test_readConfig(t *testing.T) {
+	dir := t.TempDir()
+	c, err := readConfig(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &config{}, c)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, configFileName), []byte(`{"outputFile": "tedi_test.go"}`), 0644))
+	_, err = readConfig(dir)
+	assert.Error(t, err)
+}
+
+func Test_configureNoWarnUnsatisfiable(t *testing.T) {
+	dir := t.TempDir()
+	configured, err := configure(dir, writeTediFileOptions{})
+	require.NoError(t, err)
+	assert.False(t, configured.ParseOptions.NoWarnUnsatisfiable)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, configFileName), []byte(`{"noWarnUnsatisfiable": true}`), 0644))
+	configured, err = configure(dir, writeTediFileOptions{})
+	require.NoError(t, err)
+	assert.True(t, configured.ParseOptions.NoWarnUnsatisfiable)
+}
+
+func Test_configureInclude(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, configFileName), []byte(`{"include": ["helpers*.go"]}`), 0644))
+	configured, err := configure(dir, writeTediFileOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"helpers*.go"}, configured.ParseOptions.Include)
+
+	// -include given on the command line takes precedence over the configuration file.
+	configured, err = configure(dir, writeTediFileOptions{
+		ParseOptions: annotations.Options{Include: []string{"fixtures.go"}},
+		SetFlags:     map[string]bool{"include": true},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fixtures.go"}, configured.ParseOptions.Include)
+}
+
+func Test_configureTags(t *testing.T) {
+	dir := t.TempDir()
+	o := writeTediFileOptions{Entrypoints: []entrypoint{{Funcname: "TestMain", BuildTag: "integration"}}}
+	configured, err := configure(dir, o)
+	require.NoError(t, err)
+	assert.Nil(t, configured.ParseOptions.Tags, "files are scanned regardless of build constraints without tags")
+
+	o.ParseOptions.Tags = []string{"postgres"}
+	configured, err = configure(dir, o)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"postgres", "integration"}, configured.ParseOptions.Tags)
+	configured, err = configure(dir, configured)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"postgres", "integration"}, configured.ParseOptions.Tags)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, configFileName), []byte(`{"tags": ["mysql"]}`), 0644))
+	configured, err = configure(dir, writeTediFileOptions{Entrypoints: []entrypoint{{Funcname: "TestMain", BuildTag: "tedi"}}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mysql", "tedi"}, configured.ParseOptions.Tags)
+
+	// -tags given on the command line takes precedence over the configuration file.
+	configured, err = configure(dir, writeTediFileOptions{
+		Entrypoints:  []entrypoint{{Funcname: "TestMain"}},
+		ParseOptions: annotations.Options{Tags: []string{}},
+		SetFlags:     map[string]bool{"tags": true},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, configured.ParseOptions.Tags)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around the changes of a hunk.
+const diffContext = 3
+
+// unifiedDiff returns the differences between the old and new content of the
+// file as a unified diff, like diff -u; empty if they are equal.
+func unifiedDiff(name string, old, new []byte) string {
+	if string(old) == string(new) {
+		return ""
+	}
+	a, b := splitLines(string(old)), splitLines(string(new))
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// edit is a line of the diff: ' ' unchanged, '-' removed or '+' added.
+	type edit struct {
+		op   byte
+		line string
+		// ai and bi are the indexes of the line in a and b before the edit.
+		ai, bi int
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var res strings.Builder
+	fmt.Fprintf(&res, "--- a/%s\n+++ b/%s\n", name, name)
+	for start := 0; start < len(edits); {
+		if edits[start].op == ' ' {
+			start++
+			continue
+		}
+
+		// A hunk extends until diffContext*2 unchanged lines follow a change.
+		end := start
+		for k := start; k < len(edits) && k-end <= 2*diffContext; k++ {
+			if edits[k].op != ' ' {
+				end = k
+			}
+		}
+		from := start - diffContext
+		if from < 0 {
+			from = 0
+		}
+		to := end + diffContext + 1
+		if to > len(edits) {
+			to = len(edits)
+		}
+
+		oldLines, newLines := 0, 0
+		for _, e := range edits[from:to] {
+			if e.op != '+' {
+				oldLines++
+			}
+			if e.op != '-' {
+				newLines++
+			}
+		}
+		fmt.Fprintf(&res, "@@ -%s +%s @@\n", hunkRange(edits[from].ai, oldLines), hunkRange(edits[from].bi, newLines))
+		for _, e := range edits[from:to] {
+			fmt.Fprintf(&res, "%c%s\n", e.op, e.line)
+		}
+		start = to
+	}
+	return res.String()
+}
+
+// hunkRange formats the range of a hunk starting at the 0-based index.
+func hunkRange(start, lines int) string {
+	if lines == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if lines == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, lines)
+}
+
+// splitLines splits s into its lines without the line endings.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/jstroem/tedi"
+	"github.com/jstroem/tedi/annotations"
+)
+
+var (
+	doctorCmd      = flag.NewFlagSet("doctor", flag.ExitOnError)
+	doctorFuncname = doctorCmd.String("func", "TestMain", "name of the generated function; default TestMain")
+	doctorPrefix   = doctorCmd.String("prefix", "", "prefix name of tests; default <none>")
+	doctorOutput   = doctorCmd.String("output", "tedi_test.go", "generated file name; default srcdir/tedi_test.go")
+	doctorBuildTag = doctorCmd.String("buildTag", "", "build tag of the generated file")
+	doctorNoImp    = doctorCmd.Bool("no-imports", false, "the generated file is only formatted with gofmt, like generated with -no-imports")
+	doctorWarnUnm  = doctorCmd.Bool("warn-unmatched", false, "warn about functions looking like tests which are skipped, like generate -warn-unmatched")
+	doctorNoWarnUs = doctorCmd.Bool("no-warn-unsatisfiable", false, "do not warn about parameters of tests which no fixture provides, like generate -no-warn-unsatisfiable")
+	doctorTags     = doctorCmd.String("tags", "", "comma-separated `list` of build tags the files are scanned with, like generate -tags")
+)
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkWarn checkStatus = "WARN"
+	checkFail checkStatus = "FAIL"
+)
+
+// checkResult is the outcome of a single doctor check.
+type checkResult struct {
+	Status  checkStatus
+	Name    string
+	Message string
+}
+
+func (r checkResult) String() string {
+	return fmt.Sprintf("%s\t%s: %s", r.Status, r.Name, r.Message)
+}
+
+func doctorCommand() {
+	dir, err := os.Getwd()
+	if err != nil {
+		die(err)
+	}
+
+	failed := false
+	for _, result := range doctor(dir, writeTediFileOptions{
+		Entrypoints: []entrypoint{{Funcname: *doctorFuncname, BuildTag: *doctorBuildTag}},
+		Prefix:      *doctorPrefix,
+		OutputFile:  *doctorOutput,
+		NoImports:   *doctorNoImp,
+		ParseOptions: annotations.Options{
+			Tags:                tagsFlag(doctorCmd, *doctorTags),
+			WarnUnmatched:       *doctorWarnUnm,
+			NoWarnUnsatisfiable: *doctorNoWarnUs,
+		},
+		SetFlags: setFlags(doctorCmd),
+	}) {
+		fmt.Println(result)
+		failed = failed || result.Status == checkFail
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// doctor diagnoses the tedi setup of the package in dir without changing anything.
+func doctor(dir string, o writeTediFileOptions) []checkResult {
+	res := []checkResult{checkGoVersion()}
+
+	o, err := configure(dir, o)
+	if err != nil {
+		return append(res, checkResult{checkFail, "configuration", err.Error()})
+	}
+
+	parsed, err := annotations.ParseWithOptions(dir, "_test.go", true, o.ParseOptions)
+	if err != nil {
+		return append(res, checkResult{checkFail, "annotations", err.Error()})
+	}
+	if parsed == nil || parsed.Package == nil {
+		return append(res, checkResult{checkWarn, "annotations", "no test files found"})
+	}
+
+	res = append(res, checkAnnotations(parsed))
+	return append(res, checkGenerated(dir, parsed, o)...)
+}
+
+// checkGoVersion checks that tests can be registered with the testing package
+// of the Go version tedi is built with, and that it is the go command in use.
+func checkGoVersion() checkResult {
+	if err := tedi.CheckCompatibility(); err != nil {
+		return checkResult{checkFail, "go version", err.Error()}
+	}
+
+	if out, err := exec.Command("go", "env", "GOVERSION").Output(); err == nil {
+		if goVersion := strings.TrimSpace(string(out)); goVersion != "" && goVersion != runtime.Version() {
+			return checkResult{checkWarn, "go version", fmt.Sprintf("testing.M layout is checked for %s but go is %s; rebuild tedi to check it", runtime.Version(), goVersion)}
+		}
+	}
+	return checkResult{checkPass, "go version", fmt.Sprintf("testing.M layout of %s is supported", runtime.Version())}
+}
+
+// checkAnnotations reports the warnings of the parser, like conflicting annotations.
+func checkAnnotations(parsed *annotations.ParseResult) checkResult {
+	if len(parsed.Warnings) == 0 {
+		return checkResult{checkPass, "annotations", fmt.Sprintf("%d tests and no warnings", len(parsed.Tests))}
+	}
+	return checkResult{checkWarn, "annotations", strings.Join(parsed.Warnings, "\n\t")}
+}
+
+// checkGenerated compares the generated files with the files generated from the current annotations.
+func checkGenerated(dir string, parsed *annotations.ParseResult, o writeTediFileOptions) []checkResult {
+	files, err := renderTediFiles(parsed, o)
+	if err != nil {
+		return []checkResult{{checkFail, "generated files", err.Error()}}
+	}
+
+	var res []checkResult
+	for _, file := range files {
+		name := "generated file " + file.Name
+		current, err := ioutil.ReadFile(filepath.Join(dir, file.Name))
+		switch {
+		case os.IsNotExist(err) && file.Write:
+			res = append(res, checkResult{checkWarn, name, "not generated; run tedi generate or use tedi test"})
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			res = append(res, checkResult{checkFail, name, err.Error()})
+		case !bytes.Equal(current, file.Src):
+			res = append(res, checkResult{checkFail, name, "out of date; run tedi generate"})
+		default:
+			res = append(res, checkResult{checkPass, name, "up to date"})
+		}
+	}
+	return res
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_doctor(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "foo_test.go")
+	require.NoError(t, ioutil.WriteFile(source, []byte(`package foo
+
+// @test
+func unitTest() {}
+`), 0644))
+
+	o := writeTediFileOptions{Entrypoints: []entrypoint{{Funcname: "TestMain"}}, OutputFile: "tedi_test.go"}
+	statuses := func() map[string]checkStatus {
+		res := map[string]checkStatus{}
+		for _, result := range doctor(dir, o) {
+			res[result.Name] = result.Status
+		}
+		return res
+	}
+
+	assert.Equal(t, checkWarn, statuses()["generated file tedi_test.go"])
+
+	_, _, err := writeTediFile(dir, o)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]checkStatus{
+		"go version":                  statuses()["go version"],
+		"annotations":                 checkPass,
+		"generated file tedi_test.go": checkPass,
+	}, statuses())
+	assert.NotEqual(t, checkFail, statuses()["go version"])
+
+	require.NoError(t, ioutil.WriteFile(source, []byte(`package foo
+
+// @test
+// @fixture
+func unitTest() {}
+
+// @test
+func otherTest() {}
+`), 0644))
+	assert.Equal(t, checkWarn, statuses()["annotations"])
+	assert.Equal(t, checkFail, statuses()["generated file tedi_test.go"])
+}
+
+func Test_doctorExamples(t *testing.T) {
+	// The examples are generated by the tool and never edited by hand.
+	for _, example := range []string{"auto", "labels"} {
+		dir := filepath.Join("..", "..", "examples", example)
+		for _, result := range doctor(dir, writeTediFileOptions{Entrypoints: []entrypoint{{Funcname: "TestMain"}}, OutputFile: "tedi_test.go"}) {
+			if strings.HasPrefix(result.Name, "generated file") {
+				assert.Equal(t, checkPass, result.Status, "%s: %s", example, result)
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jstroem/tedi/annotations"
+)
+
+const (
+	formatGo   = "go"
+	formatJSON = "json"
+)
+
+// jsonFunction is the JSON representation of an annotated function, as its
+// declaration cannot be serialized.
+type jsonFunction struct {
+	Name string `json:"name"`
+	// File is relative to the package directory.
+	File   string   `json:"file"`
+	Line   int      `json:"line"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+type jsonTest struct {
+	jsonFunction
+	Timeout       string   `json:"timeout,omitempty"`
+	Retries       int      `json:"retries,omitempty"`
+	Weight        int      `json:"weight,omitempty"`
+	ExpectFailure bool     `json:"expectFailure,omitempty"`
+	Capture       bool     `json:"capture,omitempty"`
+	Env           []string `json:"env,omitempty"`
+}
+
+type jsonFixture struct {
+	jsonFunction
+	Once      bool     `json:"once,omitempty"`
+	Module    string   `json:"module,omitempty"`
+	Group     string   `json:"group,omitempty"`
+	As        []string `json:"as,omitempty"`
+	Locked    bool     `json:"locked,omitempty"`
+	PerLabel  bool     `json:"perLabel,omitempty"`
+	TestScope bool     `json:"testScope,omitempty"`
+	Eager     bool     `json:"eager,omitempty"`
+	Priority  int      `json:"priority,omitempty"`
+}
+
+type jsonHook struct {
+	jsonFunction
+	Order int `json:"order,omitempty"`
+}
+
+// jsonParseResult is the JSON representation of the parsed package written by generate -format json.
+type jsonParseResult struct {
+	Package           string              `json:"package"`
+	DefaultLabel      string              `json:"defaultLabel"`
+	Labels            map[string][]string `json:"labels"`
+	LabelDescriptions map[string]string   `json:"labelDescriptions"`
+	Tests             []jsonTest          `json:"tests"`
+	Examples          []jsonFunction      `json:"examples"`
+	Fixtures          []jsonFixture       `json:"fixtures"`
+	TypeFixtures      []jsonFunction      `json:"typeFixtures"`
+	Suites            []jsonFunction      `json:"suites"`
+	BeforeTests       []jsonHook          `json:"beforeTests"`
+	AfterTests        []jsonHook          `json:"afterTests"`
+	BeforeAll         []jsonFunction      `json:"beforeAll"`
+	AfterAll          []jsonFunction      `json:"afterAll"`
+	Warnings          []string            `json:"warnings"`
+}
+
+// generateJSON writes the parsed package in dir as JSON to stdout, or to the
+// output file if -output is given.
+func generateJSON(dir string, o writeTediFileOptions) error {
+	o, err := configure(dir, o)
+	if err != nil {
+		return err
+	}
+	parsed, err := annotations.ParseWithOptions(dir, "_test.go", true, o.ParseOptions)
+	if err != nil {
+		return err
+	}
+
+	if !o.SetFlags["output"] {
+		return writeParseResultJSON(os.Stdout, dir, parsed)
+	}
+	f, err := os.Create(filepath.Join(dir, o.OutputFile))
+	if err != nil {
+		return err
+	}
+	if err := writeParseResultJSON(f, dir, parsed); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeParseResultJSON writes the tests, fixtures and labels of the package in dir as JSON.
+func writeParseResultJSON(w io.Writer, dir string, parsed *annotations.ParseResult) error {
+	function := func(fn *annotations.Function, labels []string) jsonFunction {
+		return jsonFunction{Name: fn.Name(), File: relFile(dir, fn.File), Line: fn.Position().Line, Labels: labels}
+	}
+	typeDecl := func(typ *annotations.TypeDecl) jsonFunction {
+		return jsonFunction{Name: typ.Name(), File: relFile(dir, typ.File), Line: typ.Position().Line}
+	}
+
+	res := jsonParseResult{
+		Labels:            map[string][]string{},
+		LabelDescriptions: map[string]string{},
+		Tests:             []jsonTest{},
+		Examples:          []jsonFunction{},
+		Fixtures:          []jsonFixture{},
+		TypeFixtures:      []jsonFunction{},
+		Suites:            []jsonFunction{},
+		BeforeTests:       []jsonHook{},
+		AfterTests:        []jsonHook{},
+		BeforeAll:         []jsonFunction{},
+		AfterAll:          []jsonFunction{},
+		Warnings:          []string{},
+	}
+	if parsed == nil || parsed.Package == nil {
+		return encodeJSON(w, res)
+	}
+
+	res.Package = parsed.Package.Name
+	res.DefaultLabel = parsed.DefaultTestLabel
+	for label, matchers := range parsed.TestLabels {
+		res.Labels[label] = append([]string{}, matchers...)
+	}
+	for label, description := range parsed.LabelDescriptions {
+		res.LabelDescriptions[label] = description
+	}
+	for _, test := range parsed.Tests {
+		t := jsonTest{jsonFunction: function(test.Function, test.Labels), Retries: test.Retries, Weight: test.Weight, ExpectFailure: test.ExpectFailure, Capture: test.Capture, Env: test.Env}
+		if test.Timeout > 0 {
+			t.Timeout = test.Timeout.String()
+		}
+		res.Tests = append(res.Tests, t)
+	}
+	for _, example := range parsed.Examples {
+		res.Examples = append(res.Examples, function(example.Function, example.Labels))
+	}
+
+	addFixtures := func(fixtures []*annotations.FixtureFunction, once bool, module string) {
+		for _, fixture := range fixtures {
+			f := jsonFixture{
+				jsonFunction: function(fixture.Function, nil),
+				Once:         once,
+				Module:       module,
+				Group:        fixture.Group,
+				Locked:       fixture.Locked,
+				PerLabel:     fixture.PerLabel,
+				TestScope:    fixture.TestScope,
+				Eager:        fixture.Eager,
+				Priority:     fixture.Priority,
+			}
+			for _, typ := range fixture.As {
+				f.As = append(f.As, typ.Expr)
+			}
+			res.Fixtures = append(res.Fixtures, f)
+		}
+	}
+	addFixtures(parsed.Fixtures, false, "")
+	addFixtures(parsed.OnceFixtures, true, "")
+	var modules []string
+	for name := range parsed.Modules {
+		modules = append(modules, name)
+	}
+	sort.Strings(modules)
+	for _, name := range modules {
+		addFixtures(parsed.Modules[name].Fixtures, false, name)
+		addFixtures(parsed.Modules[name].OnceFixtures, true, name)
+	}
+
+	for _, t := range parsed.TypeFixtures {
+		res.TypeFixtures = append(res.TypeFixtures, typeDecl(t))
+	}
+	for _, t := range parsed.Suites {
+		res.Suites = append(res.Suites, typeDecl(t))
+	}
+	for _, hook := range parsed.BeforeTests {
+		res.BeforeTests = append(res.BeforeTests, jsonHook{jsonFunction: function(hook.Function, hook.Labels), Order: hook.Order})
+	}
+	for _, hook := range parsed.AfterTests {
+		res.AfterTests = append(res.AfterTests, jsonHook{jsonFunction: function(hook.Function, hook.Labels), Order: hook.Order})
+	}
+	for _, fn := range parsed.BeforeAll {
+		res.BeforeAll = append(res.BeforeAll, function(fn, nil))
+	}
+	for _, fn := range parsed.AfterAll {
+		res.AfterAll = append(res.AfterAll, function(fn, nil))
+	}
+	res.Warnings = append(res.Warnings, parsed.Warnings...)
+	return encodeJSON(w, res)
+}
+
+// relFile returns file relative to dir with slashes; file if it is not within dir.
+func relFile(dir, file string) string {
+	if rel, err := filepath.Rel(dir, file); err == nil {
+		file = rel
+	}
+	return filepath.ToSlash(file)
+}
+
+func encodeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to write JSON: %w", err)
+	}
+	return nil
+}
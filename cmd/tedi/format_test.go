@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/jstroem/tedi/annotations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_writeParseResultJSON(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo_test.go"), []byte(`package foo
+
+import (
+	"bytes"
+	"io"
+)
+
+// @fixture(as=io.Writer)
+func newBuffer() *bytes.Buffer {}
+
+// @onceFixture
+// @module(db)
+func newDB() *DB {}
+
+// @test(integration)
+// @timeout(1m)
+func queryTest(db *DB, w io.Writer) {}
+
+// @test
+func unitTest() {}
+
+// @afterTest(order=2)
+func closeDB() {}
+`), 0644))
+	parsed, err := annotations.Parse(dir, "_test.go", true)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeParseResultJSON(&buf, dir, parsed))
+
+	var res jsonParseResult
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &res))
+	assert.Equal(t, "foo", res.Package)
+	assert.Equal(t, "unit", res.DefaultLabel)
+	assert.Contains(t, res.Labels, "integration")
+	if assert.Len(t, res.Tests, 2) {
+		assert.Equal(t, jsonFunction{Name: "queryTest", File: "foo_test.go", Line: 17, Labels: []string{"integration"}}, res.Tests[0].jsonFunction)
+		assert.Equal(t, "1m0s", res.Tests[0].Timeout)
+		assert.Equal(t, "unitTest", res.Tests[1].Name)
+		assert.Equal(t, []string{"unit"}, res.Tests[1].Labels)
+	}
+	if assert.Len(t, res.Fixtures, 2) {
+		assert.Equal(t, "newBuffer", res.Fixtures[0].Name)
+		assert.Equal(t, []string{"io.Writer"}, res.Fixtures[0].As)
+		assert.Equal(t, "newDB", res.Fixtures[1].Name)
+		assert.True(t, res.Fixtures[1].Once)
+		assert.Equal(t, "db", res.Fixtures[1].Module)
+	}
+	if assert.Len(t, res.AfterTests, 1) {
+		assert.Equal(t, 2, res.AfterTests[0].Order)
+	}
+	assert.Empty(t, res.Examples)
+	assert.Empty(t, res.Warnings)
+}
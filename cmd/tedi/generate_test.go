@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jstroem/tedi/annotations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseSource(t *testing.T, src string) *annotations.ParseResult {
+	res, err := annotations.ParseFiles(map[string][]byte{"source_test.go": []byte(src)}, true)
+	require.NoError(t, err)
+	return res
+}
+
+func Test_entrypointFiles(t *testing.T) {
+	files, err := entrypointFiles("tedi_test.go", []entrypoint{
+		{Funcname: "TestMain"},
+		{Funcname: "TestMain", BuildTag: "integration", Labels: []string{"integration"}},
+		{Funcname: "TestMain", BuildTag: "smoke"},
+	})
+	require.NoError(t, err)
+	if assert.Len(t, files, 3) {
+		assert.Equal(t, "tedi_test.go", files[0].Name)
+		assert.Equal(t, "!integration,!smoke", files[0].BuildTag)
+		assert.Equal(t, "tedi_integration_test.go", files[1].Name)
+		assert.Equal(t, "integration", files[1].BuildTag)
+		assert.Equal(t, "tedi_smoke_test.go", files[2].Name)
+	}
+
+	files, err = entrypointFiles("tedi_test.go", []entrypoint{{Funcname: "tediMain"}})
+	require.NoError(t, err)
+	assert.Equal(t, "tediMain", files[0].Entrypoints[0].Funcname)
+
+	for _, entrypoints := range [][]entrypoint{
+		{{Funcname: "TestMain"}, {Funcname: "tediMain"}},
+		{{Funcname: "TestMain"}, {Funcname: "TestMain", BuildTag: "a b"}},
+		{{Funcname: "TestMain", BuildTag: "unit"}, {Funcname: "tediUnit", BuildTag: "unit"}},
+		{{Funcname: "TestUnit"}},
+		{{Funcname: "TestMain"}, {Funcname: "Test_unit", BuildTag: "unit"}},
+	} {
+		_, err = entrypointFiles("tedi_test.go", entrypoints)
+		assert.Error(t, err, "%v", entrypoints)
+	}
+}
+
+func Test_generateFileEntrypoints(t *testing.T) {
+	parsed := parseSource(t, `package foo
+
+// @test
+func unitTest() {}
+
+// @test(integration, weight=3)
+// @xfail
+// @capture
+// @env(DB_HOST=localhost)
+func integrationTest() {}
+
+// @parallelism(integration=2)
+`)
+
+	bytes, write := generateFile(parsed, []entrypoint{
+		{Funcname: "TestMain", Labels: []string{"integration"}},
+	}, nil, "integration", "")
+	assert.True(t, write)
+
+	src := string(bytes)
+	assert.Contains(t, src, "// +build integration")
+	assert.Contains(t, src, "func TestMain(m *testing.M)")
+	assert.Contains(t, src, `t.Test("integrationTest", integrationTest, "integration")`)
+	assert.Contains(t, src, `t.Weight("integrationTest", 3)`)
+	assert.NotContains(t, src, `t.Weight("unitTest"`)
+	assert.Contains(t, src, `t.ExpectFailure("integrationTest")`)
+	assert.Contains(t, src, `t.Capture("integrationTest")`)
+	assert.Contains(t, src, `t.Env("integrationTest", "DB_HOST", "localhost")`)
+	assert.Contains(t, src, `t.LabelParallelism("integration", 2)`)
+	assert.NotContains(t, src, "unitTest")
+	assert.Contains(t, src, `os.Exit(t.RunLabels("integration"))`, "a labelled entrypoint runs its labels without -labels")
+
+	bytes, _ = generateFile(parsed, []entrypoint{{Funcname: "TestMain"}}, nil, "", "")
+	assert.Contains(t, string(bytes), `os.Exit(t.Run())`)
+
+	// go test rejects a second TestMain or a TestUnit(m *testing.M) in the file.
+	_, err := entrypointFiles("tedi_test.go", []entrypoint{
+		{Funcname: "TestMain", BuildTag: "integration", Labels: []string{"integration"}},
+		{Funcname: "TestUnit", BuildTag: "integration", Labels: []string{"unit"}},
+	})
+	assert.Error(t, err)
+}
+
+func Test_generateFileExamples(t *testing.T) {
+	parsed := parseSource(t, `package foo
+
+// @example
+func hello() {
+	fmt.Println("hello \"world\"")
+	// Output: hello "world"
+}
+
+// @example(integration)
+func unordered() {
+	// Unordered output:
+	// a
+	// b
+}
+`)
+
+	bytes, write := generateFile(parsed, []entrypoint{{Funcname: "TestMain", Labels: []string{"unit"}}}, nil, "", "")
+	assert.True(t, write)
+
+	src := string(bytes)
+	assert.Contains(t, src, `t.Example(testing.InternalExample{Name: "hello", F: hello, Output: "hello \"world\""}, "unit")`)
+	assert.NotContains(t, src, "unordered")
+
+	bytes, _ = generateFile(parsed, []entrypoint{{Funcname: "TestMain"}}, nil, "", "")
+	assert.Contains(t, string(bytes), `t.Example(testing.InternalExample{Name: "unordered", F: unordered, Output: "a\nb", Unordered: true}, "integration")`)
+}
+
+func Test_testNames(t *testing.T) {
+	parsed := parseSource(t, `package foo
+
+import "testing"
+
+func TestMain(m *testing.M) {}
+
+func TestFoo(t *testing.T) {}
+
+// @test
+func Foo() {}
+
+// @test
+func Bar() {}
+
+// @test
+func TestBaz(t *testing.T) {}
+`)
+
+	names, err := testNames(parsed, writeTediFileOptions{Prefix: "tedi"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tediFoo", names[parsed.Tests[0].Function])
+
+	_, err = testNames(parsed, writeTediFileOptions{Prefix: "Test"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "test name 'TestFoo' of 'Foo' collides with 'TestFoo'")
+		assert.NotContains(t, err.Error(), "Bar")
+	}
+
+	_, err = testNames(parsed, writeTediFileOptions{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "test name 'TestBaz' is also run by go test")
+	}
+
+	_, err = renderTediFiles(parsed, writeTediFileOptions{Entrypoints: []entrypoint{{Funcname: "TestMain"}}, OutputFile: "tedi_test.go", Prefix: "Test"})
+	assert.Error(t, err)
+}
+
+func Test_nameTemplate(t *testing.T) {
+	parsed := parseSource(t, `package foo
+
+// @test
+func fooBar() {}
+
+// @test
+func Baz() {}
+`)
+
+	o := writeTediFileOptions{Entrypoints: []entrypoint{{Funcname: "TestMain"}}, OutputFile: "tedi_test.go", Prefix: "x", NameTemplate: "{{.Prefix}}{{upper .Name}}"}
+	files, err := renderTediFiles(parsed, o)
+	require.NoError(t, err)
+	src := string(files[0].Src)
+	assert.Contains(t, src, `t.Test("xFOOBAR", fooBar, "unit")`)
+	assert.Contains(t, src, `t.Test("xBAZ", Baz, "unit")`)
+
+	o.NameTemplate = "{{snake .Name}}_{{index .Labels 0}}"
+	names, err := testNames(parsed, o)
+	require.NoError(t, err)
+	assert.Equal(t, "foo_bar_unit", names[parsed.Tests[0].Function])
+
+	for _, tmpl := range []string{"{{.Name", "{{.Unknown}}", "{{unknown .Name}}", `{{.Name}}"`, "{{if false}}x{{end}}"} {
+		o.NameTemplate = tmpl
+		_, err := renderTediFiles(parsed, o)
+		assert.Error(t, err, tmpl)
+	}
+}
+
+func Test_generateFileFixtureOptions(t *testing.T) {
+	parsed := parseSource(t, `package foo
+
+import (
+	"io"
+	pb "example.com/proto/v2"
+	"os"
+)
+
+// @fixture(as=io.Writer, as=os.Signal)
+func newBuffer() {}
+
+// @onceFixture(as=pb.Client)
+func newClient() {}
+
+// @fixture(group=handlers)
+func newHandler() {}
+
+// @fixture(as=pb.Client, priority=10)
+func newMockClient() {}
+
+// @onceFixture(locked)
+func newCounter() {}
+
+// @onceFixture(perLabel)
+func newDB() {}
+
+// @fixture
+type client struct{}
+
+// @fixture(scope=test)
+func newSession() {}
+
+// @fixture(eager)
+func startServer() {}
+
+// @beforeTest(order=-1)
+func openDB() {}
+
+// @afterTest
+func closeDB() {}
+
+// @afterTest(integration, order=2)
+func stopServer() {}
+`)
+
+	bytes, _ := generateFile(parsed, []entrypoint{{Funcname: "TestMain"}}, nil, "", "")
+	src := string(bytes)
+	assert.Contains(t, src, `t.Fixture(newBuffer, tedi.As(new(io.Writer), new(os.Signal)))`)
+	assert.Contains(t, src, `t.OnceFixture(newClient, tedi.As(new(pb.Client)))`)
+	assert.Contains(t, src, `t.Fixture(newHandler, tedi.Group("handlers"))`)
+	assert.Contains(t, src, `t.Fixture(newMockClient, tedi.As(new(pb.Client)), tedi.Priority(10))`)
+	assert.Contains(t, src, `t.OnceFixture(tedi.Locked(newCounter))`)
+	assert.Contains(t, src, `t.OnceFixture(newDB, tedi.PerLabel())`)
+	assert.Contains(t, src, `t.Fixture(newSession, tedi.TestScope())`)
+	assert.Contains(t, src, `t.Fixture(startServer, tedi.Eager())`)
+	assert.Contains(t, src, `t.Fixture(func() *client { return &client{} })`)
+	assert.Contains(t, src, `t.BeforeTest(openDB, tedi.Order(-1))`)
+	assert.Contains(t, src, `t.AfterTest(closeDB)`+"\n")
+	assert.Contains(t, src, `t.AfterTest(stopServer, tedi.Order(2), tedi.Labels("integration"))`)
+	assert.Contains(t, src, "\"io\"\n")
+	assert.Contains(t, src, "pb \"example.com/proto/v2\"\n")
+	assert.Equal(t, 1, strings.Count(src, `"os"`))
+}
+
+func Test_generateFileBeforeAfterAll(t *testing.T) {
+	parsed := parseSource(t, `package foo
+
+// @afterAll
+func stopDatabase(db *DB) {}
+
+// @test
+func queryTest(db *DB) {}
+
+// @beforeAll
+func startDatabase(db *DB) {}
+
+// @beforeAll
+func migrateDatabase(db *DB) {}
+
+// @onceFixture
+func newDB() *DB {}
+`)
+
+	bytes, _ := generateFile(parsed, []entrypoint{{Funcname: "TestMain"}}, nil, "", "")
+	src := string(bytes)
+	start := strings.Index(src, `t.BeforeAll(startDatabase)`)
+	migrate := strings.Index(src, `t.BeforeAll(migrateDatabase)`)
+	test := strings.Index(src, `t.Test("queryTest", queryTest, "unit")`)
+	stop := strings.Index(src, `t.AfterAll(stopDatabase)`)
+	assert.True(t, start >= 0 && migrate >= 0 && test >= 0 && stop >= 0, src)
+	assert.True(t, start < migrate, "BeforeAll hooks are registered in declaration order")
+	assert.True(t, migrate < test, "BeforeAll hooks are registered before the tests")
+	assert.True(t, test < stop, "AfterAll hooks are registered after the tests")
+}
+
+func Test_generateFileModules(t *testing.T) {
+	parsed := parseSource(t, `package foo
+
+// @fixture
+// @module("db \\ \"main\"")
+func newDB() *DB {}
+`)
+
+	bytes, _ := generateFile(parsed, []entrypoint{{Funcname: "TestMain"}}, nil, "", "")
+	src := string(bytes)
+	assert.Contains(t, src, `t.Module("db \\ \"main\"", func(t *tedi.Tedi) {`)
+	assert.Contains(t, src, "t.Fixture(newDB)\n")
+}
+
+func Test_generateFileSuite(t *testing.T) {
+	parsed := parseSource(t, `package foo
+
+type suite struct{}
+
+// @fixture
+func (s *suite) newDB() *DB {}
+
+// @beforeTest
+func (s *suite) openDB() {}
+
+// @test(integration)
+func (s *suite) queryTest(db *DB) {}
+`)
+
+	bytes, _ := generateFile(parsed, []entrypoint{{Funcname: "TestMain"}}, nil, "", "")
+	src := string(bytes)
+	assert.Contains(t, src, `t.Fixture(func() *suite { return &suite{} })`)
+	assert.Contains(t, src, `t.Fixture((*suite).newDB)`)
+	assert.Contains(t, src, `t.BeforeTest((*suite).openDB)`)
+	assert.Contains(t, src, `t.Test("suite.queryTest", (*suite).queryTest, "integration")`)
+}
+
+func Test_generateFileImportPath(t *testing.T) {
+	parsed := parseSource(t, `package foo
+
+// @test
+func unitTest() {}
+`)
+
+	bytes, _ := generateFile(parsed, []entrypoint{{Funcname: "TestMain"}}, nil, "", "")
+	assert.Contains(t, string(bytes), `"github.com/jstroem/tedi"`)
+
+	bytes, _ = generateFile(parsed, []entrypoint{{Funcname: "TestMain"}}, nil, "", "example.com/fork/tedi/v2")
+	assert.Contains(t, string(bytes), "\n\"example.com/fork/tedi/v2\"\n")
+	assert.NotContains(t, string(bytes), tediPackage)
+
+	bytes, _ = generateFile(parsed, []entrypoint{{Funcname: "TestMain"}}, nil, "", "example.com/vendor/tedi-fork")
+	assert.Contains(t, string(bytes), `tedi "example.com/vendor/tedi-fork"`)
+}
+
+func Test_checkImportPath(t *testing.T) {
+	assert.NoError(t, checkImportPath(tediPackage))
+	assert.NoError(t, checkImportPath("example.com/fork/tedi/v2"))
+	assert.NoError(t, checkImportPath("vendored/tedi"))
+	assert.Error(t, checkImportPath(""))
+	assert.Error(t, checkImportPath("example.com//tedi"))
+	assert.Error(t, checkImportPath("/example.com/tedi"))
+	assert.Error(t, checkImportPath("example.com/../tedi"))
+	assert.Error(t, checkImportPath("example.com/te di"))
+	assert.Error(t, checkImportPath(`example.com/"tedi"`))
+}
+
+func Test_writeTediFileOutputDir(t *testing.T) {
+	root := t.TempDir()
+	pkgDir := filepath.Join(root, "internal", "foo")
+	require.NoError(t, os.MkdirAll(pkgDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/foo\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(pkgDir, "foo_test.go"), []byte(`package foo
+
+// @test
+func unitTest() {}
+`), 0644))
+
+	_, _, err := writeTediFile(pkgDir, writeTediFileOptions{
+		Entrypoints: []entrypoint{{Funcname: "TestMain"}},
+		OutputFile:  "tedi_test.go",
+		OutputDir:   "gen",
+	})
+	require.NoError(t, err)
+
+	generated := filepath.Join(root, "gen", "internal", "foo", "tedi_test.go")
+	src, err := ioutil.ReadFile(generated)
+	require.NoError(t, err)
+	assert.Contains(t, string(src), "package foo")
+	_, err = os.Stat(filepath.Join(pkgDir, "tedi_test.go"))
+	assert.True(t, os.IsNotExist(err))
+
+	bytes, err := ioutil.ReadFile(filepath.Join(root, "gen", overlayFileName))
+	require.NoError(t, err)
+	var o overlay
+	require.NoError(t, json.Unmarshal(bytes, &o))
+	assert.Equal(t, map[string]string{filepath.Join(pkgDir, "tedi_test.go"): generated}, o.Replace)
+}
+
+func Test_packagesOverlay(t *testing.T) {
+	root := t.TempDir()
+	var dirs []string
+	for _, name := range []string{"foo", "bar"} {
+		dir := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/"+name+"\n"), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+"_test.go"), []byte("package "+name+"\n\n// @test\nfunc unitTest() {}\n"), 0644))
+		_, _, err := writeTediFile(dir, writeTediFileOptions{
+			Entrypoints: []entrypoint{{Funcname: "TestMain"}},
+			OutputFile:  "tedi_test.go",
+			OutputDir:   "gen",
+		})
+		require.NoError(t, err)
+		dirs = append(dirs, dir)
+	}
+
+	overlayFile, temporary, err := packagesOverlay(dirs[:1], "gen")
+	require.NoError(t, err)
+	assert.False(t, temporary)
+	assert.Equal(t, filepath.Join(root, "foo", "gen", overlayFileName), overlayFile)
+
+	// The modules have their own overlay, which are merged as go test takes one.
+	overlayFile, temporary, err = packagesOverlay(dirs, "gen")
+	require.NoError(t, err)
+	assert.True(t, temporary)
+	defer os.Remove(overlayFile)
+	o, err := readOverlay(overlayFile)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		filepath.Join(root, "foo", "tedi_test.go"): filepath.Join(root, "foo", "gen", "tedi_test.go"),
+		filepath.Join(root, "bar", "tedi_test.go"): filepath.Join(root, "bar", "gen", "tedi_test.go"),
+	}, o.Replace)
+}
+
+func Test_writeTediFileOnly(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo_test.go"), []byte(`package foo
+
+// @fixture
+func newDB() string { return "db" }
+
+// @test
+func queryTest(db string) {}
+
+// @test(integration)
+func insertTest(db string) {}
+
+// @example
+func exampleQuery() {
+	// Output: query
+}
+`), 0644))
+
+	parsed, _, err := writeTediFile(dir, writeTediFileOptions{
+		Entrypoints: []entrypoint{{Funcname: "TestMain"}},
+		OutputFile:  "tedi_test.go",
+		Only:        "insertTest",
+	})
+	require.NoError(t, err)
+	if assert.Len(t, parsed.Tests, 1) {
+		assert.Equal(t, "insertTest", parsed.Tests[0].Name())
+	}
+
+	src, err := ioutil.ReadFile(filepath.Join(dir, "tedi_test.go"))
+	require.NoError(t, err)
+	assert.Contains(t, string(src), `t.Test("insertTest", insertTest, "integration")`)
+	assert.Contains(t, string(src), `t.Fixture(newDB)`)
+	assert.NotContains(t, string(src), "queryTest")
+	assert.NotContains(t, string(src), "exampleQuery")
+}
+
+func Test_noTestsMessage(t *testing.T) {
+	assert.Equal(t, "", noTestsMessage(parseSource(t, `package foo
+
+// @test
+func query() {}
+`)))
+
+	assert.Equal(t, "no annotations found; did you forget @test?", noTestsMessage(parseSource(t, `package foo
+
+func verifyQuery(t *testing.T) {}
+
+func helper() {}
+`)))
+
+	// go test runs the tests of a package without annotations by itself.
+	assert.Equal(t, "", noTestsMessage(parseSource(t, `package foo
+
+func TestMain(m *testing.M) {}
+
+func TestQuery(t *testing.T) {}
+`)))
+
+	assert.Contains(t, noTestsMessage(parseSource(t, `package foo
+
+// @fixture
+func newDB() string { return "db" }
+`)), "no tests;")
+
+	assert.Contains(t, noTestsMessage(parseSource(t, `package foo
+
+type helper struct{}
+`)), "no functions")
+}
+
+func Test_onlyRunRegexp(t *testing.T) {
+	assert.Equal(t, `^(queryTest)$`, onlyRunRegexp(map[string]bool{"queryTest": true}))
+	assert.Equal(t, `^(TestQuery|suite\.queryTest)$`, onlyRunRegexp(map[string]bool{"suite.queryTest": true, "TestQuery": true}))
+}
+
+func Test_removeGeneratedFiles(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "foo_test.go")
+	require.NoError(t, ioutil.WriteFile(source, []byte(`package foo
+
+// @test
+func unitTest() {}
+`), 0644))
+
+	o := writeTediFileOptions{
+		Entrypoints: []entrypoint{{Funcname: "TestMain", BuildTag: "tedi"}},
+		OutputFile:  "tedi_test.go",
+		ForceWrite:  true,
+		Previous:    map[string][]byte{},
+	}
+	_, written, err := writeTediFile(dir, o)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "tedi_test.go")}, written)
+	assert.Empty(t, o.Previous)
+
+	// tedi test -keep=false removes the written files after go test.
+	require.NoError(t, restoreFiles(append(written, filepath.Join(dir, "missing_test.go")), o.Previous))
+	_, err = os.Stat(filepath.Join(dir, "tedi_test.go"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(source)
+	assert.NoError(t, err)
+
+	// Files which existed before are restored instead of removed.
+	committed := []byte("package foo\n\n// committed\n")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "tedi_test.go"), committed, 0644))
+	_, written, err = writeTediFile(dir, o)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{filepath.Join(dir, "tedi_test.go"): committed}, o.Previous)
+	require.NoError(t, restoreFiles(written, o.Previous))
+	src, err := ioutil.ReadFile(filepath.Join(dir, "tedi_test.go"))
+	require.NoError(t, err)
+	assert.Equal(t, committed, src)
+}
+
+func Test_writeTediFileCheck(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo_test.go"), []byte(`package foo
+
+// @test
+func unitTest() {}
+`), 0644))
+	o := writeTediFileOptions{Entrypoints: []entrypoint{{Funcname: "TestMain"}}, OutputFile: "tedi_test.go"}
+	_, _, err := writeTediFile(dir, o)
+	require.NoError(t, err)
+
+	var diff bytes.Buffer
+	o.Check = &diff
+	_, stale, err := writeTediFile(dir, o)
+	require.NoError(t, err)
+	assert.Empty(t, stale)
+	assert.Empty(t, diff.String())
+
+	// A new test makes the generated file out of date.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bar_test.go"), []byte(`package foo
+
+// @test(integration)
+func queryTest() {}
+`), 0644))
+	before, err := ioutil.ReadFile(filepath.Join(dir, "tedi_test.go"))
+	require.NoError(t, err)
+
+	_, stale, err = writeTediFile(dir, o)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "tedi_test.go")}, stale)
+	assert.Contains(t, diff.String(), "--- a/tedi_test.go\n+++ b/tedi_test.go\n@@ ")
+	assert.Contains(t, diff.String(), "\n+\tt.Test(\"queryTest\", queryTest, \"integration\")\n")
+
+	after, err := ioutil.ReadFile(filepath.Join(dir, "tedi_test.go"))
+	require.NoError(t, err)
+	assert.Equal(t, string(before), string(after), "-check must not write the file")
+}
+
+func Test_unifiedDiff(t *testing.T) {
+	assert.Empty(t, unifiedDiff("a.go", []byte("a\nb\n"), []byte("a\nb\n")))
+	assert.Equal(t, "--- a/a.go\n+++ b/a.go\n@@ -1,5 +1,5 @@\n 1\n 2\n-3\n+three\n 4\n 5\n",
+		unifiedDiff("a.go", []byte("1\n2\n3\n4\n5\n"), []byte("1\n2\nthree\n4\n5\n")))
+	assert.Equal(t, "--- a/a.go\n+++ b/a.go\n@@ -0,0 +1,2 @@\n+a\n+b\n", unifiedDiff("a.go", nil, []byte("a\nb\n")))
+	// Changes far apart get their own hunks.
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	new := "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n"
+	assert.Equal(t, "--- a/a.go\n+++ b/a.go\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n", unifiedDiff("a.go", []byte(old), []byte(new)))
+}
+
+func Test_removeFlag(t *testing.T) {
+	assert.Equal(t, []string{"-v", "./..."}, removeFlag([]string{"-output-dir", "gen", "-v", "./..."}, "-output-dir"))
+	assert.Equal(t, []string{"-v", "./..."}, removeFlag([]string{"-v", "-output-dir=gen", "./..."}, "-output-dir"))
+}
+
+func Test_mergeTags(t *testing.T) {
+	assert.Equal(t, []string{"-tags", "tedi", "-v", "./..."}, mergeTags([]string{"-v", "./..."}, "tedi"))
+	assert.Equal(t, []string{"-tags", "integration,tedi", "-v", "./..."}, mergeTags([]string{"-v", "-tags", "integration", "./..."}, "tedi"))
+	assert.Equal(t, []string{"-tags", "a,b,tedi", "./..."}, mergeTags([]string{"-tags=a,b", "./..."}, "tedi"))
+	assert.Equal(t, []string{"-tags", "a,b,tedi", "./..."}, mergeTags([]string{"-tags", "a b", "./..."}, "tedi"))
+	assert.Equal(t, []string{"-tags", "tedi,a", "./..."}, mergeTags([]string{"-tags", "tedi,a", "./..."}, "tedi"))
+}
+
+func Test_labelCoverProfile(t *testing.T) {
+	assert.Equal(t, []string{"-coverprofile", "cover.integration.out", "./..."}, labelCoverProfile([]string{"-coverprofile", "cover.out", "./..."}, "integration", ","))
+	assert.Equal(t, []string{"-v", "-coverprofile=out/cover.integration-regression.out"}, labelCoverProfile([]string{"-v", "-coverprofile=out/cover.out"}, "regression,integration", ","))
+	assert.Equal(t, []string{"-coverprofile=cover.integration-regression.out"}, labelCoverProfile([]string{"-coverprofile=cover.out"}, "regression, integration", ","))
+	assert.Equal(t, []string{"-coverprofile", "cover._labels_txt"}, labelCoverProfile([]string{"-coverprofile", "cover"}, "@labels.txt", ","))
+	assert.Equal(t, []string{"-v", "./..."}, labelCoverProfile([]string{"-v", "./..."}, "unit", ","))
+	assert.Equal(t, []string{"-coverprofile=cover.integration-regression.out"}, labelCoverProfile([]string{"-coverprofile=cover.out"}, "regression;integration", ";"))
+}
+
+func Test_moveTediFlags(t *testing.T) {
+	args := moveTediFlags([]string{"tedi", "test", "-labels", "unit;integration", "-label-sep", ";", "-v", "./..."})
+	assert.Equal(t, []string{"tedi", "test", "-v", "./...", "-labels", "unit;integration", "-label-sep", ";"}, args)
+}
+
+func Test_renderTediFilesImports(t *testing.T) {
+	parsed := parseSource(t, `package foo
+
+import "io"
+
+// @fixture
+func newWriter() io.Writer { return nil }
+
+// @test
+// @timeout(1s)
+func writeTest(w io.Writer) {}
+`)
+
+	o := writeTediFileOptions{Entrypoints: []entrypoint{{Funcname: "TestMain"}}, OutputFile: "tedi_test.go"}
+	files, err := renderTediFiles(parsed, o)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Contains(t, string(files[0].Src), "import (\n\t\"os\"\n\t\"testing\"\n\t\"time\"\n\n\t\"github.com/jstroem/tedi\"\n)\n")
+
+	o.NoImports = true
+	files, err = renderTediFiles(parsed, o)
+	require.NoError(t, err)
+	assert.Contains(t, string(files[0].Src), "import (\n\t\"github.com/jstroem/tedi\"\n\t\"os\"\n\t\"testing\"\n\t\"time\"\n)\n")
+}
+
+func Test_runTestsOnly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go test")
+	}
+	// The package must be in the module to import tedi; go test ./... skips
+	// directories starting with an underscore.
+	dir, err := ioutil.TempDir(".", "_only")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo.go"), []byte("package foo\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo_test.go"), []byte(`package foo
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// @test
+func queryTest() {}
+
+// @test(integration)
+func insertTest() {
+	ioutil.WriteFile(os.Getenv("TEDI_ONLY_MARKER"), nil, 0644)
+}
+`), 0644))
+	marker := filepath.Join(t.TempDir(), "ran")
+	t.Setenv("TEDI_ONLY_MARKER", marker)
+
+	args := os.Args
+	defer func() {
+		os.Args = args
+		*tediOnly = ""
+	}()
+	os.Args = []string{"tedi", "test", "-only", "insertTest", "./" + filepath.Base(dir)}
+	require.NoError(t, testCmd.Parse(os.Args[2:]))
+
+	exitCode, _, err := runTests(map[string][]byte{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, exitCode)
+	_, err = os.Stat(marker)
+	assert.NoError(t, err, "the integration test given by -only runs without -labels")
+	assert.Contains(t, os.Args, "integration")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/build"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+var (
+	initCmd   = flag.NewFlagSet("init", flag.ExitOnError)
+	initFile  = initCmd.String("file", "example_test.go", "name of the test file to create")
+	initForce = initCmd.Bool("force", false, "overwrite the test file if it exists")
+)
+
+func initCommand() {
+	dir, err := os.Getwd()
+	if err != nil {
+		die(err)
+	}
+
+	file, err := scaffold(dir, *initFile, *initForce)
+	if err != nil {
+		die(err)
+	}
+	log.Printf("created %s", file)
+
+	o, err := configure(dir, writeTediFileOptions{
+		Entrypoints: []entrypoint{{Funcname: "TestMain"}},
+		OutputFile:  "tedi_test.go",
+	})
+	if err != nil {
+		die(err)
+	}
+	if _, _, err := writeTediFile(dir, o); err != nil {
+		die(err)
+	}
+	log.Printf("generated %s; run the tests with tedi test", o.OutputFile)
+}
+
+// scaffoldTemplate is the test file created by tedi init, in the style of the examples.
+var scaffoldTemplate = template.Must(template.New("scaffold").Parse(`package {{.Package}}
+
+import (
+	"github.com/jstroem/tedi"
+)
+
+// greeting is the value of the fixture below. Replace it by the types the
+// tests depend on, like a connection to a database.
+type greeting string
+
+// newGreeting is a fixture: tests get its value by having a parameter of the
+// type it returns. It is called for every test depending on it; use
+// @onceFixture to share a single value between all tests.
+//
+// @fixture
+func newGreeting() greeting {
+	return "hello"
+}
+
+// logGreeting is called before every test with the same fixtures as the test.
+//
+// @beforeTest
+func logGreeting(t *tedi.T, g greeting) {
+	t.Logf("%s greets with %q", t.Name(), g)
+}
+
+// greetingTest is a test with the label unit. Run it with tedi test, or
+// with go test once tedi generate has generated the TestMain running it.
+//
+// @test(unit)
+func greetingTest(t *tedi.T, g greeting) {
+	if g != "hello" {
+		t.Errorf("got greeting %q, want %q", g, "hello")
+	}
+}
+`))
+
+// scaffold writes the annotated test file to dir and returns its path. It
+// fails if the file exists, unless force is set.
+func scaffold(dir, fileName string, force bool) (string, error) {
+	file := filepath.Join(dir, fileName)
+	if !strings.HasSuffix(fileName, "_test.go") {
+		return "", fmt.Errorf("%s is not a test file; its name must end with _test.go", fileName)
+	}
+	if _, err := os.Stat(file); err == nil && !force {
+		return "", fmt.Errorf("%s already exists; use -force to overwrite it", file)
+	}
+
+	var buf bytes.Buffer
+	if err := scaffoldTemplate.Execute(&buf, struct{ Package string }{packageName(dir)}); err != nil {
+		return "", err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return file, ioutil.WriteFile(file, src, 0644)
+}
+
+// packageName returns the name of the package in dir, or a name derived from
+// the directory if it has no Go files yet.
+func packageName(dir string) string {
+	pkg, err := build.ImportDir(dir, 0)
+	if err == nil && pkg.Name != "" {
+		return pkg.Name
+	}
+	var noGo *build.NoGoError
+	if err != nil && !errors.As(err, &noGo) {
+		log.Printf("warning: failed to read the package name: %s", err)
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, filepath.Base(dir))
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "pkg" + name
+	}
+	return name
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_scaffold(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo.go"), []byte("package foo\n"), 0644))
+
+	file, err := scaffold(dir, "example_test.go", false)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "example_test.go"), file)
+
+	src, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	f, err := parser.ParseFile(token.NewFileSet(), file, src, parser.ParseComments)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", f.Name.Name)
+
+	parsed, written, err := writeTediFile(dir, writeTediFileOptions{Entrypoints: []entrypoint{{Funcname: "TestMain"}}, OutputFile: "tedi_test.go"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "tedi_test.go")}, written)
+	assert.Empty(t, parsed.Warnings)
+	assert.Len(t, parsed.Fixtures, 1)
+	assert.Len(t, parsed.BeforeTests, 1)
+	if assert.Len(t, parsed.Tests, 1) {
+		assert.Equal(t, []string{"unit"}, parsed.Tests[0].Labels)
+	}
+
+	// An existing file is only overwritten with -force.
+	require.NoError(t, ioutil.WriteFile(file, []byte("package foo\n"), 0644))
+	_, err = scaffold(dir, "example_test.go", false)
+	assert.Error(t, err)
+	_, err = scaffold(dir, "example_test.go", true)
+	assert.NoError(t, err)
+	src, err = ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Contains(t, string(src), "@test(unit)")
+
+	_, err = scaffold(dir, "example.go", false)
+	assert.Error(t, err)
+}
+
+func Test_packageName(t *testing.T) {
+	root := t.TempDir()
+	for dir, expected := range map[string]string{
+		"my-pkg": "mypkg",
+		"2fa":    "pkg2fa",
+		"Tedi":   "tedi",
+	} {
+		require.NoError(t, os.Mkdir(filepath.Join(root, dir), 0755))
+		assert.Equal(t, expected, packageName(filepath.Join(root, dir)), dir)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jstroem/tedi/annotations"
+)
+
+// packageLabels maps the import path of a package to the labels of its tests by name.
+type packageLabels map[string]map[string][]string
+
+// add records the labels of the tests of the package in dir, named with the prefix.
+func (p packageLabels) add(dir string, parsed *annotations.ParseResult, prefix string) error {
+	importPath, err := importPath(dir)
+	if err != nil {
+		return err
+	}
+
+	labels := map[string][]string{}
+	for _, test := range labeledTests(parsed, prefix, nil) {
+		labels[test.Name] = test.Labels
+	}
+	p[importPath] = labels
+	return nil
+}
+
+// labels returns the labels of the test of pkg, which are the labels of the
+// root test for subtests.
+func (p packageLabels) labels(pkg, test string) ([]string, bool) {
+	if i := strings.Index(test, "/"); i >= 0 {
+		test = test[:i]
+	}
+	labels, ok := p[pkg][test]
+	return labels, ok
+}
+
+// annotateTestEvents copies the test2json events of r to w, adding the labels
+// of the test to every event of a test as the Labels field. Lines which are
+// not events are copied as is.
+func annotateTestEvents(r io.Reader, w io.Writer, labels packageLabels) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		var event struct {
+			Package string
+			Test    string
+		}
+		trimmed := bytes.TrimSpace(line)
+		if json.Unmarshal(trimmed, &event) == nil && event.Test != "" && bytes.HasSuffix(trimmed, []byte("}")) {
+			if testLabels, ok := labels.labels(event.Package, event.Test); ok {
+				encoded, err := json.Marshal(testLabels)
+				if err != nil {
+					return err
+				}
+				var annotated bytes.Buffer
+				annotated.Write(trimmed[:len(trimmed)-1])
+				annotated.WriteString(`,"Labels":`)
+				annotated.Write(encoded)
+				annotated.WriteByte('}')
+				line = annotated.Bytes()
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// importPath returns the import path of the package in dir from the module path of its go.mod.
+func importPath(dir string) (string, error) {
+	root, err := moduleRoot(dir)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return "", err
+	}
+
+	goMod, err := ioutil.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(goMod), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "module" {
+			continue
+		}
+		modulePath := fields[1]
+		if unquoted, err := strconv.Unquote(modulePath); err == nil {
+			modulePath = unquoted
+		}
+		return path.Join(modulePath, filepath.ToSlash(rel)), nil
+	}
+	return "", fmt.Errorf("no module path found in %s", filepath.Join(root, "go.mod"))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_annotateTestEvents(t *testing.T) {
+	labels := packageLabels{"example.com/foo": {
+		"queryTest": {"integration", "slow"},
+		"parseTest": {"unit"},
+	}}
+
+	in := strings.Join([]string{
+		`{"Action":"run","Package":"example.com/foo","Test":"queryTest"}`,
+		`{"Action":"output","Package":"example.com/foo","Test":"queryTest/sub","Output":"=== RUN   queryTest/sub\n"}`,
+		`{"Action":"pass","Package":"example.com/bar","Test":"parseTest","Elapsed":0}`,
+		`{"Action":"pass","Package":"example.com/foo","Test":"parseTest","Elapsed":0}`,
+		`{"Action":"pass","Package":"example.com/foo","Elapsed":0.1}`,
+		`# example.com/foo [build failed]`,
+	}, "\n")
+
+	var out bytes.Buffer
+	require.NoError(t, annotateTestEvents(strings.NewReader(in), &out, labels))
+	assert.Equal(t, strings.Join([]string{
+		`{"Action":"run","Package":"example.com/foo","Test":"queryTest","Labels":["integration","slow"]}`,
+		`{"Action":"output","Package":"example.com/foo","Test":"queryTest/sub","Output":"=== RUN   queryTest/sub\n","Labels":["integration","slow"]}`,
+		`{"Action":"pass","Package":"example.com/bar","Test":"parseTest","Elapsed":0}`,
+		`{"Action":"pass","Package":"example.com/foo","Test":"parseTest","Elapsed":0,"Labels":["unit"]}`,
+		`{"Action":"pass","Package":"example.com/foo","Elapsed":0.1}`,
+		`# example.com/foo [build failed]`,
+	}, "\n")+"\n", out.String())
+}
+
+func Test_goTestError(t *testing.T) {
+	assert.NoError(t, goTestError(nil))
+	assert.NoError(t, goTestError(exec.Command("false").Run()), "the exit code of go test is the exit code of tedi")
+
+	err := goTestError(exec.Command(filepath.Join(t.TempDir(), "missing")).Run())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to run go test")
+	}
+}
+
+func Test_importPath(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/foo\n\ngo 1.15\n"), 0644))
+
+	res, err := importPath(filepath.Join(root, "internal", "bar"))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com/foo/internal/bar", res)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jstroem/tedi/annotations"
+)
+
+var (
+	listLabelsCmd    = flag.NewFlagSet("list-labels", flag.ExitOnError)
+	listLabelsJSON   = listLabelsCmd.Bool("json", false, "print the tests and labels as JSON instead of tab separated lines")
+	listLabelsFilter = listLabelsCmd.String("labels", "", "only list tests matching the label `expression`, like 'integration,unit+!slow'; default all tests")
+	listLabelsPrefix = listLabelsCmd.String("prefix", "", "prefix name of tests; default <none>")
+)
+
+func listLabelsCommand() {
+	dir, err := os.Getwd()
+	if err != nil {
+		die(err)
+	}
+
+	o, err := configure(dir, writeTediFileOptions{Prefix: *listLabelsPrefix, SetFlags: setFlags(listLabelsCmd)})
+	if err != nil {
+		die(err)
+	}
+
+	parsed, err := annotations.ParseWithOptions(dir, "_test.go", true, o.ParseOptions)
+	if err != nil {
+		die(err)
+	}
+
+	expr, err := parseLabelExpr(*listLabelsFilter)
+	if err != nil {
+		die(err)
+	}
+
+	tests := labeledTests(parsed, o.Prefix, expr)
+	var descriptions map[string]string
+	if parsed != nil {
+		descriptions = parsed.LabelDescriptions
+	}
+	if *listLabelsJSON {
+		err = writeLabelsJSON(os.Stdout, tests, descriptions)
+	} else {
+		err = writeLabelsTSV(os.Stdout, tests, descriptions)
+	}
+	if err != nil {
+		die(err)
+	}
+}
+
+// labeledTest is a test or example together with its labels.
+type labeledTest struct {
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+}
+
+// labeledTests returns the tests and examples of the package matching expr,
+// sorted by name.
+func labeledTests(parsed *annotations.ParseResult, prefix string, expr labelExpr) []labeledTest {
+	var res []labeledTest
+	add := func(fn *annotations.Function, labels []string) {
+		if expr.matches(labels) {
+			labels = append([]string{}, labels...)
+			sort.Strings(labels)
+			res = append(res, labeledTest{Name: prefix + fn.Name(), Labels: labels})
+		}
+	}
+	if parsed != nil {
+		for _, test := range parsed.Tests {
+			add(test.Function, test.Labels)
+		}
+		for _, example := range parsed.Examples {
+			add(example.Function, example.Labels)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// writeLabelsTSV writes a line with the name, the comma separated labels and
+// the descriptions of these labels of every test.
+func writeLabelsTSV(w io.Writer, tests []labeledTest, descriptions map[string]string) error {
+	for _, test := range tests {
+		var described []string
+		for _, label := range test.Labels {
+			if description, ok := descriptions[label]; ok {
+				described = append(described, label+": "+description)
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", test.Name, strings.Join(test.Labels, ","), strings.Join(described, "; ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLabelsJSON writes the tests together with the tests grouped by label
+// and the descriptions of the labels.
+func writeLabelsJSON(w io.Writer, tests []labeledTest, descriptions map[string]string) error {
+	res := struct {
+		Tests        []labeledTest       `json:"tests"`
+		Labels       map[string][]string `json:"labels"`
+		Descriptions map[string]string   `json:"descriptions"`
+	}{Tests: tests, Labels: map[string][]string{}, Descriptions: map[string]string{}}
+	if res.Tests == nil {
+		res.Tests = []labeledTest{}
+	}
+	for _, test := range tests {
+		for _, label := range test.Labels {
+			res.Labels[label] = append(res.Labels[label], test.Name)
+		}
+	}
+	for label, description := range descriptions {
+		res.Descriptions[label] = description
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(res)
+}
+
+// labelExpr is a label expression in disjunctive normal form: a test matches
+// if all terms of any of the clauses match its labels. A term is a label, or a
+// label prefixed by ! matching tests without the label.
+type labelExpr [][]string
+
+// parseLabelExpr parses clauses separated by ',' of terms separated by '+',
+// like 'integration,unit+!slow'. The empty expression matches all tests.
+func parseLabelExpr(s string) (labelExpr, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var res labelExpr
+	for _, clause := range strings.Split(s, ",") {
+		var terms []string
+		for _, term := range strings.Split(clause, "+") {
+			term = strings.TrimSpace(term)
+			if strings.TrimPrefix(term, "!") == "" {
+				return nil, fmt.Errorf("label expression %q has an empty label", s)
+			}
+			terms = append(terms, term)
+		}
+		res = append(res, terms)
+	}
+	return res, nil
+}
+
+func (e labelExpr) matches(labels []string) bool {
+	if len(e) == 0 {
+		return true
+	}
+
+	has := map[string]bool{}
+	for _, label := range labels {
+		has[label] = true
+	}
+
+clauseLoop:
+	for _, clause := range e {
+		for _, term := range clause {
+			if strings.HasPrefix(term, "!") == has[strings.TrimPrefix(term, "!")] {
+				continue clauseLoop
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_listLabels(t *testing.T) {
+	parsed := parseSource(t, `package foo
+
+// @testLabel(slow, "Long running tests")
+
+// @test(integration, slow)
+func queryTest() {}
+
+// @test(integration)
+func insertTest() {}
+
+// @test
+func parseTest() {}
+
+// @example(unit)
+func greeting() {
+	// Output: hello
+}
+`)
+
+	all, err := parseLabelExpr("")
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, writeLabelsTSV(&out, labeledTests(parsed, "", all), parsed.LabelDescriptions))
+	assert.Equal(t, "greeting\tunit\t\ninsertTest\tintegration\t\nparseTest\tunit\t\nqueryTest\tintegration,slow\tslow: Long running tests\n", out.String())
+
+	out.Reset()
+	require.NoError(t, writeLabelsJSON(&out, labeledTests(parsed, "Test", all), parsed.LabelDescriptions))
+	var res struct {
+		Labels       map[string][]string
+		Descriptions map[string]string
+	}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &res))
+	assert.Equal(t, map[string][]string{
+		"integration": {"TestinsertTest", "TestqueryTest"},
+		"slow":        {"TestqueryTest"},
+		"unit":        {"Testgreeting", "TestparseTest"},
+	}, res.Labels)
+	assert.Equal(t, map[string]string{"slow": "Long running tests"}, res.Descriptions)
+
+	expr, err := parseLabelExpr("integration+!slow, unit+slow")
+	require.NoError(t, err)
+	out.Reset()
+	require.NoError(t, writeLabelsTSV(&out, labeledTests(parsed, "", expr), parsed.LabelDescriptions))
+	assert.Equal(t, "insertTest\tintegration\t\n", out.String())
+
+	_, err = parseLabelExpr("integration,+!")
+	assert.Error(t, err)
+}
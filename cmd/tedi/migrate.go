@@ -0,0 +1,460 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jstroem/tedi/annotations"
+)
+
+var (
+	migrateCmd    = flag.NewFlagSet("migrate", flag.ExitOnError)
+	migrateFile   = migrateCmd.String("file", "tedi_test.go", "hand-written file registering the tests with t.Test, t.Fixture and the like")
+	migrateDryRun = migrateCmd.Bool("dry-run", false, "print the annotations which would be added without changing any file")
+)
+
+func migrateCommand() {
+	dir, err := os.Getwd()
+	if err != nil {
+		die(err)
+	}
+
+	edits, warnings, err := migrate(dir, *migrateFile)
+	if err != nil {
+		die(err)
+	}
+	for _, warning := range warnings {
+		log.Println(warning)
+	}
+	for _, edit := range edits {
+		fmt.Println(edit)
+	}
+
+	if *migrateDryRun || len(edits) == 0 {
+		return
+	}
+	if err := applyMigrateEdits(edits); err != nil {
+		die(err)
+	}
+	log.Printf("added annotations to %d function%s; remove the registrations from %s and run tedi generate", len(edits), plural(len(edits), "", "s"), *migrateFile)
+}
+
+// migrateEdit adds annotations to the doc comment of a function.
+type migrateEdit struct {
+	File string
+	Line int
+	// Offset is the start of the line declaring the function.
+	Offset      int
+	Func        string
+	Annotations []string
+}
+
+func (e *migrateEdit) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", e.File, e.Line, e.Func, strings.Join(e.Annotations, " "))
+}
+
+// migrate returns the annotations to add to the functions of the package in
+// dir, which are registered by the calls in the hand-written file. Calls which
+// cannot be expressed by annotations are returned as warnings.
+func migrate(dir, file string) ([]*migrateEdit, []string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return strings.HasSuffix(fi.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := &migration{fset: fset, funcs: map[string]*ast.FuncDecl{}, tests: map[string]string{}, edits: map[string]*migrateEdit{}}
+	var registrations *ast.File
+	for _, pkg := range pkgs {
+		for fileName, f := range pkg.Files {
+			if filepath.Base(fileName) == filepath.Base(file) {
+				registrations = f
+			}
+			for _, decl := range f.Decls {
+				if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil {
+					m.funcs[fn.Name.Name] = fn
+				}
+			}
+		}
+	}
+	if registrations == nil {
+		return nil, nil, fmt.Errorf("%s not found in %s", file, dir)
+	}
+
+	// Tests are migrated first, as the calls configuring them refer to their names.
+	var calls []*ast.CallExpr
+	modules := map[*ast.CallExpr]string{}
+	var inspect func(node ast.Node, module string)
+	inspect = func(node ast.Node, module string) {
+		ast.Inspect(node, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			if migrateMethod(call) == "Module" && len(call.Args) == 2 {
+				if name, ok := stringValue(call.Args[0]); ok {
+					inspect(call.Args[1], name)
+					return false
+				}
+			}
+			calls = append(calls, call)
+			modules[call] = module
+			return true
+		})
+	}
+	inspect(registrations, "")
+	sort.SliceStable(calls, func(i, j int) bool {
+		return migrateMethod(calls[i]) == "Test" && migrateMethod(calls[j]) != "Test"
+	})
+
+	for _, call := range calls {
+		m.migrateCall(call, modules[call])
+	}
+
+	var res []*migrateEdit
+	for _, edit := range m.edits {
+		res = append(res, edit)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].File != res[j].File {
+			return res[i].File < res[j].File
+		}
+		return res[i].Offset < res[j].Offset
+	})
+	return res, m.warnings, nil
+}
+
+// migration holds the state of migrating the calls of a file.
+type migration struct {
+	fset  *token.FileSet
+	funcs map[string]*ast.FuncDecl
+	// Test name => function of the test.
+	tests    map[string]string
+	edits    map[string]*migrateEdit
+	warnings []string
+}
+
+// migrateMethod returns the name of the method called, like Test for t.Test(...).
+func migrateMethod(call *ast.CallExpr) string {
+	if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
+		return sel.Sel.Name
+	}
+	return ""
+}
+
+func (m *migration) warn(node ast.Node, format string, args ...interface{}) {
+	pos := m.fset.Position(node.Pos())
+	m.warnings = append(m.warnings, fmt.Sprintf("%s:%d: %s", pos.Filename, pos.Line, fmt.Sprintf(format, args...)))
+}
+
+// migrateCall adds the annotations of a single registration call.
+func (m *migration) migrateCall(call *ast.CallExpr, module string) {
+	annotation := map[string]string{
+		"Test":        annotations.TestAnnotation,
+		"Fixture":     annotations.FixtureAnnotation,
+		"OnceFixture": annotations.OnceFixtureAnnotation,
+		"BeforeTest":  annotations.BeforeTestAnnotation,
+		"AfterTest":   annotations.AfterTestAnnotation,
+		"BeforeAll":   annotations.BeforeAllAnnotation,
+		"AfterAll":    annotations.AfterAllAnnotation,
+	}
+
+	switch method := migrateMethod(call); method {
+	case "Test":
+		if len(call.Args) < 2 {
+			m.warn(call, "cannot migrate %s", types.ExprString(call))
+			return
+		}
+		name, nameOK := stringValue(call.Args[0])
+		fn, ok := call.Args[1].(*ast.Ident)
+		if !nameOK || !ok {
+			m.warn(call, "cannot migrate %s; the test must be a declared function", types.ExprString(call))
+			return
+		}
+		if name != fn.Name {
+			m.warn(call, "test '%s' is registered with the name of its function '%s'", name, fn.Name)
+		}
+
+		var labels []string
+		for _, arg := range call.Args[2:] {
+			label, ok := stringValue(arg)
+			if !ok {
+				m.warn(call, "cannot migrate label %s of test '%s'", types.ExprString(arg), name)
+				continue
+			}
+			labels = append(labels, label)
+		}
+		if m.annotate(call, fn.Name, annotations.TestAnnotation, labels) {
+			m.tests[name] = fn.Name
+		}
+
+	case "Fixture", "OnceFixture", "BeforeTest", "AfterTest", "BeforeAll", "AfterAll":
+		if len(call.Args) < 1 {
+			m.warn(call, "cannot migrate %s", types.ExprString(call))
+			return
+		}
+
+		fn, params, ok := m.migrateFunc(call.Args[0])
+		if !ok {
+			m.warn(call, "cannot migrate %s; the %s must be a declared function", types.ExprString(call), strings.ToLower(method[:1])+method[1:])
+			return
+		}
+		for _, arg := range call.Args[1:] {
+			option, ok := m.migrateOption(arg)
+			if !ok {
+				m.warn(call, "cannot migrate option %s of '%s'", types.ExprString(arg), fn)
+				continue
+			}
+			params = append(params, option...)
+		}
+		if m.annotate(call, fn, annotation[method], params) && module != "" {
+			m.annotate(call, fn, annotations.ModuleAnnotation, []string{module})
+		}
+
+	case "Retry", "ExpectFailure", "Capture", "Timeout", "Env":
+		if len(call.Args) < 1 {
+			m.warn(call, "cannot migrate %s", types.ExprString(call))
+			return
+		}
+		name, _ := stringValue(call.Args[0])
+		fn, ok := m.tests[name]
+		if !ok {
+			m.warn(call, "cannot migrate %s; the test is not migrated", types.ExprString(call))
+			return
+		}
+
+		switch {
+		case method == "ExpectFailure":
+			m.annotate(call, fn, annotations.XFailAnnotation, nil)
+		case method == "Capture":
+			m.annotate(call, fn, annotations.CaptureAnnotation, nil)
+		case method == "Retry" && len(call.Args) == 2:
+			if retries, ok := intValue(call.Args[1]); ok {
+				m.annotate(call, fn, annotations.RetryAnnotation, []string{strconv.Itoa(retries)})
+				return
+			}
+			m.warn(call, "cannot migrate %s", types.ExprString(call))
+		case method == "Timeout" && len(call.Args) == 2:
+			if d, ok := durationValue(call.Args[1]); ok {
+				m.annotate(call, fn, annotations.TimeoutAnnotation, []string{d.String()})
+				return
+			}
+			m.warn(call, "cannot migrate %s", types.ExprString(call))
+		case method == "Env" && len(call.Args) == 3:
+			key, keyOk := stringValue(call.Args[1])
+			value, valueOk := stringValue(call.Args[2])
+			if keyOk && valueOk {
+				m.annotate(call, fn, annotations.EnvAnnotation, []string{key + "=" + value})
+				return
+			}
+			m.warn(call, "cannot migrate %s", types.ExprString(call))
+		default:
+			m.warn(call, "cannot migrate %s", types.ExprString(call))
+		}
+
+	case "TestLabel", "Run", "Example", "LabelParallelism":
+		if method != "Run" {
+			m.warn(call, "cannot migrate %s; add the corresponding annotation by hand", types.ExprString(call))
+		}
+	}
+}
+
+// migrateFunc returns the name of the function registered by expr, together
+// with the parameters implied by wrapping it, like tedi.Locked(fn).
+func (m *migration) migrateFunc(expr ast.Expr) (string, []string, bool) {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return expr.Name, nil, true
+	case *ast.CallExpr:
+		if migrateMethod(expr) == "Locked" && len(expr.Args) == 1 {
+			if fn, ok := expr.Args[0].(*ast.Ident); ok {
+				return fn.Name, []string{"locked"}, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// migrateOption returns the annotation parameters of a fixture or hook option.
+func (m *migration) migrateOption(expr ast.Expr) ([]string, bool) {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return nil, false
+	}
+
+	var res []string
+	switch migrateMethod(call) {
+	case "Group":
+		if len(call.Args) == 1 {
+			if group, ok := stringValue(call.Args[0]); ok {
+				return []string{"group=" + group}, true
+			}
+		}
+	case "Order":
+		if len(call.Args) == 1 {
+			if order, ok := intValue(call.Args[0]); ok {
+				return []string{"order=" + strconv.Itoa(order)}, true
+			}
+		}
+	case "As":
+		for _, arg := range call.Args {
+			n, ok := arg.(*ast.CallExpr)
+			if !ok || types.ExprString(n.Fun) != "new" || len(n.Args) != 1 {
+				return nil, false
+			}
+			res = append(res, "as="+types.ExprString(n.Args[0]))
+		}
+		return res, true
+	case "Priority":
+		if len(call.Args) == 1 {
+			if priority, ok := intValue(call.Args[0]); ok {
+				return []string{"priority=" + strconv.Itoa(priority)}, true
+			}
+		}
+	case "PerLabel":
+		return []string{"perLabel"}, true
+	case "TestScope":
+		return []string{"scope=test"}, true
+	case "Eager":
+		return []string{"eager"}, true
+	case "Labels":
+		for _, arg := range call.Args {
+			label, ok := stringValue(arg)
+			if !ok {
+				return nil, false
+			}
+			res = append(res, label)
+		}
+		return res, true
+	}
+	return nil, false
+}
+
+// annotate adds the annotation to the declaration of fn, unless it has the
+// annotation already. It returns false if fn is not declared in the package.
+func (m *migration) annotate(call *ast.CallExpr, fn, annotation string, params []string) bool {
+	decl, ok := m.funcs[fn]
+	if !ok {
+		m.warn(call, "function '%s' is not declared in a test file of the package", fn)
+		return false
+	}
+
+	if regexp.MustCompile(`(^|\n)\s*` + annotation + `(\(|\s|$)`).MatchString(decl.Doc.Text()) {
+		return true
+	}
+
+	pos := m.fset.Position(decl.Pos())
+	edit, ok := m.edits[fn]
+	if !ok {
+		edit = &migrateEdit{File: pos.Filename, Line: pos.Line, Offset: pos.Offset - (pos.Column - 1), Func: fn}
+		m.edits[fn] = edit
+	}
+	if len(params) > 0 {
+		annotation = fmt.Sprintf("%s(%s)", annotation, strings.Join(params, ", "))
+	}
+	edit.Annotations = append(edit.Annotations, annotation)
+	return true
+}
+
+// applyMigrateEdits writes the annotations of the edits to the source files.
+func applyMigrateEdits(edits []*migrateEdit) error {
+	byFile := map[string][]*migrateEdit{}
+	for _, edit := range edits {
+		byFile[edit.File] = append(byFile[edit.File], edit)
+	}
+
+	for file, edits := range byFile {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		// Insert from the end of the file, so the offsets stay valid.
+		sort.Slice(edits, func(i, j int) bool { return edits[i].Offset > edits[j].Offset })
+		for _, edit := range edits {
+			var lines strings.Builder
+			for _, annotation := range edit.Annotations {
+				fmt.Fprintf(&lines, "// %s\n", annotation)
+			}
+			src = append(src[:edit.Offset], append([]byte(lines.String()), src[edit.Offset:]...)...)
+		}
+
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file, src, fi.Mode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stringValue(expr ast.Expr) (string, bool) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	res, err := strconv.Unquote(lit.Value)
+	return res, err == nil
+}
+
+func intValue(expr ast.Expr) (int, bool) {
+	if unary, ok := expr.(*ast.UnaryExpr); ok && unary.Op == token.SUB {
+		res, ok := intValue(unary.X)
+		return -res, ok
+	}
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.INT {
+		return 0, false
+	}
+	res, err := strconv.Atoi(lit.Value)
+	return res, err == nil
+}
+
+// durationValue evaluates durations written like 30 * time.Second.
+func durationValue(expr ast.Expr) (time.Duration, bool) {
+	switch expr := expr.(type) {
+	case *ast.ParenExpr:
+		return durationValue(expr.X)
+	case *ast.BasicLit:
+		n, ok := intValue(expr)
+		return time.Duration(n), ok
+	case *ast.SelectorExpr:
+		units := map[string]time.Duration{
+			"Nanosecond":  time.Nanosecond,
+			"Microsecond": time.Microsecond,
+			"Millisecond": time.Millisecond,
+			"Second":      time.Second,
+			"Minute":      time.Minute,
+			"Hour":        time.Hour,
+		}
+		if pkg, ok := expr.X.(*ast.Ident); ok && pkg.Name == "time" {
+			d, ok := units[expr.Sel.Name]
+			return d, ok
+		}
+	case *ast.BinaryExpr:
+		if expr.Op != token.MUL {
+			return 0, false
+		}
+		x, xOK := durationValue(expr.X)
+		y, yOK := durationValue(expr.Y)
+		return x * y, xOK && yOK
+	}
+	return 0, false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/jstroem/tedi/annotations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_migrate(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "foo_test.go")
+	require.NoError(t, ioutil.WriteFile(source, []byte(`package foo
+
+import "io"
+
+// newBuffer creates a buffer.
+func newBuffer() *bytes.Buffer { return nil }
+
+func newDB() *DB { return nil }
+
+func startServer() {}
+
+// @test
+func queryTest() {}
+
+func slowTest() {}
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "tedi_test.go"), []byte(`package foo
+
+func TestMain(m *testing.M) {
+	t := tedi.New(m)
+	t.Fixture(newBuffer, tedi.As(new(io.Writer)), tedi.Priority(2))
+	t.Module("db", func(t *tedi.Tedi) {
+		t.OnceFixture(tedi.Locked(newDB))
+	})
+	t.BeforeTest(startServer, tedi.Order(-1), tedi.Labels("integration"))
+	t.Timeout("slowTest", 2*time.Minute)
+	t.Test("slowTest", slowTest, "integration", "regression")
+	t.Test("queryTest", queryTest)
+	t.Retry("slowTest", 2)
+	t.Fixture(func() int { return 1 })
+	t.Env("slowTest", "DB_HOST", "localhost")
+	os.Exit(t.Run())
+}
+`), 0644))
+
+	edits, warnings, err := migrate(dir, "tedi_test.go")
+	require.NoError(t, err)
+	if assert.Len(t, warnings, 1) {
+		assert.Contains(t, warnings[0], "tedi_test.go:14: cannot migrate t.Fixture((func() int literal)); the fixture must be a declared function")
+	}
+	if assert.Len(t, edits, 4) {
+		assert.Equal(t, "newBuffer", edits[0].Func)
+		assert.Equal(t, 6, edits[0].Line)
+		assert.Equal(t, []string{"@fixture(as=io.Writer, priority=2)"}, edits[0].Annotations)
+		assert.Equal(t, []string{"@onceFixture(locked)", "@module(db)"}, edits[1].Annotations)
+		assert.Equal(t, []string{"@beforeTest(order=-1, integration)"}, edits[2].Annotations)
+		assert.Equal(t, []string{"@test(integration, regression)", "@timeout(2m0s)", "@retry(2)", "@env(DB_HOST=localhost)"}, edits[3].Annotations)
+	}
+
+	require.NoError(t, applyMigrateEdits(edits))
+	src, err := ioutil.ReadFile(source)
+	require.NoError(t, err)
+	assert.Contains(t, string(src), "// newBuffer creates a buffer.\n// @fixture(as=io.Writer, priority=2)\nfunc newBuffer()")
+
+	parsed, err := annotations.Parse(dir, "foo_test.go", false)
+	require.NoError(t, err)
+	assert.Len(t, parsed.Fixtures, 1)
+	assert.Len(t, parsed.Modules["db"].OnceFixtures, 1)
+	assert.Len(t, parsed.BeforeTests, 1)
+	if assert.Len(t, parsed.Tests, 2) {
+		assert.Equal(t, 2, parsed.Tests[1].Retries)
+		assert.Equal(t, []string{"DB_HOST=localhost"}, parsed.Tests[1].Env)
+	}
+
+	// Migrating again adds nothing, as the functions are annotated.
+	edits, _, err = migrate(dir, "tedi_test.go")
+	require.NoError(t, err)
+	assert.Empty(t, edits)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/jstroem/tedi/annotations"
+)
+
+// defaultNameTemplate names a test by its function name prefixed by -prefix.
+const defaultNameTemplate = "{{.Prefix}}{{.Name}}"
+
+// testNameData is the data of the template computing the name of a test.
+type testNameData struct {
+	Prefix string
+	// Name is the name of the function, like Suite.Method for the methods of suites.
+	Name   string
+	Labels []string
+}
+
+var nameTemplateFuncs = template.FuncMap{
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"snake":      snakeCase,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+}
+
+// testNamer computes the names the tests and examples are registered with.
+type testNamer struct {
+	prefix string
+	tmpl   *template.Template
+}
+
+// newTestNamer returns a namer executing the template given by -nameTemplate;
+// the default template if it is empty. The template is executed once to
+// report errors before generating.
+func newTestNamer(prefix, nameTemplate string) (*testNamer, error) {
+	if nameTemplate == "" {
+		nameTemplate = defaultNameTemplate
+	}
+	tmpl, err := template.New("name").Funcs(nameTemplateFuncs).Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -nameTemplate: %w", err)
+	}
+
+	res := &testNamer{prefix: prefix, tmpl: tmpl}
+	if _, err := res.execute(testNameData{Prefix: prefix, Name: "Name", Labels: []string{annotations.DefaultTestLabel}}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// name returns the name of the test or example of fn with the labels.
+func (n *testNamer) name(fn *annotations.Function, labels []string) (string, error) {
+	res, err := n.execute(testNameData{Prefix: n.prefix, Name: fn.Name(), Labels: labels})
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return res, nil
+}
+
+func (n *testNamer) execute(data testNameData) (string, error) {
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("invalid -nameTemplate: %w", err)
+	}
+
+	// The name is written into the generated file as a string literal.
+	res := buf.String()
+	if strings.TrimSpace(res) == "" || strconv.Quote(res) != `"`+res+`"` {
+		return "", fmt.Errorf("-nameTemplate gives invalid test name %q", res)
+	}
+	return res, nil
+}
+
+// snakeCase converts a camel case name like FooBar to foo_bar.
+func snakeCase(s string) string {
+	var res strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// Acronyms like ID stay one word, but the last upper case letter
+			// of an acronym starts a word if a lower case letter follows.
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) && runes[i-1] != '_' && runes[i-1] != '.' {
+				res.WriteRune('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		res.WriteRune(r)
+	}
+	return res.String()
+}
@@ -2,21 +2,30 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"go/ast"
 	"go/build"
 	"go/format"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/jstroem/tedi/annotations"
 	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/imports"
 )
 
 const (
@@ -27,25 +36,65 @@ const (
 
 		%s
 
-		os.Exit(t.Run())
+		os.Exit(%s)
 	}`
-	fixtureCall     = `t.Fixture(%s)` + "\n"
-	onceFixtureCall = `t.OnceFixture(%s)` + "\n"
+	runCall         = `t.Run()`
+	runLabelsCall   = `t.RunLabels(%s)`
+	fixtureCall     = `t.Fixture(%s%s)` + "\n"
+	onceFixtureCall = `t.OnceFixture(%s%s)` + "\n"
+	typeFixtureCall = `t.Fixture(func() *%s { return &%s{} })` + "\n"
+	groupOption     = `tedi.Group(%q)`
+	asOption        = `tedi.As(%s)`
+	perLabelOption  = `tedi.PerLabel()`
+	testScopeOption = `tedi.TestScope()`
+	eagerOption     = `tedi.Eager()`
+	priorityOption  = `tedi.Priority(%d)`
+	lockedCall      = `tedi.Locked(%s)`
 	testCall        = `t.Test("%s", %s%s)` + "\n"
-	beforeTestCall  = `t.BeforeTest(%s)` + "\n"
-	afterTestCall   = `t.AfterTest(%s)` + "\n"
-	testLabelCall   = `t.TestLabel("%s")` + "\n"
+	exampleCall     = `t.Example(testing.InternalExample{Name: "%s", F: %s, Output: %q%s}%s)` + "\n"
+	beforeTestCall  = `t.BeforeTest(%s%s)` + "\n"
+	afterTestCall   = `t.AfterTest(%s%s)` + "\n"
+	orderOption     = `tedi.Order(%d)`
+	labelsOption    = `tedi.Labels(%s)`
+	beforeAllCall   = `t.BeforeAll(%s)` + "\n"
+	afterAllCall    = `t.AfterAll(%s)` + "\n"
+	testLabelCall   = `t.TestLabel(%q)` + "\n"
+	parallelismCall = `t.LabelParallelism(%q, %d)` + "\n"
+	timeoutCall     = `t.Timeout("%s", %s)` + "\n"
+	retryCall       = `t.Retry("%s", %d)` + "\n"
+	weightCall      = `t.Weight("%s", %d)` + "\n"
+	xfailCall       = `t.ExpectFailure("%s")` + "\n"
+	captureCall     = `t.Capture("%s")` + "\n"
+	envCall         = `t.Env("%s", %q, %q)` + "\n"
+	moduleStartCall = `t.Module(%q, func(t *tedi.Tedi) {` + "\n"
+	moduleEndCall   = `})` + "\n"
 )
 
 func init() {
+	generateCmd.Var(&generateEntries, "entry", "entrypoint to generate as `func:buildTag:label1,label2`; can be repeated and overrides -func and -buildTag")
+	testCmd.Var(&tediChanged, "changed", "only generate and test the packages with files changed since the git `ref`, like -changed=origin/main; HEAD if no ref is given")
+	generateCmd.Var(&generateInclude, "include", "also scan the files of the package matching the glob `pattern` for annotations, like helpers.go; can be repeated")
+	testCmd.Var(&tediInclude, "include", "also scan the files of the packages matching the glob `pattern` for annotations, like generate -include; can be repeated")
 }
 
 var (
 	generateCmd      = flag.NewFlagSet("generate", flag.ExitOnError)
 	generateFuncname = generateCmd.String("func", "TestMain", "name of the function to generate; default TestMain")
 	generatePrefix   = generateCmd.String("prefix", "", "prefix name of tests; default <none>")
+	generateNameTmpl = generateCmd.String("nameTemplate", "", "text/template `template` computing the name of a test from its .Prefix, .Name and .Labels, with the functions upper, lower, snake, trimPrefix and trimSuffix; default "+defaultNameTemplate)
 	generateOutput   = generateCmd.String("output", "tedi_test.go", "output file name; default srcdir/tedi_test.go")
 	generateBuildTag = generateCmd.String("buildTag", "", "build tag to set in the generated file")
+	generateOutDir   = generateCmd.String("output-dir", "", "write the generated files to a tree mirroring the module in `dir` together with an overlay.json for go test -overlay")
+	generateNoImp    = generateCmd.Bool("no-imports", false, "only gofmt the generated file instead of sorting and grouping its imports like goimports")
+	generateCheck    = generateCmd.Bool("check", false, "only print the diff of the generated files which are out of date and exit with 1 if any is, instead of writing them")
+	generateTags     = generateCmd.String("tags", "", "comma-separated `list` of build tags like the -tags of go test; if given, files whose build constraints are not satisfied are not scanned")
+	generateWarnUnm  = generateCmd.Bool("warn-unmatched", false, "warn about functions with a *testing.T or *tedi.T parameter which are skipped as they are neither annotated nor match a label")
+	generateNoWarnUs = generateCmd.Bool("no-warn-unsatisfiable", false, "do not warn about parameters of tests which no fixture provides, like when the fixtures are registered by hand")
+	generateVerbose  = generateCmd.Bool("v", false, "log for every function why it is registered as a test, fixture or hook, like the annotation or prefix it matched, or why it is skipped")
+	generateImport   = generateCmd.String("importPath", tediPackage, "import `path` of tedi in the generated file, like the path of a fork or vendored copy of tedi")
+	generateFormat   = generateCmd.String("format", formatGo, "`format` to generate: go writes the test file, json prints the parsed tests, fixtures and labels, or writes them to -output if given")
+	generateEntries  entrypointsFlag
+	generateInclude  includeFlag
 
 	testCmd = flag.NewFlagSet("test", flag.ExitOnError)
 
@@ -84,9 +133,25 @@ var (
 	testRace                 = testCmd.Bool("race", false, "enable the race detector when running tests")
 	testV                    = testCmd.Bool("v", false, "verbose: print additional output")
 
-	tediTestLabels = testCmd.String("labels", annotations.DefaultTestLabel, "Tedi test labels to run. Can be multiple with ',' as a seperator")
+	tediTestLabels = testCmd.String("labels", annotations.DefaultTestLabel, "Tedi test labels to run. Can be multiple with ',' or the -label-sep as a seperator")
+	tediModules    = testCmd.String("modules", "", "Tedi modules to enable. Can be multiple with ',' or the -label-sep as a seperator; default all modules")
+	tediLabelMatch = testCmd.String("label-match", "any", "Tedi runs the tests having any of the labels to run with 'any', or only the tests having all of them with 'all'")
+	tediFailFast   = testCmd.String("failfast-labels", "", "Tedi skips the tests having one of the labels once a test with the label failed. Can be multiple with ',' or the -label-sep as a seperator")
+	tediConfirm    = testCmd.Bool("confirm", false, "Tedi prints the selected tests and asks for confirmation before running them")
+	tediYes        = testCmd.Bool("yes", false, "Tedi runs the selected tests without asking for confirmation")
+	tediTrace      = testCmd.Bool("tedi.trace", false, "Tedi prints the missing and provided fixture types when a test cannot be invoked")
+	tediSeed       = testCmd.Int64("tedi.seed", 0, "Tedi seeds the *rand.Rand of every test with the seed; default a random seed")
+	tediShuffle    = testCmd.String("tedi.shuffle", "off", "Tedi runs the tests in a random order with 'on', or in the order given by the seed; 'off' runs them in the order they are registered")
+	tediLabelSep   = testCmd.String("label-sep", ",", "Tedi separates the labels of -labels, -failfast-labels and -modules by the `character`, besides whitespace")
+	tediGrace      = testCmd.Duration("tedi.grace", 5*time.Second, "Tedi ends the deadline of the injected contexts the `duration` before the -timeout of go test, at most half of it, leaving time for the cleanups")
+	tediBuildTag   = testCmd.String("buildTag", "tedi", "build tag of the generated file, which is added to -tags of go test; empty to generate without build tag")
+	tediOutputDir  = testCmd.String("output-dir", "", "write the generated files to a tree mirroring the module in `dir` and run go test with the overlay")
+	tediKeep       = testCmd.Bool("keep", true, "keep the generated files after running the tests; -keep=false removes them")
+	tediOnly       = testCmd.String("only", "", "only register and run the test of the function `name`, like queryTest or suite.queryTest")
+	tediChanged    changedFlag
+	tediInclude    includeFlag
 
-	testTags = testCmd.String("tags", "", "tags")
+	testTags = testCmd.String("tags", "", "comma-separated `list` of build tags passed to go test; if given, files whose build constraints are not satisfied are not scanned")
 )
 
 // Usage prints how the tedi command should be executed.
@@ -96,8 +161,13 @@ func Usage() {
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "Commands are:\n")
 	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "\tinit\t\tto create an annotated test file and generate its tedi file\n")
 	fmt.Fprintf(os.Stderr, "\tgenerate\tfor generation of tedi files\n")
 	fmt.Fprintf(os.Stderr, "\ttest\t\tto run both generation and test in one command\n")
+	fmt.Fprintf(os.Stderr, "\twatch\t\tto regenerate tedi files when test files change\n")
+	fmt.Fprintf(os.Stderr, "\tdoctor\t\tto diagnose common misconfigurations\n")
+	fmt.Fprintf(os.Stderr, "\tmigrate\t\tto annotate the functions registered by a hand-written TestMain\n")
+	fmt.Fprintf(os.Stderr, "\tlist-labels\tto list the tests together with their labels\n")
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "For more information, see:\n")
 	fmt.Fprintf(os.Stderr, "\thttp://github.com/jstroem/tedi\n")
@@ -114,6 +184,13 @@ func main() {
 	}
 
 	switch os.Args[1] {
+	case "init":
+		if err := initCmd.Parse(os.Args[2:]); err != nil {
+			die(err)
+			os.Exit(2)
+		}
+		initCommand()
+
 	case "generate":
 		if err := generateCmd.Parse(os.Args[2:]); err != nil {
 			die(err)
@@ -122,11 +199,40 @@ func main() {
 		generateCommand()
 
 	case "test":
+		os.Args = append(os.Args[:2], joinChangedRef(os.Args[2:])...)
 		if err := testCmd.Parse(os.Args[2:]); err != nil {
 			die(err)
 			os.Exit(2)
 		}
 		testCommand()
+
+	case "watch":
+		if err := watchCmd.Parse(os.Args[2:]); err != nil {
+			die(err)
+			os.Exit(2)
+		}
+		watchCommand()
+
+	case "doctor":
+		if err := doctorCmd.Parse(os.Args[2:]); err != nil {
+			die(err)
+			os.Exit(2)
+		}
+		doctorCommand()
+
+	case "migrate":
+		if err := migrateCmd.Parse(os.Args[2:]); err != nil {
+			die(err)
+			os.Exit(2)
+		}
+		migrateCommand()
+
+	case "list-labels":
+		if err := listLabelsCmd.Parse(os.Args[2:]); err != nil {
+			die(err)
+			os.Exit(2)
+		}
+		listLabelsCommand()
 	default:
 		fmt.Printf("%q is not valid command.\n", os.Args[1])
 		os.Exit(2)
@@ -139,49 +245,633 @@ func generateCommand() {
 		die(err)
 	}
 
-	if err = writeTediFile(dir, writeTediFileOptions{
-		Funcname:   *generateFuncname,
-		Prefix:     *generatePrefix,
-		BuildTag:   *generateBuildTag,
-		OutputFile: *generateOutput,
-	}); err != nil {
-		die(err)
+	entrypoints := []entrypoint(generateEntries)
+	if len(entrypoints) == 0 {
+		entrypoints = []entrypoint{{Funcname: *generateFuncname, BuildTag: *generateBuildTag}}
+	}
+
+	o := writeTediFileOptions{
+		Entrypoints:  entrypoints,
+		Prefix:       *generatePrefix,
+		NameTemplate: *generateNameTmpl,
+		OutputFile:   *generateOutput,
+		OutputDir:    *generateOutDir,
+		NoImports:    *generateNoImp,
+		ImportPath:   *generateImport,
+		Verbose:      *generateVerbose,
+		ParseOptions: annotations.Options{
+			Include:             generateInclude,
+			Tags:                tagsFlag(generateCmd, *generateTags),
+			WarnUnmatched:       *generateWarnUnm,
+			NoWarnUnsatisfiable: *generateNoWarnUs,
+		},
+		SetFlags: setFlags(generateCmd),
+	}
+
+	switch *generateFormat {
+	case formatGo:
+		if *generateCheck {
+			o.Check = os.Stdout
+		}
+		_, written, err := writeTediFile(dir, o)
+		if err != nil {
+			die(err)
+		}
+		if *generateCheck && len(written) > 0 {
+			os.Exit(1)
+		}
+	case formatJSON:
+		if err := generateJSON(dir, o); err != nil {
+			die(err)
+		}
+	default:
+		die(fmt.Errorf("unknown format %q; use %s or %s", *generateFormat, formatGo, formatJSON))
 	}
 }
 
 type writeTediFileOptions struct {
-	Funcname   string
-	Prefix     string
-	BuildTag   string
-	OutputFile string
+	Entrypoints []entrypoint
+	Prefix      string
+	// NameTemplate computes the names of the tests; the prefixed function name if empty.
+	NameTemplate string
+	OutputFile   string
+	// OutputDir is the root of the tree mirroring the module the files are written to; the package directory if empty.
+	OutputDir  string
 	ForceWrite bool
+	// NoImports only formats the generated files with gofmt instead of goimports.
+	NoImports bool
+	// ImportPath is the import path of tedi in the generated files; tediPackage if empty.
+	ImportPath string
+	// Verbose logs the decisions of the parser classifying the functions.
+	Verbose bool
+	// Only is the name of the function of the only test to register; all tests if empty.
+	Only string
+	// ParseOptions changes how the package is parsed, like the additional files to scan for annotations.
+	ParseOptions annotations.Options
+	// SetFlags are the flags given on the command line, which take precedence over the configuration file.
+	SetFlags map[string]bool
+	// Check, if not nil, gets the diffs of the files which are out of date instead of writing them.
+	Check io.Writer
+	// Previous, if not nil, gets the content of the written files which existed before, keyed by their path.
+	Previous map[string][]byte
+}
+
+// entrypoint is a generated function creating its own tedi.New(m).
+type entrypoint struct {
+	Funcname string
+	BuildTag string
+	// Labels limits the registered tests to tests having one of the labels; all tests if empty.
+	Labels []string
+}
+
+// matches returns true if the entrypoint registers tests with the labels.
+func (e entrypoint) matches(labels []string) bool {
+	if len(e.Labels) == 0 {
+		return true
+	}
+	for _, label := range labels {
+		for _, entryLabel := range e.Labels {
+			if label == entryLabel {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// includeFlag collects the glob patterns of files to include.
+type includeFlag []string
+
+func (i *includeFlag) String() string {
+	return strings.Join(*i, " ")
+}
+
+func (i *includeFlag) Set(value string) error {
+	if _, err := filepath.Match(value, ""); err != nil {
+		return fmt.Errorf("invalid include pattern %q: %w", value, err)
+	}
+	*i = append(*i, value)
+	return nil
+}
+
+// entrypointsFlag parses entrypoints from `func:buildTag:label1,label2`.
+type entrypointsFlag []entrypoint
+
+func (e *entrypointsFlag) String() string {
+	var res []string
+	for _, entry := range *e {
+		res = append(res, fmt.Sprint(entry.Funcname, ":", entry.BuildTag, ":", strings.Join(entry.Labels, ",")))
+	}
+	return strings.Join(res, " ")
+}
+
+func (e *entrypointsFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 3)
+	if parts[0] == "" {
+		return fmt.Errorf("entrypoint %q must have a function name", value)
+	}
+
+	entry := entrypoint{Funcname: parts[0]}
+	if len(parts) > 1 {
+		entry.BuildTag = parts[1]
+	}
+	if len(parts) > 2 && parts[2] != "" {
+		entry.Labels = strings.Split(parts[2], ",")
+	}
+	*e = append(*e, entry)
+	return nil
 }
 
-func writeTediFile(dir string, o writeTediFileOptions) error {
-	res, err := annotations.Parse(dir, "_test.go", true)
+// entrypointFile is a generated file holding the entrypoint of a build tag.
+type entrypointFile struct {
+	Name        string
+	BuildTag    string
+	Entrypoints []entrypoint
+}
+
+var (
+	buildTagRegexp = regexp.MustCompile(`^\w+$`)
+	// testFuncRegexp matches the names go test takes for test functions.
+	testFuncRegexp = regexp.MustCompile(`^Test($|\P{Ll})`)
+)
+
+// importPathElemRegexp matches an element of an import path, like the ones
+// allowed in module paths.
+var importPathElemRegexp = regexp.MustCompile(`^[A-Za-z0-9_~+-][A-Za-z0-9._~+-]*$`)
+
+// majorVersionRegexp matches the major version suffix of module paths, like v2.
+var majorVersionRegexp = regexp.MustCompile(`^v[0-9]+$`)
+
+// checkImportPath returns an error if path is not a plausible import path of
+// tedi, like example.com/fork/tedi.
+func checkImportPath(path string) error {
+	for _, elem := range strings.Split(path, "/") {
+		if !importPathElemRegexp.MatchString(elem) || strings.HasSuffix(elem, ".") {
+			return fmt.Errorf("invalid -importPath %q", path)
+		}
+	}
+	return nil
+}
+
+// importPathName returns the default name of the package imported from path,
+// which is its last element without the major version suffix of modules.
+func importPathName(path string) string {
+	elems := strings.Split(path, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && majorVersionRegexp.MatchString(name) {
+		name = elems[len(elems)-2]
+	}
+	return name
+}
+
+// entrypointFiles groups the entrypoints into the files they are generated
+// into. Build constraints apply to whole files, so every build tag gets its own
+// file and the file of the entrypoint without a build tag is only built when
+// none of the other build tags are set. This way only one TestMain exists per
+// build configuration, so at most one entrypoint can have each build tag and
+// at most one can be without build tag, and an entrypoint can only be named
+// like a test if it is TestMain.
+func entrypointFiles(outputFile string, entrypoints []entrypoint) ([]*entrypointFile, error) {
+	for _, e := range entrypoints {
+		if e.Funcname != "TestMain" && testFuncRegexp.MatchString(e.Funcname) {
+			return nil, fmt.Errorf("entrypoint %s must be named TestMain or not like a test, as go test rejects %s(m *testing.M)", e.Funcname, e.Funcname)
+		}
+	}
+	if len(entrypoints) == 1 {
+		return []*entrypointFile{{Name: outputFile, BuildTag: entrypoints[0].BuildTag, Entrypoints: entrypoints}}, nil
+	}
+
+	var res []*entrypointFile
+	var defaultFile *entrypointFile
+	files := map[string]*entrypointFile{}
+	for _, e := range entrypoints {
+		if e.BuildTag == "" {
+			if defaultFile != nil {
+				return nil, fmt.Errorf("at most one entrypoint can be without build tag, got %s and %s", defaultFile.Entrypoints[0].Funcname, e.Funcname)
+			}
+			defaultFile = &entrypointFile{Name: outputFile, Entrypoints: []entrypoint{e}}
+			res = append(res, defaultFile)
+			continue
+		}
+
+		if !buildTagRegexp.MatchString(e.BuildTag) {
+			return nil, fmt.Errorf("build tag %q of entrypoint %s must be a single tag when generating multiple entrypoints", e.BuildTag, e.Funcname)
+		}
+
+		if other, ok := files[e.BuildTag]; ok {
+			return nil, fmt.Errorf("at most one entrypoint can have build tag %s, got %s and %s", e.BuildTag, other.Entrypoints[0].Funcname, e.Funcname)
+		}
+		file := &entrypointFile{
+			Name:        strings.TrimSuffix(outputFile, "_test.go") + "_" + e.BuildTag + "_test.go",
+			BuildTag:    e.BuildTag,
+			Entrypoints: []entrypoint{e},
+		}
+		files[e.BuildTag] = file
+		res = append(res, file)
+	}
+
+	if defaultFile != nil {
+		var tags []string
+		for _, file := range res {
+			if file != defaultFile {
+				tags = append(tags, "!"+file.BuildTag)
+			}
+		}
+		defaultFile.BuildTag = strings.Join(tags, ",")
+	}
+	return res, nil
+}
+
+// writeTediFile generates the tedi files of dir, configured by its
+// configuration file, and returns the parsed package and the files written;
+// with o.Check the files out of date.
+func writeTediFile(dir string, o writeTediFileOptions) (*annotations.ParseResult, []string, error) {
+	o, err := configure(dir, o)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	if res == nil || res.Package == nil {
-		return nil
+	res, err := annotations.ParseWithOptions(dir, "_test.go", true, o.ParseOptions)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	bytes, write := generateFile(res, o.Funcname, o.Prefix, o.BuildTag)
-	if !write && !o.ForceWrite {
-		return nil
+	if res == nil || res.Package == nil {
+		return res, nil, nil
 	}
 
 	for _, warning := range res.Warnings {
 		log.Println(warning)
 	}
+	if o.Verbose {
+		for _, decision := range res.Decisions {
+			log.Println(decision)
+		}
+	}
+
+	if o.Only != "" {
+		res = onlyTest(res, o.Only)
+	}
+
+	files, err := renderTediFiles(res, o)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	outputDir, overlayFile := dir, ""
+	if o.OutputDir != "" {
+		if outputDir, overlayFile, err = mirrorDir(dir, o.OutputDir); err != nil {
+			return nil, nil, err
+		}
+		if o.Check == nil {
+			if err := os.MkdirAll(outputDir, 0755); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	var written []string
+	replace := map[string]string{}
+	for _, file := range files {
+		if !file.Write && !o.ForceWrite {
+			continue
+		}
+
+		outputFile := filepath.Join(outputDir, file.Name)
+		if o.Check != nil {
+			current, err := ioutil.ReadFile(outputFile)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, written, err
+			}
+			if diff := unifiedDiff(file.Name, current, file.Src); diff != "" {
+				fmt.Fprint(o.Check, diff)
+				written = append(written, outputFile)
+			}
+			continue
+		}
+		if o.Previous != nil {
+			if _, ok := o.Previous[outputFile]; !ok {
+				current, err := ioutil.ReadFile(outputFile)
+				if err == nil {
+					o.Previous[outputFile] = current
+				} else if !os.IsNotExist(err) {
+					return nil, written, err
+				}
+			}
+		}
+		if err := ioutil.WriteFile(outputFile, file.Src, 0644); err != nil {
+			return nil, written, err
+		}
+		replace[filepath.Join(dir, file.Name)] = outputFile
+		written = append(written, outputFile)
+	}
+
+	if overlayFile != "" && o.Check == nil {
+		if err := updateOverlay(overlayFile, replace); err != nil {
+			return nil, written, err
+		}
+	}
+	return res, written, nil
+}
+
+// noTestsMessage explains why the parsed package registers no tests, telling
+// a package without annotations from one whose annotations declare no tests;
+// empty if the package has tests or examples, including the ones go test runs
+// by itself.
+func noTestsMessage(parsed *annotations.ParseResult) string {
+	switch {
+	case parsed == nil || parsed.Package == nil:
+		return "no functions in _test.go files; nothing to generate"
+	case len(parsed.Tests) > 0 || len(parsed.Examples) > 0 || hasGoTests(parsed.Package):
+		return ""
+	case len(parsed.Fixtures) > 0 || len(parsed.OnceFixtures) > 0 || len(parsed.Modules) > 0 || len(parsed.TypeFixtures) > 0 ||
+		len(parsed.BeforeTests) > 0 || len(parsed.AfterTests) > 0 || len(parsed.BeforeAll) > 0 || len(parsed.AfterAll) > 0:
+		return "no tests; the fixtures and hooks are not used by any test, annotate the tests with @test"
+	default:
+		return "no annotations found; did you forget @test?"
+	}
+}
+
+// hasGoTests returns true if the package has functions go test runs by
+// itself, like TestXxx.
+func hasGoTests(pkg *ast.Package) bool {
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || fn.Name.Name == "TestMain" {
+				continue
+			}
+			for _, prefix := range []string{"Test", "Benchmark", "Example", "Fuzz"} {
+				if isGoTestName(fn.Name.Name, prefix) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// onlyTest returns the parsed package with only the test of the function
+// named name, without the other tests and the examples. The fixtures and
+// hooks are kept; fixtures are only called for the tests depending on them.
+func onlyTest(parsed *annotations.ParseResult, name string) *annotations.ParseResult {
+	res := *parsed
+	res.Tests, res.Examples = nil, nil
+	for _, test := range parsed.Tests {
+		if test.Name() == name {
+			res.Tests = append(res.Tests, test)
+		}
+	}
+	return &res
+}
+
+// renderedFile is a generated file which is not written yet.
+type renderedFile struct {
+	Name string
+	Src  []byte
+	// Write is false if the file does not register anything.
+	Write bool
+}
+
+// renderTediFiles generates the formatted source of the tedi files of the parsed package.
+func renderTediFiles(res *annotations.ParseResult, o writeTediFileOptions) ([]*renderedFile, error) {
+	files, err := entrypointFiles(o.OutputFile, o.Entrypoints)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := testNames(res, o)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.ImportPath != "" {
+		if err := checkImportPath(o.ImportPath); err != nil {
+			return nil, err
+		}
+	}
+
+	var rendered []*renderedFile
+	for _, file := range files {
+		bytes, write := generateFile(res, file.Entrypoints, names, file.BuildTag, o.ImportPath)
+		if o.NoImports {
+			bytes, err = format.Source(bytes)
+		} else {
+			bytes, err = imports.Process(file.Name, bytes, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, &renderedFile{Name: file.Name, Src: bytes, Write: write})
+	}
+	return rendered, nil
+}
+
+// testNames returns the names of the tests and examples computed by the name
+// template, and an error if they are not unique, like colliding with a
+// function go test runs itself. Tests with the same name are reported by go
+// test as different runs of the same test, so they cannot be told apart in the
+// output or with -run.
+func testNames(parsed *annotations.ParseResult, o writeTediFileOptions) (map[*annotations.Function]string, error) {
+	namer, err := newTestNamer(o.Prefix, o.NameTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	entrypoints := map[string]bool{}
+	for _, e := range o.Entrypoints {
+		entrypoints[e.Funcname] = true
+	}
+
+	// Test name => function running it.
+	names := map[string]string{}
+	var fileNames []string
+	for fileName := range parsed.Package.Files {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+	for _, fileName := range fileNames {
+		for _, decl := range parsed.Package.Files[fileName].Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || fn.Name.Name == "TestMain" || entrypoints[fn.Name.Name] {
+				continue
+			}
+			if isGoTestName(fn.Name.Name, "Test") || isGoTestName(fn.Name.Name, "Example") {
+				names[fn.Name.Name] = fn.Name.Name
+			}
+		}
+	}
+
+	res := map[*annotations.Function]string{}
+	var collisions []string
+	add := func(fn *annotations.Function, labels []string) error {
+		name, err := namer.name(fn, labels)
+		if err != nil {
+			return err
+		}
+		res[fn] = name
+		if other, ok := names[name]; ok && other == fn.Name() {
+			collisions = append(collisions, fmt.Sprintf("test name '%s' is also run by go test", name))
+		} else if ok {
+			collisions = append(collisions, fmt.Sprintf("test name '%s' of '%s' collides with '%s'", name, fn.Name(), other))
+		} else {
+			names[name] = fn.Name()
+		}
+		return nil
+	}
+	for _, test := range parsed.Tests {
+		if err := add(test.Function, test.Labels); err != nil {
+			return nil, err
+		}
+	}
+	for _, example := range parsed.Examples {
+		if err := add(example.Function, example.Labels); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(collisions) > 0 {
+		return nil, fmt.Errorf("%s; use another -prefix or rename the functions", strings.Join(collisions, "; "))
+	}
+	return res, nil
+}
+
+// isGoTestName returns true if go test runs the function with the name by
+// itself, like TestXxx, using the same rules as go test.
+func isGoTestName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	return !unicode.IsLower(rune(name[len(prefix)]))
+}
+
+// overlayFileName is the name of the overlay file written to the root of the output dir.
+const overlayFileName = "overlay.json"
+
+// mirrorDir returns the directory in outputDir mirroring dir relative to the
+// root of its module, and the overlay file of outputDir. A relative outputDir
+// is relative to the module root.
+func mirrorDir(dir, outputDir string) (string, string, error) {
+	root, err := moduleRoot(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	if !filepath.IsAbs(outputDir) {
+		outputDir = filepath.Join(root, outputDir)
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(outputDir, rel), filepath.Join(outputDir, overlayFileName), nil
+}
+
+// moduleRoot returns the closest directory containing a go.mod file, starting from dir.
+func moduleRoot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			return d, nil
+		}
+		if filepath.Dir(d) == d {
+			return "", fmt.Errorf("no go.mod found for %s", dir)
+		}
+	}
+}
+
+// overlay is the format of the file given to the -overlay flag of the go command.
+type overlay struct {
+	Replace map[string]string
+}
+
+// updateOverlay adds the replaced files to the overlay file, keeping the files
+// replaced for other packages.
+func updateOverlay(overlayFile string, replace map[string]string) error {
+	o, err := readOverlay(overlayFile)
+	if err != nil {
+		return err
+	}
+
+	for from, to := range replace {
+		o.Replace[from] = to
+	}
+	return writeOverlay(overlayFile, o)
+}
+
+// readOverlay reads the overlay file; the empty overlay if it does not exist.
+func readOverlay(overlayFile string) (overlay, error) {
+	o := overlay{Replace: map[string]string{}}
+	bytes, err := ioutil.ReadFile(overlayFile)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return o, err
+	}
+	if err := json.Unmarshal(bytes, &o); err != nil {
+		return o, fmt.Errorf("failed to read overlay %s: %w", overlayFile, err)
+	}
+	if o.Replace == nil {
+		o.Replace = map[string]string{}
+	}
+	return o, nil
+}
 
-	if bytes, err = format.Source(bytes); err != nil {
+func writeOverlay(overlayFile string, o overlay) error {
+	bytes, err := json.MarshalIndent(o, "", "\t")
+	if err != nil {
 		return err
 	}
+	return ioutil.WriteFile(overlayFile, bytes, 0644)
+}
+
+// packagesOverlay returns the overlay file replacing the generated files of
+// all the package dirs, and true if it is a temporary file. Packages of
+// different modules have their own overlay file with a relative outputDir,
+// but go test takes a single overlay, so these are merged into a temporary file.
+func packagesOverlay(dirs []string, outputDir string) (string, bool, error) {
+	var files []string
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		_, overlayFile, err := mirrorDir(dir, outputDir)
+		if err != nil {
+			return "", false, err
+		}
+		if !seen[overlayFile] {
+			seen[overlayFile] = true
+			files = append(files, overlayFile)
+		}
+	}
+	if len(files) == 1 {
+		return files[0], false, nil
+	}
 
-	outputFile := filepath.Join(dir, o.OutputFile)
-	return ioutil.WriteFile(outputFile, bytes, 0644)
+	merged := overlay{Replace: map[string]string{}}
+	for _, file := range files {
+		o, err := readOverlay(file)
+		if err != nil {
+			return "", false, err
+		}
+		for from, to := range o.Replace {
+			merged.Replace[from] = to
+		}
+	}
+	tmp, err := ioutil.TempFile("", "tedi-overlay-*.json")
+	if err != nil {
+		return "", false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", false, err
+	}
+	return tmp.Name(), true, writeOverlay(tmp.Name(), merged)
 }
 
 func pathToPackageDirs(args []string) ([]string, error) {
@@ -209,49 +899,364 @@ func pathToPackageDirs(args []string) ([]string, error) {
 }
 
 func testCommand() {
-	paths, err := pathToPackageDirs(testCmd.Args())
+	previous := map[string][]byte{}
+	exitCode, generated, err := runTests(previous)
+	// The generated files are removed even if the tests could not be run.
+	if !*tediKeep {
+		if err := restoreFiles(generated, previous); err != nil {
+			log.Println(err)
+		}
+	}
 	if err != nil {
 		die(err)
 	}
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
 
+// restoreFiles writes back the previous content of the files which existed
+// before they were generated and removes the others, ignoring files which do
+// not exist anymore.
+func restoreFiles(files []string, previous map[string][]byte) error {
+	for _, file := range files {
+		if src, ok := previous[file]; ok {
+			if err := ioutil.WriteFile(file, src, 0644); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTests generates the tedi files of the packages and runs go test. It
+// returns the exit code of go test together with the files generated, and
+// adds the previous content of the generated files which existed to previous.
+func runTests(previous map[string][]byte) (int, []string, error) {
+	paths, err := pathToPackageDirs(testCmd.Args())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	os.Args = append(os.Args[:2], removeFlag(removeFlag(removeBoolFlag(removeBoolFlag(os.Args[2:], "-changed"), "-keep"), "-only"), "-include")...)
+	if tediChanged != "" {
+		if paths, err = changedPackageDirs(paths, string(tediChanged)); err != nil {
+			return 0, nil, err
+		}
+		if len(paths) == 0 {
+			fmt.Printf("tedi: no packages changed since %s\n", tediChanged)
+			return 0, nil, nil
+		}
+		os.Args = append(os.Args[:2], replacePackages(os.Args[2:], testCmd.Args(), paths)...)
+	}
+
+	var generated []string
+	labels := packageLabels{}
+	buildTags := map[string]bool{}
+	// onlyNames are the names the test given by -only is registered with, and
+	// onlyLabels its labels.
+	onlyNames, onlyLabels := map[string]bool{}, map[string]bool{}
 	for _, path := range paths {
-		if err := writeTediFile(path, writeTediFileOptions{
-			Funcname:   "TestMain",
-			Prefix:     "",
-			OutputFile: "tedi_test.go",
-			BuildTag:   "",
-			ForceWrite: true,
-		}); err != nil {
-			die(err)
+		o, err := configure(path, writeTediFileOptions{
+			Entrypoints: []entrypoint{{Funcname: "TestMain", BuildTag: *tediBuildTag}},
+			Prefix:      "",
+			OutputFile:  "tedi_test.go",
+			OutputDir:   *tediOutputDir,
+			ForceWrite:  true,
+			Only:        *tediOnly,
+			Previous:    previous,
+			ParseOptions: annotations.Options{
+				Include: tediInclude,
+				Tags:    tagsFlag(testCmd, *testTags),
+			},
+			SetFlags: setFlags(testCmd),
+		})
+		if err != nil {
+			return 0, generated, err
+		}
+		parsed, written, err := writeTediFile(path, o)
+		generated = append(generated, written...)
+		if err != nil {
+			return 0, generated, err
+		}
+		if msg := noTestsMessage(parsed); msg != "" {
+			log.Printf("%s: %s", path, msg)
+		}
+		if *tediOnly != "" && parsed != nil && len(parsed.Tests) > 0 {
+			names, err := testNames(parsed, o)
+			if err != nil {
+				return 0, generated, err
+			}
+			onlyNames[names[parsed.Tests[0].Function]] = true
+			for _, label := range parsed.Tests[0].Labels {
+				onlyLabels[label] = true
+			}
+		}
+		buildTags[o.Entrypoints[0].BuildTag] = true
+		if *testJSON {
+			if err := labels.add(path, parsed, o.Prefix); err != nil {
+				return 0, generated, err
+			}
 		}
 	}
 
-	idx := 0
-	for i, arg := range os.Args {
-		if arg == "-labels" {
-			idx = i
-			break
+	// Only the test given by -only runs, not the tests go test runs itself.
+	if *tediOnly != "" {
+		if len(onlyNames) == 0 {
+			return 0, generated, fmt.Errorf("-only %s: no test of that function", *tediOnly)
+		}
+		if !setFlags(testCmd)["run"] {
+			os.Args = append(os.Args, "-run", onlyRunRegexp(onlyNames))
 		}
+		// The test runs whatever its labels are, unless -labels is given.
+		if !setFlags(testCmd)["labels"] {
+			os.Args = append(os.Args, "-labels", onlyLabelsFlag(onlyLabels, *tediLabelSep))
+		}
+	}
+
+	os.Args = moveTediFlags(os.Args)
+	if *tediOutputDir != "" && len(paths) > 0 {
+		overlayFile, temporary, err := packagesOverlay(paths, *tediOutputDir)
+		if temporary {
+			// It is removed together with the generated files.
+			generated = append(generated, overlayFile)
+		}
+		if err != nil {
+			return 0, generated, err
+		}
+		os.Args = append([]string{os.Args[0], os.Args[1], "-overlay", overlayFile}, removeFlag(os.Args[2:], "-output-dir")...)
+	}
+
+	// Coverage profiles of runs with different labels do not overwrite each other.
+	if setFlags(testCmd)["labels"] && *testCoverProfile != "" {
+		os.Args = append(os.Args[:2], labelCoverProfile(os.Args[2:], *tediTestLabels, *tediLabelSep)...)
 	}
 
-	// '-labels' flag is a custom 'tedi' flag so we need to move them as the last arguments to go test.
-	if idx > 0 && idx+1 < len(os.Args) {
-		labelFlag, labelValue := os.Args[idx], os.Args[idx+1]
-		os.Args = append(append(os.Args[0:idx], os.Args[idx+2:]...), labelFlag, labelValue)
+	// The generated files are only compiled when their build tags are given.
+	os.Args = append(os.Args[:2], removeFlag(os.Args[2:], "-buildTag")...)
+	if len(paths) == 0 {
+		buildTags[*tediBuildTag] = true
+	}
+	var tags []string
+	for tag := range buildTags {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		os.Args = append(os.Args[:2], mergeTags(os.Args[2:], tag)...)
 	}
 
 	cmd := exec.Command("go", os.Args[1:]...)
 	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
 
-	cmd.Run()
-	if exitCode := cmd.ProcessState.ExitCode(); exitCode != 0 {
-		os.Exit(exitCode)
+	// The events of go test -json are annotated with the labels of the tests.
+	if *testJSON {
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return 0, generated, err
+		}
+		if err := cmd.Start(); err != nil {
+			return 0, generated, err
+		}
+		annotateErr := annotateTestEvents(stdout, os.Stdout, labels)
+		if annotateErr != nil {
+			// go test is waited for, so it must not block writing to the pipe.
+			io.Copy(ioutil.Discard, stdout)
+		}
+		if err := goTestError(cmd.Wait()); err != nil {
+			return 0, generated, err
+		}
+		if annotateErr != nil {
+			return 0, generated, annotateErr
+		}
+	} else {
+		cmd.Stdout = os.Stdout
+		if err := goTestError(cmd.Run()); err != nil {
+			return 0, generated, err
+		}
+	}
+	return cmd.ProcessState.ExitCode(), generated, nil
+}
+
+// goTestError returns the error of running go test, unless go test ran and
+// exited with a non-zero exit code, which is the exit code of tedi instead.
+func goTestError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run go test: %w", err)
+	}
+	return nil
+}
+
+// onlyRunRegexp returns the -run regexp of go test matching the tests with the names.
+func onlyRunRegexp(names map[string]bool) string {
+	var quoted []string
+	for name := range names {
+		quoted = append(quoted, regexp.QuoteMeta(name))
+	}
+	sort.Strings(quoted)
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
+
+// onlyLabelsFlag returns the -labels value running the tests with the labels,
+// separated by sep.
+func onlyLabelsFlag(labels map[string]bool, sep string) string {
+	var res []string
+	for label := range labels {
+		res = append(res, label)
+	}
+	sort.Strings(res)
+	return strings.Join(res, sep)
+}
+
+// tediFlags are the custom 'tedi' flags of the test command and whether they take a value.
+var tediFlags = []struct {
+	name     string
+	hasValue bool
+}{
+	{"-labels", true},
+	{"-modules", true},
+	{"-label-match", true},
+	{"-failfast-labels", true},
+	{"-label-sep", true},
+	{"-confirm", false},
+	{"-yes", false},
+	{"-tedi.trace", false},
+	{"-tedi.seed", true},
+	{"-tedi.shuffle", true},
+	{"-tedi.grace", true},
+}
+
+// moveTediFlags moves the custom 'tedi' flags as the last arguments, as go test passes these on to the test binary.
+func moveTediFlags(args []string) []string {
+	for _, tediFlag := range tediFlags {
+		idx := 0
+		for i, arg := range args {
+			if arg == tediFlag.name {
+				idx = i
+				break
+			}
+		}
+
+		n := 1
+		if tediFlag.hasValue {
+			n = 2
+		}
+		if idx > 0 && idx+n <= len(args) {
+			moved := append([]string{}, args[idx:idx+n]...)
+			args = append(append(args[0:idx], args[idx+n:]...), moved...)
+		}
+	}
+	return args
+}
+
+// mergeTags adds tag to the -tags flag of args, keeping the tags given by the
+// user. The flag is added if args does not have it.
+func mergeTags(args []string, tag string) []string {
+	res := append([]string{}, args...)
+	for i, arg := range res {
+		var value string
+		switch {
+		case arg == "-tags" && i+1 < len(res):
+			value = res[i+1]
+			res = append(res[:i], res[i+2:]...)
+		case strings.HasPrefix(arg, "-tags="):
+			value = strings.TrimPrefix(arg, "-tags=")
+			res = append(res[:i], res[i+1:]...)
+		default:
+			continue
+		}
+
+		tags := splitTags(value)
+		for _, t := range tags {
+			if t == tag {
+				return append([]string{"-tags", strings.Join(tags, ",")}, res...)
+			}
+		}
+		return append([]string{"-tags", strings.Join(append(tags, tag), ",")}, res...)
+	}
+	return append([]string{"-tags", tag}, res...)
+}
+
+// splitTags splits the build tags of a -tags flag, which are separated by
+// commas or spaces.
+func splitTags(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// tagsFlag returns the build tags of the -tags flag of fs to scan the files
+// with, or nil if the flag is not given, so the files are scanned regardless
+// of their build constraints.
+func tagsFlag(fs *flag.FlagSet, value string) []string {
+	if !setFlags(fs)["tags"] {
+		return nil
+	}
+	return append([]string{}, splitTags(value)...)
+}
+
+// unsafeFileChars matches the characters of labels not used in file names.
+var unsafeFileChars = regexp.MustCompile(`[^\w-]+`)
+
+// labelCoverProfile suffixes the file of the -coverprofile flag of args with the
+// labels separated by sep, like cover.integration-regression.out for -labels
+// regression,integration.
+func labelCoverProfile(args []string, labels, sep string) []string {
+	set := strings.FieldsFunc(labels, func(r rune) bool { return strings.ContainsRune(sep, r) || unicode.IsSpace(r) })
+	sort.Strings(set)
+	suffix := unsafeFileChars.ReplaceAllString(strings.Join(set, "-"), "_")
+
+	rename := func(file string) string {
+		ext := filepath.Ext(file)
+		return strings.TrimSuffix(file, ext) + "." + suffix + ext
+	}
+
+	res := append([]string{}, args...)
+	for i, arg := range res {
+		switch {
+		case arg == "-coverprofile" && i+1 < len(res):
+			res[i+1] = rename(res[i+1])
+		case strings.HasPrefix(arg, "-coverprofile="):
+			res[i] = "-coverprofile=" + rename(strings.TrimPrefix(arg, "-coverprofile="))
+		}
+	}
+	return res
+}
+
+// removeFlag removes the flag and its value from args.
+func removeFlag(args []string, name string) []string {
+	var res []string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == name:
+			i++
+		case strings.HasPrefix(args[i], name+"="):
+		default:
+			res = append(res, args[i])
+		}
 	}
+	return res
 }
 
-func generateFile(parsed *annotations.ParseResult, funcName, prefixTestName, buildTags string) ([]byte, bool) {
+// generateFile returns the source of the file registering the tests of the
+// entrypoints, named by names, and true if it registers anything. Tests
+// missing in names are named by their function name. tedi is imported from
+// importPath; from tediPackage if it is empty.
+func generateFile(parsed *annotations.ParseResult, entrypoints []entrypoint, names map[*annotations.Function]string, buildTags string, importPath string) ([]byte, bool) {
 	g := &generator{}
+	if importPath == "" {
+		importPath = tediPackage
+	}
 
 	if tags := buildTags; len(tags) > 0 {
 		g.Printf("// +build %s\n", tags)
@@ -264,27 +1269,94 @@ func generateFile(parsed *annotations.ParseResult, funcName, prefixTestName, bui
 	g.Printf("package %s", parsed.Package.Name)
 	g.Printf("\n")
 	g.Printf("import (\n")
-	g.Printf("\"%s\"\n", tediPackage)
+	// The generated code refers to the package as tedi, whatever the name of
+	// the last element of the import path.
+	if importPathName(importPath) == "tedi" {
+		g.Printf("\"%s\"\n", importPath)
+	} else {
+		g.Printf("tedi \"%s\"\n", importPath)
+	}
 	g.Printf("\"testing\"\n")
 	g.Printf("\"os\"\n")
+	imported := map[string]bool{importPath: true, "testing": true, "os": true}
+	for _, test := range parsed.Tests {
+		if test.Timeout > 0 {
+			g.Printf("\"time\"\n")
+			imported["time"] = true
+			break
+		}
+	}
+	for _, imp := range fixtureImports(parsed, imported) {
+		g.Printf("%s\n", imp)
+	}
 	g.Printf(")\n")
 
+	write := false
+	for _, e := range entrypoints {
+		fn, writeFunc := generateFunc(parsed, e, names)
+		write = write || writeFunc
+		g.Printf("\n%s", fn)
+	}
+
+	return g.buf.Bytes(), write
+}
+
+// generateFunc returns the function of the entrypoint and true if it registers anything.
+func generateFunc(parsed *annotations.ParseResult, e entrypoint, names map[*annotations.Function]string) (string, bool) {
+	testName := func(fn *annotations.Function) string {
+		if name, ok := names[fn]; ok {
+			return name
+		}
+		return fn.Name()
+	}
+
+	var tests []*annotations.LabelFunction
+	for _, test := range parsed.Tests {
+		if e.matches(test.Labels) {
+			tests = append(tests, test)
+		}
+	}
+	var examples []*annotations.ExampleFunction
+	for _, example := range parsed.Examples {
+		if e.matches(example.Labels) {
+			examples = append(examples, example)
+		}
+	}
+
 	write := false
 
 	var buf bytes.Buffer
 	if len(parsed.TestLabels) > 0 {
-		fmt.Fprintln(&buf, "// TestLabels: ")
+		var labels []string
 		for label := range parsed.TestLabels {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+
+		fmt.Fprintln(&buf, "// TestLabels: ")
+		for _, label := range labels {
 			fmt.Fprintf(&buf, testLabelCall, label)
 		}
+		for _, label := range labels {
+			if n, ok := parsed.LabelParallelism[label]; ok {
+				fmt.Fprintf(&buf, parallelismCall, label, n)
+			}
+		}
 	}
 
-	if len(parsed.Fixtures) > 0 {
+	if len(parsed.Fixtures) > 0 || len(parsed.TypeFixtures) > 0 || len(parsed.Suites) > 0 {
 		write = true
 		fmt.Fprintln(&buf, "")
 		fmt.Fprintln(&buf, "// Fixtures: ")
 		for _, fixture := range parsed.Fixtures {
-			fmt.Fprintf(&buf, fixtureCall, fixture.Decl.Name.Name)
+			fmt.Fprintf(&buf, fixtureCall, fixtureFunc(fixture), fixtureOptions(fixture))
+		}
+		for _, typ := range parsed.TypeFixtures {
+			fmt.Fprintf(&buf, typeFixtureCall, typ.Name(), typ.Name())
+		}
+		// The suite of annotated methods is injected as the receiver of the method expressions.
+		for _, typ := range parsed.Suites {
+			fmt.Fprintf(&buf, typeFixtureCall, typ.Name(), typ.Name())
 		}
 	}
 
@@ -293,7 +1365,38 @@ func generateFile(parsed *annotations.ParseResult, funcName, prefixTestName, bui
 		fmt.Fprintln(&buf, "")
 		fmt.Fprintln(&buf, "// OnceFixtures: ")
 		for _, fixture := range parsed.OnceFixtures {
-			fmt.Fprintf(&buf, onceFixtureCall, fixture.Decl.Name.Name)
+			fmt.Fprintf(&buf, onceFixtureCall, fixtureFunc(fixture), fixtureOptions(fixture))
+		}
+	}
+
+	if len(parsed.Modules) > 0 {
+		write = true
+		var names []string
+		for name := range parsed.Modules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintln(&buf, "")
+		fmt.Fprintln(&buf, "// Modules: ")
+		for _, name := range names {
+			fmt.Fprintf(&buf, moduleStartCall, name)
+			for _, fixture := range parsed.Modules[name].Fixtures {
+				fmt.Fprintf(&buf, fixtureCall, fixtureFunc(fixture), fixtureOptions(fixture))
+			}
+			for _, fixture := range parsed.Modules[name].OnceFixtures {
+				fmt.Fprintf(&buf, onceFixtureCall, fixtureFunc(fixture), fixtureOptions(fixture))
+			}
+			fmt.Fprint(&buf, moduleEndCall)
+		}
+	}
+
+	if len(parsed.BeforeAll) > 0 {
+		write = true
+		fmt.Fprintln(&buf, "")
+		fmt.Fprintln(&buf, "// Before all: ")
+		for _, hook := range parsed.BeforeAll {
+			fmt.Fprintf(&buf, beforeAllCall, hook.Expr())
 		}
 	}
 
@@ -302,20 +1405,49 @@ func generateFile(parsed *annotations.ParseResult, funcName, prefixTestName, bui
 		fmt.Fprintln(&buf, "")
 		fmt.Fprintln(&buf, "// Before tests: ")
 		for _, test := range parsed.BeforeTests {
-			fmt.Fprintf(&buf, beforeTestCall, test.Decl.Name.Name)
+			fmt.Fprintf(&buf, beforeTestCall, test.Expr(), hookOptions(test))
 		}
 	}
 
-	if len(parsed.Tests) > 0 {
+	if len(tests) > 0 {
 		write = true
 		fmt.Fprintln(&buf, "")
 		fmt.Fprintln(&buf, "// Tests: ")
-		for _, test := range parsed.Tests {
-			labelArgs := ""
-			if len(test.Labels) > 0 {
-				labelArgs = fmt.Sprint(`, "`, strings.Join(test.Labels, `", "`), `"`)
+		for _, test := range tests {
+			name := testName(test.Function)
+			fmt.Fprintf(&buf, testCall, name, test.Expr(), labelArgs(test.Labels))
+			if test.Timeout > 0 {
+				fmt.Fprintf(&buf, timeoutCall, name, durationExpr(test.Timeout))
+			}
+			if test.Retries > 0 {
+				fmt.Fprintf(&buf, retryCall, name, test.Retries)
+			}
+			if test.Weight > annotations.DefaultWeight {
+				fmt.Fprintf(&buf, weightCall, name, test.Weight)
+			}
+			if test.ExpectFailure {
+				fmt.Fprintf(&buf, xfailCall, name)
+			}
+			if test.Capture {
+				fmt.Fprintf(&buf, captureCall, name)
 			}
-			fmt.Fprintf(&buf, testCall, prefixTestName+test.Decl.Name.Name, test.Decl.Name.Name, labelArgs)
+			for _, env := range test.Env {
+				key, value := splitEnv(env)
+				fmt.Fprintf(&buf, envCall, name, key, value)
+			}
+		}
+	}
+
+	if len(examples) > 0 {
+		write = true
+		fmt.Fprintln(&buf, "")
+		fmt.Fprintln(&buf, "// Examples: ")
+		for _, example := range examples {
+			unordered := ""
+			if example.Unordered {
+				unordered = ", Unordered: true"
+			}
+			fmt.Fprintf(&buf, exampleCall, testName(example.Function), example.Decl.Name.Name, example.Output, unordered, labelArgs(example.Labels))
 		}
 	}
 
@@ -324,13 +1456,150 @@ func generateFile(parsed *annotations.ParseResult, funcName, prefixTestName, bui
 		fmt.Fprintln(&buf, "")
 		fmt.Fprintln(&buf, "// After tests: ")
 		for _, test := range parsed.AfterTests {
-			fmt.Fprintf(&buf, afterTestCall, test.Decl.Name.Name)
+			fmt.Fprintf(&buf, afterTestCall, test.Expr(), hookOptions(test))
 		}
 	}
 
-	g.Printf(funcBody, funcName, buf.String())
+	if len(parsed.AfterAll) > 0 {
+		write = true
+		fmt.Fprintln(&buf, "")
+		fmt.Fprintln(&buf, "// After all: ")
+		for _, hook := range parsed.AfterAll {
+			fmt.Fprintf(&buf, afterAllCall, hook.Expr())
+		}
+	}
 
-	return g.buf.Bytes(), write
+	// The tests of a labelled entrypoint run regardless of the -labels flag,
+	// which defaults to the unit label.
+	run := runCall
+	if len(e.Labels) > 0 {
+		var quoted []string
+		for _, label := range e.Labels {
+			quoted = append(quoted, strconv.Quote(label))
+		}
+		run = fmt.Sprintf(runLabelsCall, strings.Join(quoted, ", "))
+	}
+	return fmt.Sprintf(funcBody, e.Funcname, buf.String(), run), write
+}
+
+// splitEnv splits a KEY=value environment variable.
+func splitEnv(env string) (string, string) {
+	if i := strings.Index(env, "="); i >= 0 {
+		return env[:i], env[i+1:]
+	}
+	return env, ""
+}
+
+// labelArgs returns the label arguments of a test or example.
+func labelArgs(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var res strings.Builder
+	for _, label := range labels {
+		res.WriteString(", " + strconv.Quote(label))
+	}
+	return res.String()
+}
+
+// fixtureFunc returns the function registered for the fixture.
+func fixtureFunc(fixture *annotations.FixtureFunction) string {
+	if fixture.Locked {
+		return fmt.Sprintf(lockedCall, fixture.Expr())
+	}
+	return fixture.Expr()
+}
+
+// fixtureOptions returns the tedi.FixtureOption arguments for the fixture.
+func fixtureOptions(fixture *annotations.FixtureFunction) string {
+	var opts []string
+	if fixture.Group != "" {
+		opts = append(opts, fmt.Sprintf(groupOption, fixture.Group))
+	}
+	if len(fixture.As) > 0 {
+		var ifaces []string
+		for _, typ := range fixture.As {
+			ifaces = append(ifaces, fmt.Sprintf("new(%s)", typ.Expr))
+		}
+		opts = append(opts, fmt.Sprintf(asOption, strings.Join(ifaces, ", ")))
+	}
+	if fixture.PerLabel {
+		opts = append(opts, perLabelOption)
+	}
+	if fixture.TestScope {
+		opts = append(opts, testScopeOption)
+	}
+	if fixture.Eager {
+		opts = append(opts, eagerOption)
+	}
+	if fixture.Priority != 0 {
+		opts = append(opts, fmt.Sprintf(priorityOption, fixture.Priority))
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(opts, ", ")
+}
+
+// hookOptions returns the tedi.HookOption arguments for the hook.
+func hookOptions(hook *annotations.HookFunction) string {
+	var opts []string
+	if hook.Order != 0 {
+		opts = append(opts, fmt.Sprintf(orderOption, hook.Order))
+	}
+	if len(hook.Labels) > 0 {
+		opts = append(opts, fmt.Sprintf(labelsOption, strings.TrimPrefix(labelArgs(hook.Labels), ", ")))
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(opts, ", ")
+}
+
+// fixtureImports returns the import specs of the packages of the types
+// referenced by the fixture options, which are not imported already.
+func fixtureImports(parsed *annotations.ParseResult, imported map[string]bool) []string {
+	fixtures := append(append([]*annotations.FixtureFunction{}, parsed.Fixtures...), parsed.OnceFixtures...)
+	for _, module := range parsed.Modules {
+		fixtures = append(append(fixtures, module.Fixtures...), module.OnceFixtures...)
+	}
+
+	var res []string
+	for _, fixture := range fixtures {
+		for _, typ := range fixture.As {
+			if typ.ImportPath == "" || imported[typ.ImportPath] {
+				continue
+			}
+			imported[typ.ImportPath] = true
+
+			if typ.ImportName == typ.ImportPath[strings.LastIndex(typ.ImportPath, "/")+1:] {
+				res = append(res, fmt.Sprintf("%q", typ.ImportPath))
+			} else {
+				res = append(res, fmt.Sprintf("%s %q", typ.ImportName, typ.ImportPath))
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// durationExpr returns d as a go expression using the largest unit of the time package that divides d.
+func durationExpr(d time.Duration) string {
+	for _, unit := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"time.Hour", time.Hour},
+		{"time.Minute", time.Minute},
+		{"time.Second", time.Second},
+		{"time.Millisecond", time.Millisecond},
+		{"time.Microsecond", time.Microsecond},
+	} {
+		if d%unit.d == 0 {
+			return fmt.Sprintf("%d * %s", d/unit.d, unit.name)
+		}
+	}
+	return fmt.Sprintf("%d * time.Nanosecond", d)
 }
 
 type generator struct {
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jstroem/tedi/annotations"
+)
+
+var (
+	watchCmd       = flag.NewFlagSet("watch", flag.ExitOnError)
+	watchRecursive = watchCmd.Bool("r", false, "also watch the subdirectories of the current directory")
+	watchDebounce  = watchCmd.Duration("debounce", 200*time.Millisecond, "time to wait for further changes before regenerating")
+	watchFuncname  = watchCmd.String("func", "TestMain", "name of the function to generate; default TestMain")
+	watchPrefix    = watchCmd.String("prefix", "", "prefix name of tests; default <none>")
+	watchOutput    = watchCmd.String("output", "tedi_test.go", "output file name; default srcdir/tedi_test.go")
+	watchBuildTag  = watchCmd.String("buildTag", "", "build tag to set in the generated file")
+	watchNoImp     = watchCmd.Bool("no-imports", false, "only gofmt the generated file instead of sorting and grouping its imports like goimports")
+	watchTags      = watchCmd.String("tags", "", "comma-separated `list` of build tags the files are scanned with, like generate -tags")
+)
+
+func watchCommand() {
+	dir, err := os.Getwd()
+	if err != nil {
+		die(err)
+	}
+
+	dirs := []string{dir}
+	if *watchRecursive {
+		if dirs, err = watchDirs(dir); err != nil {
+			die(err)
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		die(err)
+	}
+	defer watcher.Close()
+
+	o := writeTediFileOptions{
+		Entrypoints: []entrypoint{{Funcname: *watchFuncname, BuildTag: *watchBuildTag}},
+		Prefix:      *watchPrefix,
+		OutputFile:  *watchOutput,
+		NoImports:   *watchNoImp,
+		ParseOptions: annotations.Options{
+			Tags: tagsFlag(watchCmd, *watchTags),
+		},
+		SetFlags: setFlags(watchCmd),
+	}
+
+	for _, d := range dirs {
+		if err := watcher.Add(d); err != nil {
+			die(err)
+		}
+		regenerate(d, o)
+	}
+	log.Printf("watching %d director%s for changes", len(dirs), plural(len(dirs), "y", "ies"))
+
+	// The timer is reset on every change, so a burst of writes, like an
+	// editor writing a temp file and renaming it, only regenerates once.
+	timer := time.NewTimer(*watchDebounce)
+	timer.Stop()
+	pending := map[string]bool{}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if *watchRecursive && event.Op&fsnotify.Create == fsnotify.Create {
+				if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() && !skipDir(fi.Name()) {
+					if err := watcher.Add(event.Name); err != nil {
+						log.Println(err)
+					}
+					continue
+				}
+			}
+
+			output := o.OutputFile
+			if configured, err := configure(filepath.Dir(event.Name), o); err == nil {
+				output = configured.OutputFile
+			}
+			if !isTestFileEvent(event, output) {
+				continue
+			}
+			pending[filepath.Dir(event.Name)] = true
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(*watchDebounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println(err)
+
+		case <-timer.C:
+			var changed []string
+			for d := range pending {
+				changed = append(changed, d)
+			}
+			sort.Strings(changed)
+			pending = map[string]bool{}
+
+			for _, d := range changed {
+				regenerate(d, o)
+			}
+		}
+	}
+}
+
+// regenerate writes the tedi file of dir and prints a short summary.
+func regenerate(dir string, o writeTediFileOptions) {
+	start := time.Now()
+	o, err := configure(dir, o)
+	if err != nil {
+		log.Printf("%s: %s", dir, err)
+		return
+	}
+	res, _, err := writeTediFile(dir, o)
+	if err != nil {
+		log.Printf("%s: %s", dir, err)
+		return
+	}
+	if res == nil || res.Package == nil {
+		log.Printf("%s: no tests found", dir)
+		return
+	}
+
+	fixtures := len(res.Fixtures) + len(res.OnceFixtures) + len(res.TypeFixtures)
+	for _, module := range res.Modules {
+		fixtures += len(module.Fixtures) + len(module.OnceFixtures)
+	}
+	log.Printf("%s: regenerated %s with %d test%s and %d fixture%s in %s",
+		dir, o.OutputFile,
+		len(res.Tests), plural(len(res.Tests), "", "s"),
+		fixtures, plural(fixtures, "", "s"),
+		time.Since(start).Round(time.Millisecond))
+}
+
+// isTestFileEvent returns true if the event changes a _test.go file which is
+// not the generated output file. Temp files written by editors are ignored;
+// the rename onto the test file is reported as a create of the test file.
+func isTestFileEvent(event fsnotify.Event, outputFile string) bool {
+	name := filepath.Base(event.Name)
+	if !strings.HasSuffix(name, "_test.go") || strings.HasPrefix(name, ".") {
+		return false
+	}
+	if name == filepath.Base(outputFile) {
+		return false
+	}
+	return event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0
+}
+
+// watchDirs returns dir and all of its subdirectories which are not skipped.
+func watchDirs(dir string) ([]string, error) {
+	var res []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if path != dir && skipDir(fi.Name()) {
+			return filepath.SkipDir
+		}
+		res = append(res, path)
+		return nil
+	})
+	return res, err
+}
+
+// skipDir returns true for directories the go tool ignores.
+func skipDir(name string) bool {
+	return name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+func plural(n int, singular, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_isTestFileEvent(t *testing.T) {
+	for _, tc := range []struct {
+		event fsnotify.Event
+		exp   bool
+	}{
+		{fsnotify.Event{Name: "pkg/foo_test.go", Op: fsnotify.Write}, true},
+		{fsnotify.Event{Name: "pkg/foo_test.go", Op: fsnotify.Create}, true},
+		{fsnotify.Event{Name: "pkg/foo_test.go", Op: fsnotify.Rename}, true},
+		{fsnotify.Event{Name: "pkg/foo_test.go", Op: fsnotify.Remove}, true},
+		{fsnotify.Event{Name: "pkg/foo_test.go", Op: fsnotify.Chmod}, false},
+		{fsnotify.Event{Name: "pkg/foo.go", Op: fsnotify.Write}, false},
+		{fsnotify.Event{Name: "pkg/foo_test.go~", Op: fsnotify.Write}, false},
+		{fsnotify.Event{Name: "pkg/.foo_test.go", Op: fsnotify.Create}, false},
+		{fsnotify.Event{Name: "pkg/tedi_test.go", Op: fsnotify.Write}, false},
+	} {
+		assert.Equal(t, tc.exp, isTestFileEvent(tc.event, "tedi_test.go"), tc.event.String())
+	}
+}
+
+func Test_watchDirs(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"a", "a/b", "vendor", "testdata", ".git", "_skip"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, sub), 0755))
+	}
+
+	dirs, err := watchDirs(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{dir, filepath.Join(dir, "a"), filepath.Join(dir, "a", "b")}, dirs)
+}
@@ -0,0 +1,48 @@
+package tedi
+
+import (
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+// Example registers a testable example. The example is run like the Example
+// functions of go test, so its standard output must match example.Output.
+// Examples cannot depend on fixtures.
+func (t *Tedi) Example(example testing.InternalExample, labels ...string) {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	t.registrations = append(t.registrations, registration{example.Name, func() { t.registerExample(example, labels...) }})
+	t.registerExample(example, labels...)
+}
+
+// registerExample adds the example to m if its labels match the labels to run, like registerTest.
+func (t *Tedi) registerExample(example testing.InternalExample, labels ...string) {
+	if _, ok := t.matchLabels(labels); ok {
+		t.addExample(example)
+		t.tests = append(t.tests, example.Name)
+	}
+}
+
+// addExample adds the example to m like addTest. Callers must hold registerMu.
+func (t *Tedi) addExample(example testing.InternalExample) {
+	if !t.registerInM() {
+		t.fallbackExamples = append(t.fallbackExamples, example)
+		return
+	}
+
+	examples := reflect.ValueOf(t.m).Elem().FieldByName("examples")
+
+	// examples is a private field on the testing.M struct, see addTest.
+	examples = reflect.NewAt(examples.Type(), unsafe.Pointer(examples.UnsafeAddr()))
+
+	newExample := reflect.New(examples.Type().Elem().Elem())
+	newExample.Elem().FieldByName("Name").Set(reflect.ValueOf(example.Name))
+	newExample.Elem().FieldByName("F").Set(reflect.ValueOf(example.F))
+	newExample.Elem().FieldByName("Output").Set(reflect.ValueOf(example.Output))
+	newExample.Elem().FieldByName("Unordered").Set(reflect.ValueOf(example.Unordered))
+
+	examples.Elem().Set(reflect.Append(examples.Elem(), newExample.Elem()))
+	t.addedExamples++
+}
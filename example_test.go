@@ -0,0 +1,36 @@
+package tedi
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Example(t *testing.T) {
+	m := &testing.M{}
+	tedi := newTedi(m, "unit")
+	tedi.TestLabel("unit")
+	tedi.TestLabel("integration")
+
+	hello := testing.InternalExample{Name: "exampleHello", F: func() { fmt.Println("hello") }, Output: "hello\n"}
+	tedi.Example(hello, "unit")
+	tedi.Example(testing.InternalExample{Name: "exampleSkipped", F: func() {}}, "integration")
+
+	examples := reflect.ValueOf(m).Elem().FieldByName("examples")
+	if assert.Equal(t, 1, examples.Len()) {
+		assert.Equal(t, "exampleHello", examples.Index(0).FieldByName("Name").String())
+		assert.Equal(t, "hello\n", examples.Index(0).FieldByName("Output").String())
+	}
+	assert.Equal(t, []string{"exampleHello"}, tedi.tests)
+
+	tedi.compatErr = ErrIncompatibleGoVersion
+	tedi.Example(testing.InternalExample{Name: "exampleFails", F: func() { fmt.Println("bye") }, Output: "hello\n"}, "unit")
+	tedi.Example(hello, "unit")
+	assert.Len(t, tedi.fallbackExamples, 2)
+	assert.False(t, tedi.runFallbackTests(matchAll))
+
+	tedi.fallbackExamples = tedi.fallbackExamples[1:]
+	assert.True(t, tedi.runFallbackTests(matchAll))
+}
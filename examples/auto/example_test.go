@@ -18,10 +18,9 @@ func fixtureNameLength(t *testing.T, r int64) int {
 	return len(t.Name())
 }
 
-func fixtureRand() int64 {
+func fixtureRand(r *rand.Rand) int64 {
 	fmt.Println("rand fixture called")
-	rand.Seed(time.Now().UnixNano())
-	return rand.Int63()
+	return r.Int63()
 }
 
 func testTimer(t *testing.T, foo int, _ printTimerFunc) {
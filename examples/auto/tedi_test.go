@@ -3,9 +3,10 @@
 package auto
 
 import (
-	"github.com/jstroem/tedi"
 	"os"
 	"testing"
+
+	"github.com/jstroem/tedi"
 )
 
 func TestMain(m *testing.M) {
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/jstroem/tedi"
+	"github.com/stretchr/testify/assert"
 )
 
 // @disableAutoLabelling
@@ -22,10 +23,9 @@ func myFixture(t *testing.T, r int64) int {
 }
 
 // @onceFixture
-func randFixture() int64 {
+func randFixture(r *rand.Rand) int64 {
 	fmt.Println("rand fixture called")
-	rand.Seed(time.Now().UnixNano())
-	return rand.Int63()
+	return r.Int63()
 }
 
 // @test
@@ -70,3 +70,20 @@ func myTimer(t *tedi.T) printTimerFunc {
 func MyTestTiming(t *tedi.T, _ printTimerFunc) {
 	time.Sleep(time.Second)
 }
+
+var beforeAllCalls int
+
+// @beforeAll
+func startPackage() {
+	beforeAllCalls++
+}
+
+// @afterAll
+func stopPackage() {
+	beforeAllCalls = 0
+}
+
+// @test
+func BeforeAllTest(t *tedi.T) {
+	assert.Equal(t, 1, beforeAllCalls)
+}
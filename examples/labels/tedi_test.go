@@ -3,18 +3,19 @@
 package labels
 
 import (
-	"github.com/jstroem/tedi"
 	"os"
 	"testing"
+
+	"github.com/jstroem/tedi"
 )
 
 func TestMain(m *testing.M) {
 	t := tedi.New(m)
 
 	// TestLabels:
-	t.TestLabel("unit")
 	t.TestLabel("integration")
 	t.TestLabel("regression")
+	t.TestLabel("unit")
 
 	// Fixtures:
 	t.Fixture(myFixture)
@@ -23,6 +24,9 @@ func TestMain(m *testing.M) {
 	// OnceFixtures:
 	t.OnceFixture(randFixture)
 
+	// Before all:
+	t.BeforeAll(startPackage)
+
 	// Before tests:
 	t.BeforeTest(myBefore)
 
@@ -31,6 +35,10 @@ func TestMain(m *testing.M) {
 	t.Test("AnotherTest", AnotherTest, "unit")
 	t.Test("MyIntegrationTest", MyIntegrationTest, "integration")
 	t.Test("MyTestTiming", MyTestTiming, "unit")
+	t.Test("BeforeAllTest", BeforeAllTest, "unit")
+
+	// After all:
+	t.AfterAll(stopPackage)
 
 	os.Exit(t.Run())
 }
@@ -1,11 +1,20 @@
 package tedi
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/rand"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/dig"
 )
 
@@ -14,55 +23,764 @@ var (
 	ErrFixtureMustBeFunction = errors.New("fixture can only be functions")
 	// ErrFixtureCannotProduceTestingTB thrown if a fixture produces a testing.TB
 	ErrFixtureCannotProduceTestingTB = errors.New("fixture cannot produce testing.TB")
+	// ErrFixtureCannotProduceBuiltin thrown if a fixture produces a type tedi
+	// provides to every test and depends on itself: *testing.T, *T or context.Context
+	ErrFixtureCannotProduceBuiltin = errors.New("fixture cannot produce a type provided by tedi")
+	// ErrFixtureDuringTest thrown if a fixture is registered while tests run
+	ErrFixtureDuringTest = errors.New("fixtures cannot be registered while tests run")
+	// ErrFixtureCannotBeLocked thrown if a fixture given to Locked does not produce a single value
+	ErrFixtureCannotBeLocked = errors.New("fixture can only be locked if it produces a single value and optionally an error")
+	// ErrValueCannotBeNil thrown if the value given to Value is nil
+	ErrValueCannotBeNil = errors.New("value fixture cannot be nil")
+	// ErrFixtureAs thrown if a fixture cannot be provided as the interface given by As
+	ErrFixtureAs = errors.New("fixture cannot be provided as interface")
+	// ErrDuplicateFixture thrown if two fixtures produce the same type
+	ErrDuplicateFixture = errors.New("type is produced by more than one fixture")
 
 	testingTB = reflect.TypeOf((*testing.TB)(nil)).Elem()
+
+	// builtinTypes are the types provided by tedi to every test. Fixtures
+	// producing a builtin type replace the builtin, except for the reserved
+	// types.
+	builtinTypes = []reflect.Type{
+		reflect.TypeOf((*testing.T)(nil)),
+		reflect.TypeOf((*T)(nil)),
+		reflect.TypeOf((*context.Context)(nil)).Elem(),
+		reflect.TypeOf(TestInfo{}),
+		reflect.TypeOf(Cleanup(nil)),
+		reflect.TypeOf((*rand.Rand)(nil)),
+		reflect.TypeOf(Outcome{}),
+		reflect.TypeOf((*Logger)(nil)),
+		reflect.TypeOf((*assert.Assertions)(nil)),
+		reflect.TypeOf((*require.Assertions)(nil)),
+		reflect.TypeOf(TempDir("")),
+		reflect.TypeOf((*Tedi)(nil)),
+	}
+
+	// reservedTypes are the builtin types fixtures cannot produce, as tedi
+	// itself depends on the test handles and the context of the test.
+	reservedTypes = []reflect.Type{
+		reflect.TypeOf((*testing.T)(nil)),
+		reflect.TypeOf((*T)(nil)),
+		reflect.TypeOf((*context.Context)(nil)).Elem(),
+	}
 )
 
-// Fixture registers a function as a fixture to tedi.
-func (t *Tedi) Fixture(fn interface{}) error {
-	fnType := reflect.TypeOf(fn)
-	if fnType.Kind() != reflect.Func {
+// FixtureOption changes how a fixture is provided to the tests.
+type FixtureOption func(*fixture)
+
+// Group provides the values of the fixture to the value group with the given
+// name instead of providing them directly. Tests collect the values of a group
+// with a dig.In struct containing a slice field tagged `group:"<name>"`.
+// Subtests share the values of the group with their root test.
+func Group(name string) FixtureOption {
+	return func(f *fixture) {
+		f.group = name
+	}
+}
+
+// As additionally provides the value of the fixture as the interfaces pointed
+// to by ifaces, like As(new(io.Writer)). The fixture must produce a type
+// implementing the interfaces.
+func As(ifaces ...interface{}) FixtureOption {
+	return func(f *fixture) {
+		f.as = append(f.as, ifaces...)
+	}
+}
+
+// PerLabel makes a once fixture create one value for every distinct set of
+// labels of the tests, instead of a single value shared by all tests. It has
+// no effect on other fixtures.
+func PerLabel() FixtureOption {
+	return func(f *fixture) {
+		f.perLabel = true
+	}
+}
+
+// TestScope makes a fixture create one value for every root test, which is
+// shared by the test and its subtests instead of creating a value for every
+// subtest. The fixture is only provided by the container of the root test,
+// which the containers of the subtests are scoped in, so the value gets the
+// dependencies of the root test even if a subtest requests it first. It has no
+// effect on once fixtures.
+func TestScope() FixtureOption {
+	return func(f *fixture) {
+		f.testScoped = true
+	}
+}
+
+// Eager makes every test create the values of the fixture before its before
+// hooks run, even if neither the test nor its hooks depend on them, for
+// fixtures with side effects like starting a server. The values of once
+// fixtures are still created once. It has no effect on fixtures of a Group.
+func Eager() FixtureOption {
+	return func(f *fixture) {
+		f.eager = true
+	}
+}
+
+// Priority decides which fixture provides an interface given by As if several
+// fixtures do: only the fixtures with the highest priority provide it. The
+// default priority is 0. Fixtures with the same priority providing the same
+// interface fail the tests with ErrDuplicateFixture.
+func Priority(priority int) FixtureOption {
+	return func(f *fixture) {
+		f.priority = priority
+	}
+}
+
+type fixture struct {
+	fn         interface{}
+	group      string
+	as         []interface{}
+	perLabel   bool
+	testScoped bool
+	eager      bool
+	// name of the function of a once fixture or of a value, as fn is created
+	// by reflection. Once fixtures log their construction time themselves,
+	// in verbose mode with the test constructing them given by onceLog.
+	name    string
+	once    bool
+	onceLog *onceLog
+	// priority decides which fixture provides the interfaces of as.
+	priority int
+}
+
+// preferred returns the fixture without the interfaces of as which other
+// fixtures with a higher priority provide, given the highest priority of the
+// fixtures providing every interface.
+func (f fixture) preferred(priorities map[reflect.Type]int) fixture {
+	var as []interface{}
+	for _, iface := range f.as {
+		if priorities[reflect.TypeOf(iface).Elem()] <= f.priority {
+			as = append(as, iface)
+		}
+	}
+	f.as = as
+	return f
+}
+
+// funcName returns the name of the function of the fixture.
+func (f fixture) funcName() string {
+	if f.name != "" {
+		return f.name
+	}
+	return funcName(f.fn)
+}
+
+func (f fixture) provideOptions() []dig.ProvideOption {
+	var res []dig.ProvideOption
+	if f.group != "" {
+		res = append(res, dig.Group(f.group))
+	}
+	return res
+}
+
+// validate returns an error if the fixture cannot be provided.
+func (f fixture) validate() error {
+	fnType := reflect.TypeOf(f.fn)
+	if fnType == nil || fnType.Kind() != reflect.Func {
 		return ErrFixtureMustBeFunction
 	}
 
 	for i := 0; i < fnType.NumOut(); i++ {
+		for _, reserved := range reservedTypes {
+			if fnType.Out(i) == reserved {
+				return fmt.Errorf("%w: %v", ErrFixtureCannotProduceBuiltin, reserved)
+			}
+		}
 		if fnType.Out(i).Implements(testingTB) {
 			return ErrFixtureCannotProduceTestingTB
 		}
 	}
 
-	t.fixtures = append(t.fixtures, fn)
+	_, err := f.aliases()
+	return err
+}
+
+// outputs returns the types the fixture provides directly, which are all its
+// outputs but errors if the fixture is not part of a group.
+func (f fixture) outputs() []reflect.Type {
+	if f.group != "" {
+		return nil
+	}
+
+	fnType := reflect.TypeOf(f.fn)
+	var res []reflect.Type
+	for i := 0; i < fnType.NumOut(); i++ {
+		if fnType.Out(i) != errorType {
+			res = append(res, fnType.Out(i))
+		}
+	}
+	return res
+}
+
+// without returns the fixture without the outputs and aliases of the given
+// types. It returns false if the fixture provides nothing else.
+func (f fixture) without(types map[reflect.Type]bool) (fixture, bool) {
+	var as []interface{}
+	for _, iface := range f.as {
+		if !types[reflect.TypeOf(iface).Elem()] {
+			as = append(as, iface)
+		}
+	}
+	f.as = as
+
+	fnValue := reflect.ValueOf(f.fn)
+	fnType := fnValue.Type()
+	var keep []int
+	var out []reflect.Type
+	removed, provides := false, false
+	for i := 0; i < fnType.NumOut(); i++ {
+		if fnType.Out(i) != errorType && f.group == "" && types[fnType.Out(i)] {
+			removed = true
+			continue
+		}
+		provides = provides || fnType.Out(i) != errorType
+		keep = append(keep, i)
+		out = append(out, fnType.Out(i))
+	}
+	if !removed {
+		return f, true
+	}
+	if !provides {
+		return f, false
+	}
+
+	in := make([]reflect.Type, fnType.NumIn())
+	for i := range in {
+		in[i] = fnType.In(i)
+	}
+	f.fn = reflect.MakeFunc(reflect.FuncOf(in, out, fnType.IsVariadic()), func(args []reflect.Value) []reflect.Value {
+		var all []reflect.Value
+		if fnType.IsVariadic() {
+			all = fnValue.CallSlice(args)
+		} else {
+			all = fnValue.Call(args)
+		}
+
+		res := make([]reflect.Value, len(keep))
+		for i, idx := range keep {
+			res[i] = all[idx]
+		}
+		return res
+	}).Interface()
+	return f, true
+}
+
+// aliases returns a constructor for every interface given by As, converting
+// the value produced by the fixture to the interface.
+func (f fixture) aliases() ([]interface{}, error) {
+	if len(f.as) > 0 && f.group != "" {
+		return nil, fmt.Errorf("%w: fixture of group %q", ErrFixtureAs, f.group)
+	}
+
+	fnType := reflect.TypeOf(f.fn)
+	var res []interface{}
+	for _, as := range f.as {
+		asType := reflect.TypeOf(as)
+		if asType == nil || asType.Kind() != reflect.Ptr || asType.Elem().Kind() != reflect.Interface {
+			return nil, fmt.Errorf("%w: %v is not a pointer to an interface", ErrFixtureAs, asType)
+		}
+		iface := asType.Elem()
+
+		var out reflect.Type
+		for i := 0; i < fnType.NumOut(); i++ {
+			if fnType.Out(i) != errorType && fnType.Out(i) != iface && fnType.Out(i).Implements(iface) {
+				out = fnType.Out(i)
+				break
+			}
+		}
+		if out == nil {
+			return nil, fmt.Errorf("%w: %v does not produce a type implementing %v", ErrFixtureAs, fnType, iface)
+		}
+
+		res = append(res, reflect.MakeFunc(reflect.FuncOf([]reflect.Type{out}, []reflect.Type{iface}, false), func(args []reflect.Value) []reflect.Value {
+			v := reflect.New(iface).Elem()
+			v.Set(args[0])
+			return []reflect.Value{v}
+		}).Interface())
+	}
+	return res, nil
+}
+
+// provide provides the fixture and its aliases to the container.
+func (f fixture) provide(c container) error {
+	if err := c.Provide(f.fn, f.provideOptions()...); err != nil {
+		return err
+	}
+
+	aliases, err := f.aliases()
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		if err := c.Provide(alias); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// OnceFixture registers a function as a fixture that should only be called once.
-func (t *Tedi) OnceFixture(fn interface{}) error {
-	return t.Fixture(Once(fn))
+// provides returns the types the fixture provides directly and through its aliases.
+func (f fixture) provides() []reflect.Type {
+	res := f.outputs()
+	for _, iface := range f.as {
+		res = append(res, reflect.TypeOf(iface).Elem())
+	}
+	return res
+}
+
+// asPriorities returns the highest priority of the fixtures providing every
+// interface given by As.
+func (t *Tedi) asPriorities() map[reflect.Type]int {
+	res := map[reflect.Type]int{}
+	for _, f := range t.fixtures {
+		for _, iface := range f.as {
+			typ := reflect.TypeOf(iface).Elem()
+			if priority, ok := res[typ]; !ok || f.priority > priority {
+				res[typ] = f.priority
+			}
+		}
+	}
+	return res
+}
+
+// duplicateFixture returns an error naming the fixtures if the i-th fixture
+// failed to be provided as an earlier fixture produces the same type; err
+// otherwise. dig does not name the functions in its error.
+func (t *Tedi) duplicateFixture(i int, err error) error {
+	priorities := t.asPriorities()
+	for _, typ := range t.fixtures[i].preferred(priorities).provides() {
+		for _, prev := range t.fixtures[:i] {
+			for _, prevTyp := range prev.preferred(priorities).provides() {
+				if prevTyp == typ {
+					return fmt.Errorf("%w: %s and %s both produce %v", ErrDuplicateFixture, prev.funcName(), t.fixtures[i].funcName(), typ)
+				}
+			}
+		}
+	}
+	return err
+}
+
+func newFixture(fn interface{}, opts ...FixtureOption) fixture {
+	res := fixture{fn: fn}
+	for _, opt := range opts {
+		opt(&res)
+	}
+	return res
+}
+
+// Fixture registers a function as a fixture to tedi.
+func (t *Tedi) Fixture(fn interface{}, opts ...FixtureOption) error {
+	// Once and Locked return the error instead of a function.
+	if err, ok := fn.(error); ok {
+		return err
+	}
+	// The containers of the running tests are created already.
+	if atomic.LoadInt32(&t.running) > 0 {
+		return ErrFixtureDuringTest
+	}
+
+	f := newFixture(fn, opts...)
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	t.fixtures = append(t.fixtures, f)
+	return nil
+}
+
+// Value registers v as a fixture providing v itself, like a fixture function
+// returning v. Every test gets the same value.
+func (t *Tedi) Value(v interface{}, opts ...FixtureOption) error {
+	if v == nil {
+		return ErrValueCannotBeNil
+	}
+
+	value := reflect.ValueOf(v)
+	fn := reflect.MakeFunc(reflect.FuncOf(nil, []reflect.Type{value.Type()}, false), func([]reflect.Value) []reflect.Value {
+		return []reflect.Value{value}
+	})
+	if err := t.Fixture(fn.Interface(), opts...); err != nil {
+		return err
+	}
+	t.fixtures[len(t.fixtures)-1].name = fmt.Sprintf("Value(%v)", value.Type())
+	return nil
+}
+
+// OnceFixture registers a function as a fixture that should only be called
+// once. Running the tests multiple times with -count resets the fixture at the
+// start of every iteration, so each iteration gets a new value which is shared
+// by all tests of the iteration. With PerLabel every set of labels gets its
+// own value.
+func (t *Tedi) OnceFixture(fn interface{}, opts ...FixtureOption) error {
+	newOnceFn := newOnce
+	if newFixture(fn, opts...).perLabel {
+		newOnceFn = newOnceKeyed
+	}
+	name := funcName(fn)
+	var log *onceLog
+	if t.verbose && reflect.ValueOf(fn).Kind() == reflect.Func {
+		// Timed inside the once function, so only the calls constructing
+		// the value are logged and not the ones returning it.
+		log = &onceLog{}
+		fn = timed(fn, name, log.logf)
+	}
+	onceFn, reset := newOnceFn(fn)
+	if err := t.Fixture(onceFn, opts...); err != nil {
+		return err
+	}
+	t.fixtures[len(t.fixtures)-1].name = name
+	t.fixtures[len(t.fixtures)-1].once = true
+	t.fixtures[len(t.fixtures)-1].onceLog = log
+	t.onceFixtures = append(t.onceFixtures, newFixture(onceFn, opts...))
+	t.onceResets = append(t.onceResets, reset)
+	return nil
 }
 
 // Once generically makes a new function that only calls fn once and afterwards returns the same result.
 func Once(fn interface{}) interface{} {
+	onceFn, _ := newOnce(fn)
+	return onceFn
+}
+
+// newOnce returns Once(fn) together with a function that resets it, so the
+// next call calls fn again.
+func newOnce(fn interface{}) (interface{}, func()) {
 	fnValue := reflect.ValueOf(fn)
 	if fnValue.Kind() != reflect.Func {
-		return ErrFixtureMustBeFunction
+		return ErrFixtureMustBeFunction, func() {}
 	}
 
-	var o sync.Once
+	var mu sync.Mutex
+	var done bool
 	var res []reflect.Value
 	onceFnValue := reflect.MakeFunc(fnValue.Type(), func(args []reflect.Value) []reflect.Value {
-		o.Do(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !done {
+			res, done = fnValue.Call(args), true
+		}
+		return res
+	})
+
+	reset := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		res, done = nil, false
+	}
+	return onceFnValue.Interface(), reset
+}
+
+// newOnceKeyed is like newOnce, but calls fn once for every distinct set of
+// labels. The returned function additionally depends on the TestInfo of the
+// test to get its labels.
+func newOnceKeyed(fn interface{}) (interface{}, func()) {
+	fnValue := reflect.ValueOf(fn)
+	if fnValue.Kind() != reflect.Func {
+		return ErrFixtureMustBeFunction, func() {}
+	}
+
+	fnType := fnValue.Type()
+	in := []reflect.Type{reflect.TypeOf(TestInfo{})}
+	for i := 0; i < fnType.NumIn(); i++ {
+		in = append(in, fnType.In(i))
+	}
+	out := make([]reflect.Type, fnType.NumOut())
+	for i := range out {
+		out[i] = fnType.Out(i)
+	}
+
+	var mu sync.Mutex
+	res := map[string][]reflect.Value{}
+	onceFnValue := reflect.MakeFunc(reflect.FuncOf(in, out, fnType.IsVariadic()), func(args []reflect.Value) []reflect.Value {
+		labels := append([]string{}, args[0].Interface().(TestInfo).Labels...)
+		sort.Strings(labels)
+		key := strings.Join(labels, ",")
+
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := res[key]; !ok {
+			if fnType.IsVariadic() {
+				res[key] = fnValue.CallSlice(args[1:])
+			} else {
+				res[key] = fnValue.Call(args[1:])
+			}
+		}
+		return res[key]
+	})
+
+	reset := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		res = map[string][]reflect.Value{}
+	}
+	return onceFnValue.Interface(), reset
+}
+
+// container is the container of a test: a dig.Container for root tests and a
+// dig.Scope of the container of the parent test for subtests.
+type container interface {
+	Provide(constructor interface{}, opts ...dig.ProvideOption) error
+	Invoke(function interface{}, opts ...dig.InvokeOption) error
+	Scope(name string, opts ...dig.ScopeOption) *dig.Scope
+}
+
+// scopeRoot is the first constructor of the container of a root test. dig
+// gives the constructors a scope copies from its parent the order 0 within the
+// scope, so its cycle detection follows their edges to the first constructor.
+// scopeRoot depends on nothing, keeping these edges from forming false cycles.
+type scopeRoot struct{}
+
+// testScope guards the containers of a root test and its subtests. dig scopes
+// are not safe for concurrent use, and parallel subtests share the container
+// of the root test which creates the values of the test scoped fixtures. The
+// lock is held while the arguments of a test are built, so parallel subtests
+// of a root test construct their fixtures one at a time; only the test
+// functions themselves run in parallel.
+type testScope struct {
+	mu sync.Mutex
+}
+
+// resolve returns the parameters of fn from the container c within the scope.
+func (s *testScope) resolve(c container, fn interface{}) ([]reflect.Value, error) {
+	fnType := reflect.TypeOf(fn)
+	in := make([]reflect.Type, fnType.NumIn())
+	for i := range in {
+		in[i] = fnType.In(i)
+	}
+
+	var args []reflect.Value
+	capture := reflect.MakeFunc(reflect.FuncOf(in, nil, fnType.IsVariadic()), func(values []reflect.Value) []reflect.Value {
+		args = values
+		return nil
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := c.Invoke(capture.Interface()); err != nil {
+		return nil, fmt.Errorf("could not build arguments for function %s: %w", funcName(fn), dig.RootCause(err))
+	}
+	return args, nil
+}
+
+// timed returns a function calling fn and logging how long the fixture of the
+// name took with logf. dig only calls the constructors of the fixtures a test
+// depends on, so only the fixtures that are used are logged.
+func timed(fn interface{}, name string, logf func(format string, args ...interface{})) interface{} {
+	fnValue := reflect.ValueOf(fn)
+	return reflect.MakeFunc(fnValue.Type(), func(args []reflect.Value) []reflect.Value {
+		start := time.Now()
+		var res []reflect.Value
+		if fnValue.Type().IsVariadic() {
+			res = fnValue.CallSlice(args)
+		} else {
 			res = fnValue.Call(args)
+		}
+		logf("Fixture %s constructed in %s", name, time.Since(start))
+		return res
+	}).Interface()
+}
+
+// onceLog logs the construction of a once fixture with the Logf of the test
+// constructing it, like the other fixtures are logged. Outside of tests, like
+// for the BeforeAll hooks, it is logged like the other diagnostics of tedi.
+type onceLog struct {
+	mu   sync.Mutex
+	test func(format string, args ...interface{})
+}
+
+func (l *onceLog) logf(format string, args ...interface{}) {
+	if l.test != nil {
+		l.test(format, args...)
+		return
+	}
+	fmt.Printf("tedi: "+format+"\n", args...)
+}
+
+// by returns a function calling fn, which logs the construction of the once
+// fixture with the logf of the test.
+func (l *onceLog) by(fn interface{}, logf func(format string, args ...interface{})) interface{} {
+	fnValue := reflect.ValueOf(fn)
+	return reflect.MakeFunc(fnValue.Type(), func(args []reflect.Value) []reflect.Value {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.test = logf
+		defer func() { l.test = nil }()
+		if fnValue.Type().IsVariadic() {
+			return fnValue.CallSlice(args)
+		}
+		return fnValue.Call(args)
+	}).Interface()
+}
+
+// Locked makes a new function that guards the value produced by fn with a
+// mutex, so the value can be shared by parallel tests. Instead of the value it
+// produces a function calling its argument with the value while holding the
+// lock, so a fixture producing *Counter is depended on as func(func(*Counter)).
+// All users of the produced function share the lock, which makes it useful
+// together with OnceFixture. fn must produce a single value and optionally an
+// error.
+func Locked(fn interface{}) interface{} {
+	fnValue := reflect.ValueOf(fn)
+	if fnValue.Kind() != reflect.Func {
+		return ErrFixtureMustBeFunction
+	}
+
+	fnType := fnValue.Type()
+	switch {
+	case fnType.NumOut() == 0 || fnType.NumOut() > 2,
+		fnType.Out(0) == errorType,
+		fnType.NumOut() == 2 && fnType.Out(1) != errorType:
+		return ErrFixtureCannotBeLocked
+	}
+
+	withType := reflect.FuncOf([]reflect.Type{reflect.FuncOf([]reflect.Type{fnType.Out(0)}, nil, false)}, nil, false)
+	in := make([]reflect.Type, fnType.NumIn())
+	for i := range in {
+		in[i] = fnType.In(i)
+	}
+	out := []reflect.Type{withType}
+	if fnType.NumOut() == 2 {
+		out = append(out, errorType)
+	}
+
+	return reflect.MakeFunc(reflect.FuncOf(in, out, fnType.IsVariadic()), func(args []reflect.Value) []reflect.Value {
+		var res []reflect.Value
+		if fnType.IsVariadic() {
+			res = fnValue.CallSlice(args)
+		} else {
+			res = fnValue.Call(args)
+		}
+
+		var mu sync.Mutex
+		value := res[0]
+		res[0] = reflect.MakeFunc(withType, func(args []reflect.Value) []reflect.Value {
+			mu.Lock()
+			defer mu.Unlock()
+			args[0].Call([]reflect.Value{value})
+			return nil
 		})
 		return res
-	})
+	}).Interface()
+}
+
+// eagerFixtures returns a function depending on the values of the eager
+// fixtures, so invoking it creates them; nil if there are no eager fixtures.
+func (t *Tedi) eagerFixtures() interface{} {
+	var in []reflect.Type
+	seen := map[reflect.Type]bool{}
+	for _, f := range t.fixtures {
+		if !f.eager {
+			continue
+		}
+		for _, typ := range f.outputs() {
+			if !seen[typ] {
+				seen[typ] = true
+				in = append(in, typ)
+			}
+		}
+	}
+	if len(in) == 0 {
+		return nil
+	}
+	return reflect.MakeFunc(reflect.FuncOf(in, nil, false), func([]reflect.Value) []reflect.Value {
+		return nil
+	}).Interface()
+}
 
-	return onceFnValue.Interface()
+// preparedFixture is a registered fixture prepared to be provided to the
+// containers of tests.
+type preparedFixture struct {
+	fixture
+	// index of the fixture in the fixtures of the Tedi.
+	index int
+	// logName is the name of the function of the fixture, which fn may wrap;
+	// only set in verbose mode to log the construction time.
+	logName string
 }
 
-func (t *Tedi) createContainer(test *testing.T, testName string, testLabels ...string) (*dig.Container, *T, error) {
-	res := dig.New()
-	for _, fn := range t.fixtures {
-		if err := res.Provide(fn); err != nil {
+// prepareFixtures returns the fixtures for the containers of the subtests of
+// parent, or of root tests if parent is nil. The fixtures only provide the
+// interfaces they are preferred for and not the types overridden by parent.
+// Subtests resolve the test scoped fixtures and groups from the container of
+// the root test, so they are only prepared for root tests.
+func (t *Tedi) prepareFixtures(parent *T) []preparedFixture {
+	overridden := map[reflect.Type]bool{}
+	if parent != nil {
+		for _, o := range parent.overrides {
+			for _, typ := range o.outputs() {
+				overridden[typ] = true
+			}
+		}
+	}
+
+	priorities := t.asPriorities()
+	res := make([]preparedFixture, 0, len(t.fixtures))
+	for i, f := range t.fixtures {
+		if parent != nil && (f.testScoped || f.group != "") {
+			continue
+		}
+		var logName string
+		if t.verbose && !f.once {
+			logName = f.funcName()
+		}
+		f, ok := f.preferred(priorities).without(overridden)
+		if !ok {
+			continue
+		}
+		res = append(res, preparedFixture{fixture: f, index: i, logName: logName})
+	}
+	return res
+}
+
+func (t *Tedi) createContainer(test *testing.T, parent *T, testName string, testLabels ...string) (container, *T, error) {
+	// Overrides of the parent test take precedence over the fixtures.
+	var overrides []fixture
+	if parent != nil {
+		overrides = parent.overrides
+	}
+
+	// The containers of subtests are scopes of the container of their parent,
+	// so the test scoped fixtures are resolved from the container of the root
+	// test and the other fixtures provided again for every subtest. dig
+	// collects the values of a group from the scope and its parents, so groups
+	// are only provided to root tests like the test scoped fixtures. Subtests
+	// share the fixtures prepared for them with their siblings.
+	var res container
+	var fixtures []preparedFixture
+	scope := &testScope{}
+	if parent == nil {
+		// The fixtures are only checked for cycles once by the first Invoke
+		// instead of by every Provide, which walks the dependencies of the
+		// fixtures provided so far. The scopes of subtests defer it as well.
+		c := dig.New(dig.DeferAcyclicVerification())
+		if err := c.Provide(func() scopeRoot { return scopeRoot{} }); err != nil {
+			return nil, nil, err
+		}
+		res = c
+		fixtures = t.prepareFixtures(nil)
+	} else {
+		scope = parent.scope
+		scope.mu.Lock()
+		defer scope.mu.Unlock()
+		res = parent.container.Scope(testName)
+		fixtures = parent.preparedSubtestFixtures()
+	}
+	for _, f := range fixtures {
+		if f.logName != "" {
+			f.fn = timed(f.fn, f.logName, test.Logf)
+		}
+		if f.onceLog != nil {
+			f.fn = f.onceLog.by(f.fn, test.Logf)
+		}
+		if err := f.provide(res); err != nil {
+			return nil, nil, t.duplicateFixture(f.index, err)
+		}
+	}
+	for _, o := range overrides {
+		if err := o.provide(res); err != nil {
 			return nil, nil, err
 		}
 	}
@@ -71,9 +789,179 @@ func (t *Tedi) createContainer(test *testing.T, testName string, testLabels ...s
 		return nil, nil, err
 	}
 
+	// Fixtures serving benchmarks as well depend on testing.TB. Fixtures cannot
+	// produce a testing.TB themselves, so this is the only provider of it.
+	if err := res.Provide(func() testing.TB { return test }); err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := t.createContext(test, parent, testName)
+	if err := res.Provide(func() context.Context { return ctx }); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
 	tediTest := t.createT(test, res, testName, testLabels...)
+	tediTest.ctx, tediTest.cancel = ctx, cancel
+	tediTest.overrides = overrides
+	tediTest.scope = scope
+	if parent == nil {
+		tediTest.semaphores = t.semaphores(testLabels)
+		tediTest.captured = t.captures.Has(testName)
+	} else {
+		tediTest.captured = parent.captured
+	}
 	if err := res.Provide(func() *T { return tediTest }); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	// The builtins below are replaced by the fixtures and overrides producing
+	// their types.
+	replaced := t.fixtureTypes(overrides)
+	provideBuiltin := func(fn interface{}) error {
+		if replaced[reflect.TypeOf(fn).Out(0)] {
+			return nil
+		}
+		return res.Provide(fn)
+	}
+
+	if err := provideBuiltin(tediTest.Info); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	// Every test gets its own source seeded with the seed of the run, so the
+	// values do not depend on the order the tests run in.
+	if err := provideBuiltin(func() *rand.Rand {
+		tediTest.seeded = true
+		return rand.New(rand.NewSource(t.seed))
+	}); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	if err := provideBuiltin(func() *Logger { return &Logger{test: test} }); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	// The assertions are bound to the test of the container, so subtests get
+	// assertions failing the subtest.
+	if err := provideBuiltin(func() *assert.Assertions { return assert.New(test) }); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if err := provideBuiltin(func() *require.Assertions { return require.New(test) }); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	// The directory is only created if the test or a fixture depends on it.
+	if err := provideBuiltin(func() TempDir { return TempDir(test.TempDir()) }); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	// Fixtures can read the configuration of the run, like the labels to run,
+	// but registering anything while tests run takes no effect.
+	if err := provideBuiltin(func() *Tedi { return t }); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	// Cleanups are after test hooks registered last, so they are called first.
+	if err := provideBuiltin(func() Cleanup { return func(fn func()) { tediTest.AfterTest(fn) } }); err != nil {
+		cancel()
 		return nil, nil, err
 	}
 	return res, tediTest, nil
 }
+
+// createPackageContainer creates the container used by the BeforeAll and
+// AfterAll hooks. It only holds the once fixtures as these are shared with the
+// tests, and a *rand.Rand seeded like the ones of the tests.
+func (t *Tedi) createPackageContainer() (*dig.Container, error) {
+	res := dig.New()
+	priorities := t.asPriorities()
+	randReplaced := false
+	for _, f := range t.onceFixtures {
+		if err := f.preferred(priorities).provide(res); err != nil {
+			return nil, err
+		}
+		for _, typ := range f.outputs() {
+			randReplaced = randReplaced || typ == reflect.TypeOf((*rand.Rand)(nil))
+		}
+	}
+	// Like in the containers of the tests, a once fixture producing a
+	// *rand.Rand replaces the seeded one.
+	if randReplaced {
+		return res, nil
+	}
+	if err := res.Provide(func() *rand.Rand { return rand.New(rand.NewSource(t.seed)) }); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// fixtureTypes returns the types produced by the fixtures and the given
+// overrides.
+func (t *Tedi) fixtureTypes(overrides []fixture) map[reflect.Type]bool {
+	res := map[reflect.Type]bool{}
+	for _, f := range t.fixtures {
+		for _, typ := range f.outputs() {
+			res[typ] = true
+		}
+	}
+	for _, o := range overrides {
+		for _, typ := range o.outputs() {
+			res[typ] = true
+		}
+	}
+	return res
+}
+
+// deadlineGrace returns the grace period, which is at most half of the timeout.
+func (t *Tedi) deadlineGrace() time.Duration {
+	if t.timeout > 0 && t.grace > t.timeout/2 {
+		return t.timeout / 2
+	}
+	return t.grace
+}
+
+func invokeAll(c *dig.Container, fns []interface{}) error {
+	for _, fn := range fns {
+		if err := c.Invoke(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createContext creates the context injected into a test. The deadline of the
+// context is the earliest of the test's timeout, the deadline of the parent
+// test and the deadline given by the -timeout flag of go test less the grace
+// period, so the cleanups of the test can run before go test panics.
+func (t *Tedi) createContext(test *testing.T, parent *T, testName string) (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if parent != nil {
+		ctx = parent.ctx
+	}
+
+	deadline, ok := test.Deadline()
+	if ok {
+		deadline = deadline.Add(-t.deadlineGrace())
+	}
+	if parent == nil {
+		if timeout, hasTimeout := t.timeouts[testName]; hasTimeout {
+			if timeoutDeadline := time.Now().Add(timeout); !ok || timeoutDeadline.Before(deadline) {
+				deadline, ok = timeoutDeadline, true
+			}
+		}
+	}
+
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
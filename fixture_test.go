@@ -0,0 +1,715 @@
+package tedi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/dig"
+)
+
+func Test_contextDeadline(t *testing.T) {
+	tedi := newTedi(&testing.M{}, "unit")
+	tedi.TestLabel("unit")
+	tedi.Timeout("withTimeout", time.Minute)
+
+	start := time.Now()
+	tedi.wrapTest(nil, "withTimeout", func(t *T, ctx context.Context) {
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.WithinDuration(t, start.Add(time.Minute), deadline, time.Second)
+
+		t.Run("sub", func(ctx context.Context) {
+			subDeadline, ok := ctx.Deadline()
+			assert.True(t, ok)
+			assert.Equal(t, deadline, subDeadline)
+		})
+	})(t)
+}
+
+func Test_contextParallelSubtest(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+
+	var subErr error
+	var rootCtx context.Context
+	t.Run("root", tedi.wrapTest(nil, "root", func(t *T, ctx context.Context) {
+		rootCtx = ctx
+		t.Run("parallel", func(t *T, ctx context.Context) {
+			t.Parallel()
+			subErr = ctx.Err()
+		})
+	}))
+
+	assert.NoError(t, subErr, "the context of a parallel subtest is not cancelled before it ran")
+	assert.Error(t, rootCtx.Err(), "the context is cancelled once the test and its subtests finished")
+}
+
+func Test_contextDeadlineGrace(t *testing.T) {
+	testDeadline, ok := t.Deadline()
+	if !ok {
+		t.Skip("go test runs without -timeout")
+	}
+
+	tedi := newTedi(&testing.M{})
+	tedi.timeout, tedi.grace = time.Hour, time.Minute
+	tedi.wrapTest(nil, "grace", func(ctx context.Context) {
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.Equal(t, testDeadline.Add(-time.Minute), deadline)
+	})(t)
+
+	// The grace is at most half of the timeout.
+	tedi.timeout = time.Minute
+	tedi.wrapTest(nil, "short", func(ctx context.Context) {
+		deadline, _ := ctx.Deadline()
+		assert.Equal(t, testDeadline.Add(-30*time.Second), deadline)
+	})(t)
+}
+
+type handler interface {
+	Name() string
+}
+
+type namedHandler string
+
+func (h namedHandler) Name() string {
+	return string(h)
+}
+
+func Test_Group(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		require.NoError(t, tedi.Fixture(func() handler { return namedHandler(name) }, Group("handlers")))
+	}
+
+	type handlers struct {
+		dig.In
+		Handlers []handler `group:"handlers"`
+	}
+
+	tedi.wrapTest(nil, "group", func(t *T, h handlers) {
+		var names []string
+		for _, handler := range h.Handlers {
+			names = append(names, handler.Name())
+		}
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, names)
+	})(t)
+}
+
+type tbLogger struct {
+	tb testing.TB
+}
+
+func Test_TestingTB(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(func(tb testing.TB) *tbLogger {
+		tb.Log("fixture using testing.TB")
+		return &tbLogger{tb: tb}
+	}))
+	assert.Equal(t, ErrFixtureCannotProduceTestingTB, tedi.Fixture(func() testing.TB { return nil }))
+
+	tedi.wrapTest(nil, "tb", func(test *testing.T, l *tbLogger) {
+		assert.Equal(t, test, l.tb)
+	})(t)
+}
+
+type valueConfig struct {
+	url string
+}
+
+// valueTB implements testing.TB by embedding it.
+type valueTB struct {
+	testing.TB
+}
+
+func Test_Value(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	config := &valueConfig{url: "postgres://localhost"}
+	require.NoError(t, tedi.Value(config))
+	require.NoError(t, tedi.Value(3))
+	assert.Equal(t, ErrFixtureCannotProduceTestingTB, tedi.Value(valueTB{TB: t}))
+	assert.True(t, errors.Is(tedi.Value(t), ErrFixtureCannotProduceBuiltin))
+	assert.Equal(t, ErrValueCannotBeNil, tedi.Value(nil))
+
+	ran := false
+	tedi.wrapTest(nil, "value", func(c *valueConfig, n int) {
+		ran = true
+		assert.True(t, c == config, "test got another config than the value")
+		assert.Equal(t, 3, n)
+	})(t)
+	assert.True(t, ran)
+}
+
+type duplicateValue struct{}
+
+func newDuplicateValue() *duplicateValue { return &duplicateValue{} }
+
+func newOtherDuplicateValue() *duplicateValue { return &duplicateValue{} }
+
+func Test_DuplicateFixture(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(newDuplicateValue))
+	require.NoError(t, tedi.Fixture(newOtherDuplicateValue))
+
+	_, _, err := tedi.createContainer(t, nil, "duplicate")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrDuplicateFixture))
+	assert.Contains(t, err.Error(), "newDuplicateValue")
+	assert.Contains(t, err.Error(), "newOtherDuplicateValue")
+	assert.Contains(t, err.Error(), "*tedi.duplicateValue")
+
+	// Once fixtures and values are named by their function and type, not by
+	// the function created by reflection.
+	tedi = newTedi(&testing.M{})
+	require.NoError(t, tedi.OnceFixture(newDuplicateValue))
+	require.NoError(t, tedi.Value(&duplicateValue{}))
+	_, _, err = tedi.createContainer(t, nil, "duplicate")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrDuplicateFixture))
+	assert.Contains(t, err.Error(), "newDuplicateValue and Value(*tedi.duplicateValue)")
+	assert.NotContains(t, err.Error(), "makeFuncStub")
+}
+
+// testPair records the *testing.T and *T a fixture has been created with.
+type testPair struct {
+	test  *testing.T
+	tediT *T
+}
+
+func Test_TestingTAndT(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(func(test *testing.T, tediT *T) *testPair {
+		return &testPair{test: test, tediT: tediT}
+	}))
+
+	var pairs []*testPair
+	check := func(test *testing.T, tediT *T, p *testPair) {
+		assert.True(t, test == p.test, "fixture got another *testing.T than %s", test.Name())
+		assert.True(t, tediT == p.tediT, "fixture got another *T than %s", test.Name())
+		assert.True(t, test == tediT.T, "*T wraps another *testing.T than %s", test.Name())
+		pairs = append(pairs, p)
+	}
+
+	tedi.wrapTest(nil, "root", func(test *testing.T, tediT *T, p *testPair) {
+		check(test, tediT, p)
+		tediT.Run("sub", func(test *testing.T, tediT *T, p *testPair) {
+			check(test, tediT, p)
+			tediT.Run("nested", func(test *testing.T, tediT *T, p *testPair) {
+				check(test, tediT, p)
+			})
+		})
+	})(t)
+
+	require.Len(t, pairs, 3)
+	assert.False(t, pairs[0].test == pairs[1].test)
+	assert.False(t, pairs[1].test == pairs[2].test)
+	assert.Equal(t, "Test_TestingTAndT/sub/nested", pairs[2].test.Name())
+}
+
+type onceValue struct {
+	n int
+}
+
+func Test_OnceFixtureCount(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	calls := 0
+	require.NoError(t, tedi.OnceFixture(func() *onceValue {
+		calls++
+		return &onceValue{n: calls}
+	}))
+
+	var values []int
+	record := func(v *onceValue) {
+		values = append(values, v.n)
+	}
+	testA := tedi.wrapTest(nil, "a", record)
+	testB := tedi.wrapTest(nil, "b", record)
+
+	// Simulate go test -count=2.
+	for i := 0; i < 2; i++ {
+		testA(t)
+		testB(t)
+	}
+	assert.Equal(t, []int{1, 1, 2, 2}, values)
+}
+
+func Test_OnceFixturePerLabel(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	calls := 0
+	require.NoError(t, tedi.OnceFixture(func() *onceValue {
+		calls++
+		return &onceValue{n: calls}
+	}, PerLabel()))
+
+	values := map[string][]int{}
+	for _, test := range []struct {
+		name   string
+		labels []string
+	}{
+		{"unit", []string{"unit"}},
+		{"integration", []string{"integration"}},
+		{"unitAgain", []string{"unit"}},
+		{"both", []string{"unit", "integration"}},
+		{"bothReversed", []string{"integration", "unit"}},
+	} {
+		tedi.wrapTest(nil, test.name, func(v *onceValue) {
+			values[test.name] = append(values[test.name], v.n)
+		}, test.labels...)(t)
+	}
+	assert.Equal(t, map[string][]int{
+		"unit":         {1},
+		"integration":  {2},
+		"unitAgain":    {1},
+		"both":         {3},
+		"bothReversed": {3},
+	}, values)
+}
+
+type session struct {
+	test string
+}
+
+func Test_TestScope(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(func(info TestInfo) *session { return &session{test: info.Name} }, TestScope()))
+	require.NoError(t, tedi.Fixture(func() *counter { return &counter{} }))
+
+	var sessions []*session
+	var counters []*counter
+	record := func(s *session, c *counter) {
+		sessions = append(sessions, s)
+		counters = append(counters, c)
+	}
+	root := func(t *T, s *session, c *counter) {
+		record(s, c)
+		t.Run("sub", func(t *T, s *session, c *counter) {
+			record(s, c)
+			t.Run("nested", record)
+		})
+	}
+	tedi.wrapTest(nil, "first", root)(t)
+	tedi.wrapTest(nil, "second", root)(t)
+
+	require.Len(t, sessions, 6)
+	assert.True(t, sessions[0] == sessions[1] && sessions[1] == sessions[2], "subtests share the session of their root test")
+	assert.False(t, sessions[0] == sessions[3], "root tests get their own session")
+	assert.True(t, sessions[3] == sessions[4] && sessions[4] == sessions[5])
+	assert.False(t, counters[0] == counters[1], "other fixtures are created for every subtest")
+}
+
+// sessionUser is created for every subtest from the session of the root test.
+type sessionUser struct {
+	session *session
+}
+
+func Test_TestScopeFallThrough(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(func(info TestInfo) *session { return &session{test: info.Name} }, TestScope()))
+	require.NoError(t, tedi.Fixture(func(s *session) *sessionUser { return &sessionUser{session: s} }))
+
+	var mu sync.Mutex
+	var users []*sessionUser
+	t.Run("root", tedi.wrapTest(nil, "root", func(t *T) {
+		for _, name := range []string{"first", "second"} {
+			t.Run(name, func(t *T) {
+				t.Parallel()
+				t.Run("nested", func(u *sessionUser) {
+					mu.Lock()
+					defer mu.Unlock()
+					users = append(users, u)
+				})
+			})
+		}
+	}))
+
+	require.Len(t, users, 2)
+	assert.False(t, users[0] == users[1], "subtests get their own values of other fixtures")
+	assert.True(t, users[0].session == users[1].session, "subtests share the session of their root test")
+	assert.Equal(t, t.Name()+"/root", users[0].session.test, "the session is created in the container of the root test")
+}
+
+// pool is a once fixture a test scoped fixture depends on.
+type pool struct {
+	name string
+}
+
+// pooledSession is a test scoped fixture depending on the once fixture pool.
+type pooledSession struct {
+	pool *pool
+}
+
+func Test_TestScopeOnceDependency(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	pools := 0
+	require.NoError(t, tedi.OnceFixture(func() *pool {
+		pools++
+		return &pool{name: "shared"}
+	}))
+	require.NoError(t, tedi.Fixture(func(p *pool) *pooledSession { return &pooledSession{pool: p} }, TestScope()))
+
+	var sessions []*pooledSession
+	var subPool *pool
+	tedi.wrapTest(nil, "root", func(t *T, p *pool) {
+		t.Run("sub", func(t *T, p *pool) {
+			subPool = p
+			t.Override(func() *pool { return &pool{name: "override"} })
+			t.Run("nested", func(s *pooledSession, p *pool) {
+				sessions = append(sessions, s)
+				assert.Equal(t, "override", p.name, "the subtest gets the override")
+			})
+		})
+		t.Run("other", func(s *pooledSession) {
+			sessions = append(sessions, s)
+		})
+	})(t)
+
+	assert.Equal(t, 1, pools)
+	require.Len(t, sessions, 2)
+	assert.True(t, sessions[0] == sessions[1], "subtests share the session of their root test")
+	assert.True(t, sessions[0].pool == subPool, "the session gets the shared once value")
+	assert.Equal(t, "shared", sessions[0].pool.name, "overrides of a subtest do not apply to the session")
+}
+
+// server is a fixture with the side effect of recording it was started.
+type server struct{}
+
+func Test_Eager(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	var calls []string
+	require.NoError(t, tedi.Fixture(func(info TestInfo) *server {
+		calls = append(calls, "server "+info.Name)
+		return &server{}
+	}, Eager()))
+	tedi.BeforeTest(func(info TestInfo) {
+		calls = append(calls, "before "+info.Name)
+	})
+
+	tedi.wrapTest(nil, "unreferenced", func(t *T) {
+		t.Run("sub", func() {})
+	})(t)
+	assert.Equal(t, []string{
+		"server " + t.Name(),
+		"before " + t.Name(),
+		"server " + t.Name() + "/sub",
+		"before " + t.Name() + "/sub",
+	}, calls, "eager fixtures are created for every test and subtest before the before hooks")
+}
+
+func Test_As(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	buf := &bytes.Buffer{}
+	require.NoError(t, tedi.Fixture(func() (*bytes.Buffer, error) { return buf, nil }, As(new(io.Writer), new(io.Reader))))
+
+	tedi.wrapTest(nil, "as", func(t *T, w io.Writer, r io.Reader, b *bytes.Buffer) {
+		assert.Equal(t, buf, w)
+		assert.Equal(t, buf, r)
+		assert.Equal(t, buf, b)
+	})(t)
+
+	for _, opts := range [][]FixtureOption{
+		{As(io.Writer(nil))},
+		{As(new(*bytes.Buffer))},
+		{As(new(handler))},
+		{As(new(io.Writer)), Group("buffers")},
+	} {
+		err := tedi.Fixture(func() *bytes.Buffer { return buf }, opts...)
+		assert.True(t, errors.Is(err, ErrFixtureAs), "%v", err)
+	}
+}
+
+func Test_Priority(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	file, buf := &os.File{}, &bytes.Buffer{}
+	require.NoError(t, tedi.Fixture(func() *os.File { return file }, As(new(io.Writer))))
+	require.NoError(t, tedi.Fixture(func() *bytes.Buffer { return buf }, As(new(io.Writer)), Priority(10)))
+
+	ran := false
+	tedi.wrapTest(nil, "priority", func(w io.Writer, f *os.File) {
+		ran = true
+		assert.True(t, w == io.Writer(buf), "the fixture with the higher priority does not provide io.Writer")
+		assert.True(t, f == file)
+	})(t)
+	assert.True(t, ran)
+	tedi.Test("priority", func(w io.Writer) {})
+	assert.NoError(t, tedi.Validate(), "only the fixture with the higher priority provides io.Writer")
+
+	require.NoError(t, tedi.Fixture(func() *strings.Builder { return &strings.Builder{} }, As(new(io.Writer)), Priority(10)))
+	_, _, err := tedi.createContainer(t, nil, "tie")
+	assert.True(t, errors.Is(err, ErrDuplicateFixture), "%v", err)
+	err = tedi.Validate()
+	assert.True(t, errors.Is(err, ErrDuplicateFixture), "%v", err)
+}
+
+type counter struct {
+	n int
+}
+
+func Test_Locked(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.OnceFixture(Locked(func() (*counter, error) { return &counter{}, nil })))
+	assert.Equal(t, ErrFixtureCannotBeLocked, tedi.Fixture(Locked(func() (*counter, *counter) { return nil, nil })))
+	assert.Equal(t, ErrFixtureCannotBeLocked, tedi.Fixture(Locked(func() error { return nil })))
+	assert.Equal(t, ErrFixtureMustBeFunction, tedi.Fixture(Locked(counter{})))
+
+	// Run with -race to detect unguarded access.
+	const n = 20
+	t.Run("parallel", func(test *testing.T) {
+		for i := 0; i < n; i++ {
+			name := fmt.Sprint("increment", i)
+			test.Run(name, tedi.wrapTest(nil, name, func(t *T, withCounter func(func(*counter))) {
+				t.Parallel()
+				withCounter(func(c *counter) {
+					c.n++
+				})
+			}))
+		}
+	})
+
+	tedi.wrapTest(nil, "check", func(withCounter func(func(*counter))) {
+		withCounter(func(c *counter) {
+			assert.Equal(t, n, c.n)
+		})
+	})(t)
+}
+
+type database interface {
+	Kind() string
+}
+
+type mockDatabase struct{}
+
+func (mockDatabase) Kind() string { return "mock" }
+
+type realDatabase struct{}
+
+func (realDatabase) Kind() string { return "real" }
+
+func Test_TestInfo(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(func(info TestInfo) database {
+		if info.HasLabel("integration") {
+			return realDatabase{}
+		}
+		return mockDatabase{}
+	}))
+
+	tedi.wrapTest(nil, "unitTest", func(t *T, info TestInfo, db database) {
+		assert.Equal(t, TestInfo{Name: t.Name(), Labels: []string{"unit"}}, info)
+		assert.Equal(t, "mock", db.Kind())
+	}, "unit")(t)
+
+	tedi.wrapTest(nil, "integrationTest", func(t *T, db database) {
+		assert.Equal(t, "real", db.Kind())
+		t.Run("sub", func(t *T, info TestInfo, db database) {
+			assert.Equal(t, t.Name(), info.Name)
+			assert.Equal(t, "real", db.Kind())
+		})
+	}, "integration")(t)
+}
+
+type tempFile struct {
+	closed bool
+}
+
+func Test_Cleanup(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	var events []string
+	var file *tempFile
+	require.NoError(t, tedi.Fixture(func(cleanup Cleanup) *tempFile {
+		file = &tempFile{}
+		cleanup(func() {
+			file.closed = true
+			events = append(events, "close file")
+		})
+		cleanup(func() { events = append(events, "last registered") })
+		return file
+	}))
+	tedi.AfterTest(func() { events = append(events, "after test") })
+
+	tedi.wrapTest(nil, "cleanup", func(f *tempFile) {
+		assert.False(t, f.closed)
+		events = append(events, "test")
+	})(t)
+
+	assert.True(t, file.closed)
+	assert.Equal(t, []string{"test", "last registered", "close file", "after test"}, events)
+}
+
+func Test_Rand(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	tedi.seed = 42
+
+	var values []int64
+	for _, name := range []string{"first", "second"} {
+		tedi.wrapTest(nil, name, func(r *rand.Rand) {
+			values = append(values, r.Int63())
+		})(t)
+	}
+	assert.Equal(t, []int64{rand.New(rand.NewSource(42)).Int63(), rand.New(rand.NewSource(42)).Int63()}, values)
+}
+
+func Test_FixtureBuiltins(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	for _, tc := range []struct {
+		fn  interface{}
+		err string
+	}{
+		{func() *testing.T { return nil }, "*testing.T"},
+		{func() (*T, error) { return nil, nil }, "*tedi.T"},
+		{func() context.Context { return context.Background() }, "context.Context"},
+	} {
+		err := tedi.Fixture(tc.fn)
+		assert.True(t, errors.Is(err, ErrFixtureCannotProduceBuiltin), "fixture producing %s: %v", tc.err, err)
+		assert.EqualError(t, err, ErrFixtureCannotProduceBuiltin.Error()+": "+tc.err)
+	}
+	assert.Equal(t, ErrFixtureCannotProduceTestingTB, tedi.Fixture(func() testing.TB { return nil }))
+	assert.Equal(t, ErrFixtureCannotProduceTestingTB, tedi.Fixture(func() (*counter, *testing.B) { return nil, nil }))
+	assert.Empty(t, tedi.fixtures)
+
+	type customContext struct {
+		context.Context
+	}
+	assert.NoError(t, tedi.Fixture(func() *customContext { return &customContext{context.Background()} }))
+}
+
+func Test_FixtureReplacesBuiltin(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	tedi.seed = 42
+	source := rand.New(rand.NewSource(7))
+	assertions := assert.New(t)
+	require.NoError(t, tedi.OnceFixture(func() *rand.Rand { return source }))
+	require.NoError(t, tedi.Fixture(func() *assert.Assertions { return assertions }))
+	tedi.Test("replaced", func(r *rand.Rand, a *assert.Assertions, logger *Logger) {})
+	require.NoError(t, tedi.Validate())
+
+	called := false
+	tedi.wrapTest(nil, "replaced", func(r *rand.Rand, a *assert.Assertions, logger *Logger) {
+		called = true
+		assert.Same(t, source, r)
+		assert.Same(t, assertions, a)
+		assert.NotNil(t, logger)
+	})(t)
+	assert.True(t, called)
+
+	c, err := tedi.createPackageContainer()
+	require.NoError(t, err)
+	require.NoError(t, c.Invoke(func(r *rand.Rand) {
+		assert.Same(t, source, r)
+	}))
+}
+
+// runLabels are the labels to run read by a fixture from the injected *Tedi.
+type runLabels []string
+
+func Test_InjectTedi(t *testing.T) {
+	tedi := newTedi(&testing.M{}, "unit", "integration")
+	require.NoError(t, tedi.Fixture(func(td *Tedi) runLabels { return td.SelectedLabels() }))
+
+	ran := false
+	tedi.wrapTest(nil, "labels", func(labels runLabels, td *Tedi) {
+		ran = true
+		assert.Equal(t, runLabels{"integration", "unit"}, labels)
+		assert.True(t, td == tedi, "test got another *Tedi than the one running it")
+		assert.Equal(t, ErrFixtureDuringTest, td.Fixture(func() int { return 1 }))
+	})(t)
+	assert.True(t, ran)
+	assert.NoError(t, tedi.Fixture(func() int { return 1 }))
+}
+
+// tempFileFixture is a file created in the temporary directory of the test.
+type tempFileFixture string
+
+func Test_TempDir(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(func(dir TempDir) (tempFileFixture, error) {
+		file := filepath.Join(string(dir), "fixture")
+		return tempFileFixture(file), ioutil.WriteFile(file, nil, 0644)
+	}))
+
+	var dirs []TempDir
+	test := func(t *T, dir TempDir, file tempFileFixture) {
+		assert.DirExists(t, string(dir))
+		assert.Equal(t, filepath.Join(string(dir), "fixture"), string(file), "fixtures get the directory of the test")
+		dirs = append(dirs, dir)
+		t.Run("sub", func(sub TempDir) {
+			assert.DirExists(t, string(sub))
+			dirs = append(dirs, sub)
+		})
+	}
+	t.Run("first", tedi.wrapTest(nil, "first", test))
+	t.Run("second", tedi.wrapTest(nil, "second", test))
+
+	require.Len(t, dirs, 4)
+	for i, dir := range dirs {
+		for _, other := range dirs[i+1:] {
+			assert.NotEqual(t, dir, other)
+		}
+		_, err := os.Stat(string(dir))
+		assert.True(t, os.IsNotExist(err), "%s is removed after the test", dir)
+	}
+}
+
+type usedFixture struct{}
+
+func newUsedFixture() *usedFixture {
+	return &usedFixture{}
+}
+
+type unusedFixture struct{}
+
+func newUnusedFixture() *unusedFixture {
+	return &unusedFixture{}
+}
+
+func Test_verboseFixtureTiming(t *testing.T) {
+	if !isolate(t) {
+		return
+	}
+
+	tedi := newTedi(&testing.M{})
+	tedi.verbose = true
+	require.NoError(t, tedi.Fixture(newUsedFixture))
+	require.NoError(t, tedi.Fixture(newUnusedFixture))
+
+	// The test fails, so its log is printed without -v as well.
+	out := captureStdout(t, func() {
+		runTestsOnce(t, []testing.InternalTest{
+			{Name: "timed", F: tedi.wrapTest(nil, "timed", func(t *testing.T, f *usedFixture) { t.Fail() })},
+		})
+	})
+	assert.Regexp(t, `Fixture github.com/jstroem/tedi.newUsedFixture constructed in \d`, out)
+	assert.NotContains(t, out, "newUnusedFixture")
+}
+
+func Test_verboseOnceFixtureTiming(t *testing.T) {
+	if !isolate(t) {
+		return
+	}
+
+	tedi := newTedi(&testing.M{})
+	tedi.verbose = true
+	require.NoError(t, tedi.OnceFixture(newUsedFixture))
+
+	out := captureStdout(t, func() {
+		runTestsOnce(t, []testing.InternalTest{
+			{Name: "first", F: tedi.wrapTest(nil, "first", func(t *testing.T, f *usedFixture) { t.Fail() })},
+			{Name: "second", F: tedi.wrapTest(nil, "second", func(t *testing.T, f *usedFixture) { t.Fail() })},
+		})
+	})
+	assert.Regexp(t, `Fixture github.com/jstroem/tedi.newUsedFixture constructed in \d`, out)
+	assert.Equal(t, 1, strings.Count(out, "constructed"), "only the first call constructs the value")
+	assert.NotContains(t, out, "tedi: Fixture", "the test constructing the value logs it")
+}
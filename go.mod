@@ -1,10 +1,17 @@
 module github.com/jstroem/tedi
 
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/stretchr/testify v1.3.0
-	go.uber.org/dig v1.7.0
+	github.com/fsnotify/fsnotify v1.5.4
+	github.com/stretchr/testify v1.8.2
+	go.uber.org/dig v1.15.0
 	golang.org/x/tools v0.0.0-20191101200257-8dbcdeb83d3f
 )
 
-go 1.13
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+go 1.17
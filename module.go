@@ -0,0 +1,59 @@
+package tedi
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var (
+	// ErrModuleDisabled returned when a fixture of a disabled module is requested
+	ErrModuleDisabled = errors.New("module is disabled")
+
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Module registers a group of fixtures under a name. The fixtures are only
+// registered if the module is enabled by the -modules flag. Tests depending on
+// a fixture of a disabled module fails with ErrModuleDisabled.
+func (t *Tedi) Module(name string, register func(*Tedi)) {
+	if t.modules == nil || t.modules.Has(name) {
+		register(t)
+		return
+	}
+
+	disabled := newTedi(&testing.M{})
+	register(disabled)
+	for _, f := range disabled.fixtures {
+		f.fn = disabledFixture(name, f.fn)
+		// Only the tests depending on the fixture fail, not every test
+		// creating the values of the eager fixtures.
+		f.eager = false
+		t.fixtures = append(t.fixtures, f)
+	}
+}
+
+// disabledFixture creates a fixture producing the same types as fn which
+// always fails.
+func disabledFixture(name string, fn interface{}) interface{} {
+	fnType := reflect.TypeOf(fn)
+
+	var out []reflect.Type
+	for i := 0; i < fnType.NumOut(); i++ {
+		if fnType.Out(i) != errorType {
+			out = append(out, fnType.Out(i))
+		}
+	}
+	out = append(out, errorType)
+
+	err := fmt.Errorf("module %q: %w", name, ErrModuleDisabled)
+	return reflect.MakeFunc(reflect.FuncOf(nil, out, false), func([]reflect.Value) []reflect.Value {
+		res := make([]reflect.Value, len(out))
+		for i := range out[:len(out)-1] {
+			res[i] = reflect.Zero(out[i])
+		}
+		res[len(out)-1] = reflect.ValueOf(&err).Elem()
+		return res
+	}).Interface()
+}
@@ -0,0 +1,54 @@
+package tedi
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/dig"
+)
+
+type moduleValue struct{}
+
+func Test_Module(t *testing.T) {
+	registerModule := func(t *Tedi) {
+		t.Fixture(func() *moduleValue { return &moduleValue{} })
+	}
+
+	enabled := newTedi(&testing.M{})
+	enabled.modules = newStringSet("db")
+	enabled.Module("db", registerModule)
+	c, _, err := enabled.createContainer(t, nil, "enabled")
+	require.NoError(t, err)
+	assert.NoError(t, c.Invoke(func(v *moduleValue) {}))
+
+	disabled := newTedi(&testing.M{})
+	disabled.modules = newStringSet("other")
+	disabled.Module("db", registerModule)
+	disabled.Fixture(func(v *moduleValue) string { return "depends on db" })
+	c, _, err = disabled.createContainer(t, nil, "disabled")
+	require.NoError(t, err)
+
+	err = c.Invoke(func(v *moduleValue) {})
+	assert.True(t, errors.Is(dig.RootCause(err), ErrModuleDisabled))
+	assert.Contains(t, err.Error(), `module "db"`)
+
+	err = c.Invoke(func(s string) {})
+	assert.Contains(t, err.Error(), `module "db"`)
+}
+
+func Test_ModuleEager(t *testing.T) {
+	disabled := newTedi(&testing.M{})
+	disabled.modules = newStringSet("other")
+	disabled.Module("db", func(t *Tedi) {
+		t.Fixture(func() *moduleValue { return &moduleValue{} }, Eager())
+	})
+
+	ran := false
+	ok := runTestsOnce(t, []testing.InternalTest{
+		{Name: "unrelated", F: disabled.wrapTest(nil, "unrelated", func() { ran = true })},
+	})
+	assert.True(t, ok, "eager fixtures of disabled modules are not created")
+	assert.True(t, ran)
+}
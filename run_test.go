@@ -0,0 +1,264 @@
+package tedi
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_confirmed(t *testing.T) {
+	tedi := newTedi(&testing.M{}, "integration")
+	tedi.TestLabel("integration")
+	tedi.Test("dropDatabase", func() {}, "integration")
+	tedi.Test("unitTest", func() {}, "unit")
+
+	var out bytes.Buffer
+	assert.False(t, tedi.confirmed(strings.NewReader(""), &out))
+	assert.Contains(t, out.String(), "dropDatabase")
+	assert.NotContains(t, out.String(), "unitTest")
+
+	assert.False(t, tedi.confirmed(strings.NewReader("n\n"), &out))
+	assert.True(t, tedi.confirmed(strings.NewReader("y\n"), &out))
+
+	tedi.yes = true
+	assert.True(t, tedi.confirmed(strings.NewReader(""), &out))
+}
+
+func Test_setRunLabels(t *testing.T) {
+	m := &testing.M{}
+	tedi := newTedi(m, "unit")
+	tedi.TestLabel("unit")
+	tedi.TestLabel("integration")
+
+	var ran []string
+	record := func(name string) func() {
+		return func() {
+			ran = append(ran, name)
+		}
+	}
+	tedi.Test("unitTest", record("unitTest"), "unit")
+	tedi.Test("integrationTest", record("integrationTest"), "integration")
+	tedi.Test("bothTest", record("bothTest"), "unit", "integration")
+	assert.Equal(t, []string{"unitTest", "bothTest"}, tedi.tests)
+
+	tedi.setRunLabels("integration")
+	assert.Equal(t, []string{"integrationTest", "bothTest"}, tedi.tests)
+
+	// Run the tests registered in m, like m.Run.
+	registered := reflect.ValueOf(m).Elem().FieldByName("tests")
+	var tests []testing.InternalTest
+	for i := 0; i < registered.Len(); i++ {
+		test := registered.Index(i)
+		tests = append(tests, testing.InternalTest{
+			Name: test.FieldByName("Name").String(),
+			F:    *(*func(*testing.T))(unsafe.Pointer(test.FieldByName("F").UnsafeAddr())),
+		})
+	}
+	assert.True(t, runTestsOnce(t, tests))
+	assert.Equal(t, []string{"integrationTest", "bothTest"}, ran)
+}
+
+func Test_shuffleTests(t *testing.T) {
+	order := func(seed int64) []string {
+		tedi := newTedi(&testing.M{}, "unit")
+		tedi.TestLabel("unit")
+		for i := 0; i < 10; i++ {
+			tedi.Test(fmt.Sprintf("test%d", i), func() {}, "unit")
+		}
+		tedi.Test("integrationTest", func() {}, "integration")
+		tedi.shuffleTests(seed)
+		return tedi.Tests()
+	}
+
+	first := order(1)
+	assert.Len(t, first, 10)
+	assert.NotContains(t, first, "integrationTest")
+	assert.Equal(t, first, order(1), "the same seed gives the same order")
+	assert.NotEqual(t, first, order(2), "another seed gives another order")
+	assert.ElementsMatch(t, first, order(2))
+}
+
+func Test_sortByWeight(t *testing.T) {
+	tedi := newTedi(&testing.M{}, "unit")
+	tedi.TestLabel("unit")
+	tedi.Test("light", func() {}, "unit")
+	tedi.Test("heavy", func() {}, "unit")
+	tedi.Test("default", func() {}, "unit")
+	tedi.Test("heavier", func() {}, "unit")
+	tedi.Example(testing.InternalExample{Name: "example", F: func() {}}, "unit")
+	tedi.Weight("light", 1)
+	tedi.Weight("heavy", 5)
+	tedi.Weight("heavier", 10)
+
+	tedi.sortByWeight()
+	assert.Equal(t, []string{"heavier", "heavy", "light", "default", "example"}, tedi.Tests())
+}
+
+func Test_parseShuffle(t *testing.T) {
+	shuffle, _, err := parseShuffle("off")
+	assert.NoError(t, err)
+	assert.False(t, shuffle)
+
+	shuffle, _, err = parseShuffle("on")
+	assert.NoError(t, err)
+	assert.True(t, shuffle)
+
+	shuffle, seed, err := parseShuffle("42")
+	assert.NoError(t, err)
+	assert.True(t, shuffle)
+	assert.Equal(t, int64(42), seed)
+
+	_, _, err = parseShuffle("random")
+	assert.Error(t, err)
+}
+
+func Test_labelMatch(t *testing.T) {
+	for _, test := range []struct {
+		labelMatch string
+		runLabels  []string
+		expected   []string
+	}{
+		{labelMatchAny, []string{"integration"}, []string{"integrationTest", "slowIntegrationTest", "ExampleSlowIntegration"}},
+		{labelMatchAny, []string{"integration", "slow"}, []string{"integrationTest", "slowIntegrationTest", "slowUnitTest", "ExampleSlowIntegration"}},
+		{labelMatchAll, []string{"integration"}, []string{"integrationTest", "slowIntegrationTest", "ExampleSlowIntegration"}},
+		{labelMatchAll, []string{"integration", "slow"}, []string{"slowIntegrationTest", "ExampleSlowIntegration"}},
+		{labelMatchAll, []string{"integration", "slow", "unit"}, []string{}},
+	} {
+		tedi := newTedi(&testing.M{}, test.runLabels...)
+		tedi.labelMatch = test.labelMatch
+		tedi.TestLabel("unit")
+		tedi.TestLabel("integration")
+		tedi.TestLabel("slow")
+
+		tedi.Test("integrationTest", func() {}, "integration")
+		tedi.Test("slowIntegrationTest", func() {}, "integration", "slow")
+		tedi.Test("slowUnitTest", func() {}, "unit", "slow")
+		tedi.Example(testing.InternalExample{Name: "ExampleSlowIntegration", F: func() {}}, "integration", "slow")
+
+		assert.Equal(t, test.expected, tedi.Tests(), "-label-match=%s -labels %s", test.labelMatch, strings.Join(test.runLabels, ","))
+	}
+}
+
+func Test_concurrentRegistration(t *testing.T) {
+	m := &testing.M{}
+	var tedis []*Tedi
+	for i := 0; i < 2; i++ {
+		tedi := newTedi(m, "unit")
+		tedi.TestLabel("unit")
+		tedis = append(tedis, tedi)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			New(&testing.M{})
+			tedis[i%2].Test(fmt.Sprintf("test%d", i), func() {}, "unit")
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, tedis[0].tests, 5)
+	assert.Len(t, tedis[1].tests, 5)
+	assert.Equal(t, 10, reflect.ValueOf(m).Elem().FieldByName("tests").Len())
+}
+
+func Test_readRunLabels(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "labels.txt")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("integration, smoke\n\nregression\n"), 0644))
+
+	labels, err := readRunLabels("unit,@"+file, defaultLabelSep)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"unit", "integration", "smoke", "regression"}, labels)
+
+	tedi := newTedi(&testing.M{}, labels...)
+	tedi.TestLabel("unit")
+	tedi.TestLabel("smoke")
+	tedi.Test("unitTest", func() {}, "unit")
+	tedi.Test("smokeTest", func() {}, "smoke")
+	assert.Equal(t, []string{"unitTest", "smokeTest"}, tedi.tests)
+
+	labels, err = readRunLabels(" a, b c,,", defaultLabelSep)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, labels)
+
+	labels, err = readRunLabels("a;b c;;", ";")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, labels)
+
+	semicolonFile := filepath.Join(t.TempDir(), "semicolon.txt")
+	assert.NoError(t, ioutil.WriteFile(semicolonFile, []byte("integration;smoke\nregression\n"), 0644))
+	labels, err = readRunLabels("unit;@"+semicolonFile, ";")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"unit", "integration", "smoke", "regression"}, labels)
+
+	// The path of @file may contain spaces.
+	spaceFile := filepath.Join(t.TempDir(), "my labels.txt")
+	assert.NoError(t, ioutil.WriteFile(spaceFile, []byte("smoke\n"), 0644))
+	labels, err = readRunLabels("unit @"+spaceFile+",a b", defaultLabelSep)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"unit", "smoke", "a", "b"}, labels)
+
+	_, err = readRunLabels("@"+filepath.Join(t.TempDir(), "missing.txt"), defaultLabelSep)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "missing.txt")
+	}
+}
+
+func Test_warnUnknownLabels(t *testing.T) {
+	tedi := newTedi(&testing.M{}, "integraton", "unit", "zzz")
+	tedi.TestLabel("unit")
+	tedi.TestLabel("integration")
+	tedi.TestLabel("regression")
+
+	var out bytes.Buffer
+	tedi.warnUnknownLabels(&out)
+	assert.Equal(t, "tedi: warning: unknown label 'integraton', did you mean 'integration'?\n"+
+		"tedi: warning: unknown label 'zzz'\n", out.String())
+}
+
+func Test_warnUnknownHookLabels(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	tedi.TestLabel("unit")
+	tedi.TestLabel("integration")
+
+	fn := func() {}
+	var out bytes.Buffer
+	tedi.warnUnknownHookLabels(&out, newHook(fn, Labels("zzz", "unit", "integraton")))
+	tedi.warnUnknownHookLabels(&out, newHook(fn))
+	assert.Equal(t, "tedi: warning: unknown label 'integraton' of hook "+funcName(fn)+", did you mean 'integration'?\n"+
+		"tedi: warning: unknown label 'zzz' of hook "+funcName(fn)+"\n", out.String())
+}
+
+func Test_levenshtein(t *testing.T) {
+	assert.Equal(t, 0, levenshtein("unit", "unit"))
+	assert.Equal(t, 1, levenshtein("integraton", "integration"))
+	assert.Equal(t, 3, levenshtein("kitten", "sitting"))
+	assert.Equal(t, 4, levenshtein("", "unit"))
+}
+
+func Test_Introspection(t *testing.T) {
+	tedi := newTedi(&testing.M{}, "unit")
+	tedi.TestLabel("unit")
+	tedi.TestLabel("integration")
+
+	type database struct{}
+	assert.NoError(t, tedi.Fixture(func() (*database, error) { return &database{}, nil }))
+	assert.NoError(t, tedi.OnceFixture(func() (string, int) { return "name", 1 }))
+	tedi.Test("unitTest", func() {}, "unit")
+	tedi.Test("integrationTest", func() {}, "integration")
+
+	assert.Equal(t, []reflect.Type{reflect.TypeOf(&database{}), reflect.TypeOf(""), reflect.TypeOf(0)}, tedi.Fixtures())
+	assert.Equal(t, []string{"unitTest"}, tedi.Tests())
+	assert.Equal(t, []string{"integration", "unit"}, tedi.Labels())
+}
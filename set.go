@@ -56,3 +56,27 @@ func (s *stringSet) Intersect(b stringSet) stringSet {
 
 	return res
 }
+
+// Len returns the number of strings in the set. A nil set has length 0.
+func (s *stringSet) Len() int {
+	if s == nil {
+		return 0
+	}
+
+	return len(*s)
+}
+
+// Equal returns whether s and b hold the same strings. A nil set equals an
+// empty set, so sets are equal whenever they have no strings.
+func (s *stringSet) Equal(b stringSet) bool {
+	if s.Len() != b.Len() {
+		return false
+	}
+
+	for k := range b {
+		if !s.Has(k) {
+			return false
+		}
+	}
+	return true
+}
@@ -17,3 +17,30 @@ func Test_stringSet(t *testing.T) {
 	assert.True(t, s2.Has("a"))
 	assert.False(t, s2.Has("d"))
 }
+
+func Test_stringSetLen(t *testing.T) {
+	var nilSet stringSet
+	var nilPointer *stringSet
+	empty := newStringSet()
+	s := newStringSet("a", "b", "a")
+	assert.Equal(t, 0, nilSet.Len())
+	assert.Equal(t, 0, nilPointer.Len())
+	assert.Equal(t, 0, empty.Len())
+	assert.Equal(t, 2, s.Len())
+}
+
+func Test_stringSetEqual(t *testing.T) {
+	var nilSet stringSet
+	var nilPointer *stringSet
+	empty := newStringSet()
+	ab := newStringSet("a", "b")
+	assert.True(t, nilSet.Equal(nil))
+	assert.True(t, nilSet.Equal(stringSet{}), "a nil set equals an empty set")
+	assert.True(t, nilPointer.Equal(empty))
+	assert.True(t, empty.Equal(nilSet))
+	assert.True(t, ab.Equal(newStringSet("b", "a", "b")))
+	assert.False(t, ab.Equal(newStringSet("a")))
+	assert.False(t, ab.Equal(newStringSet("a", "c")))
+	assert.False(t, ab.Equal(nil))
+	assert.False(t, nilPointer.Equal(ab))
+}
@@ -1,55 +1,649 @@
 package tedi
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/jstroem/tedi/annotations"
 )
 
 var (
 	_tediTestLabels string
+	_tediModules    string
+	_tediFailFast   string
+	_tediLabelMatch string
+	_tediConfirm    bool
+	_tediYes        bool
+	_tediTrace      bool
+	_tediSeed       int64
+	_tediShuffle    string
+	_tediGrace      time.Duration
+	_tediLabelSep   string
+
+	// parseFlags parses the flags once, as New may be called concurrently.
+	parseFlags sync.Once
+	// registerMu guards the registration of tests and examples, which mutates
+	// the Tedi and its testing.M. It is shared by all Tedi, as several of them
+	// may register in the same testing.M.
+	registerMu sync.Mutex
 )
 
 func init() {
-	flag.StringVar(&_tediTestLabels, "labels", annotations.DefaultTestLabel, "Tedi test labels to run. Can be multiple with ',' as a seperator")
+	flag.StringVar(&_tediTestLabels, "labels", annotations.DefaultTestLabel, "Tedi test labels to run. Can be multiple with ',' or the -label-sep as a seperator, and @file reads the labels from a file")
+	flag.StringVar(&_tediModules, "modules", "", "Tedi modules to enable. Can be multiple with ',' or the -label-sep as a seperator; default all modules")
+	flag.StringVar(&_tediLabelMatch, "label-match", labelMatchAny, "Tedi runs the tests having any of the labels to run with 'any', or only the tests having all of them with 'all'")
+	flag.StringVar(&_tediFailFast, "failfast-labels", "", "Tedi skips the tests having one of the labels once a test with the label failed. Can be multiple with ',' or the -label-sep as a seperator")
+	flag.BoolVar(&_tediConfirm, "confirm", false, "Tedi prints the selected tests and asks for confirmation before running them")
+	flag.BoolVar(&_tediYes, "yes", false, "Tedi runs the selected tests without asking for confirmation")
+	flag.Int64Var(&_tediSeed, "tedi.seed", 0, "Tedi seeds the *rand.Rand of every test with the seed; default a random seed")
+	flag.StringVar(&_tediShuffle, "tedi.shuffle", "off", "Tedi runs the tests in a random order with 'on', or in the order given by the seed; 'off' runs them in the order they are registered")
+	flag.BoolVar(&_tediTrace, "tedi.trace", false, "Tedi prints the missing and provided fixture types when a test cannot be invoked")
+	flag.StringVar(&_tediLabelSep, "label-sep", defaultLabelSep, "Tedi separates the labels of -labels, -failfast-labels and -modules by the `character`, besides whitespace")
+	flag.DurationVar(&_tediGrace, "tedi.grace", defaultGrace, "Tedi ends the deadline of the injected contexts the `duration` before the -timeout of go test, at most half of it, leaving time for the cleanups")
 }
 
 // Tedi encapsulates tests for an entire package.
 type Tedi struct {
 	m *testing.M
 
-	runLabels   stringSet
-	labels      stringSet
-	fixtures    []interface{}
-	beforeTests []interface{}
-	afterTests  []interface{}
+	runLabels    stringSet
+	labels       stringSet
+	modules      stringSet
+	confirm      bool
+	yes          bool
+	trace        bool
+	verbose      bool
+	labelMatch   string // labelMatchAny or labelMatchAll
+	shuffle      bool   // run the tests in the order given by shuffleSeed
+	shuffleSeed  int64
+	seed         int64
+	tests        []string
+	fixtures     []fixture
+	onceFixtures []fixture
+	onceResets   []func()
+	beforeTests  []hook
+	afterTests   []hook
+	beforeAll    []interface{}
+	afterAll     []interface{}
+	timeouts     map[string]time.Duration
+	retries      map[string]int
+	weights      map[string]int
+	envs         map[string][]envVar
+	xfails       stringSet
+	captures     stringSet
+	// outputDir is the -outputdir of go test the output of captured tests is written to.
+	outputDir string
+	// failFastLabels are the labels whose tests are skipped once one of them
+	// failed, and failedLabels the ones of these with a failed test.
+	failFastLabels stringSet
+	failedMu       sync.Mutex
+	failedLabels   stringSet
+	// parallelism holds a semaphore for every label with limited parallelism.
+	parallelism map[string]chan struct{}
+	middleware  []func(next func(*testing.T)) func(*testing.T)
+	// onTestComplete are called with the result of every test.
+	onTestComplete []func(TestResult)
+
+	// timeout is the -timeout given to go test, and grace the time before it
+	// the deadline of the contexts ends.
+	timeout time.Duration
+	grace   time.Duration
+
+	// registrations register the tests and examples again when the labels to
+	// run change. addedTests and addedExamples are the number of tests and
+	// examples added to m.
+	registrations []registration
+	// registered are all tests given to Test, whatever their labels.
+	registered    []registeredTest
+	addedTests    int
+	addedExamples int
+
+	// compatErr is set if tests cannot be registered in m, in which case they
+	// are run by testing.RunTests and testing.RunExamples after m.Run, like
+	// they are if withoutUnsafe is set.
+	compatErr        error
+	withoutUnsafe    bool
+	fallbackTests    []testing.InternalTest
+	fallbackExamples []testing.InternalExample
+
+	// started holds the root tests started in the current -count iteration.
+	startedMu sync.Mutex
+	started   stringSet
+	// running is the number of running tests and subtests.
+	running int32
+}
+
+// Option configures a Tedi created by New.
+type Option func(*Tedi)
+
+// WithoutUnsafe registers the tests without adding them to the private fields
+// of testing.M, which relies on the unsafe package. The tests are instead run
+// after the tests of m as subtests of a single test named Tedi, so they are
+// reported and selected by -run as Tedi/<name>. The examples are run after
+// m.Run by testing.RunExamples.
+func WithoutUnsafe() Option {
+	return func(t *Tedi) {
+		t.withoutUnsafe = true
+	}
 }
 
 // New creates a new tedi test.
-func New(m *testing.M) *Tedi {
-	if !flag.Parsed() {
-		flag.Parse()
+func New(m *testing.M, opts ...Option) *Tedi {
+	parseFlags.Do(func() {
+		if !flag.Parsed() {
+			flag.Parse()
+		}
+	})
+
+	sep := _tediLabelSep
+	if utf8.RuneCountInString(sep) != 1 || unicode.IsSpace([]rune(sep)[0]) {
+		fmt.Fprintf(os.Stderr, "tedi: invalid -label-sep %q; use a single character other than whitespace\n", sep)
+		os.Exit(2)
+	}
+
+	testLabels := _tediTestLabels
+	runLabels, err := readRunLabels(testLabels, sep)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tedi: %s\n", err)
+		os.Exit(2)
+	}
+
+	if _tediLabelMatch != labelMatchAny && _tediLabelMatch != labelMatchAll {
+		fmt.Fprintf(os.Stderr, "tedi: invalid -label-match %q; use %s or %s\n", _tediLabelMatch, labelMatchAny, labelMatchAll)
+		os.Exit(2)
+	}
+
+	shuffle, shuffleSeed, err := parseShuffle(_tediShuffle)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tedi: %s\n", err)
+		os.Exit(2)
+	}
+
+	res := newTedi(m, runLabels...)
+	res.labelMatch = _tediLabelMatch
+	res.shuffle, res.shuffleSeed = shuffle, shuffleSeed
+	for _, opt := range opts {
+		opt(res)
+	}
+	if res.compatErr != nil && !res.withoutUnsafe {
+		fmt.Printf("tedi: warning: %s; running tests with testing.RunTests\n", res.compatErr)
+	}
+	if _tediModules != "" {
+		res.modules = newStringSet(splitLabels(_tediModules, sep)...)
+	}
+	if _tediFailFast != "" {
+		res.failFastLabels = newStringSet(splitLabels(_tediFailFast, sep)...)
+	}
+	res.confirm, res.yes, res.trace = _tediConfirm, _tediYes, _tediTrace
+	res.verbose = testing.Verbose()
+	res.timeout, res.grace = testTimeout(), _tediGrace
+	if f := flag.Lookup("test.outputdir"); f != nil {
+		res.outputDir = f.Value.String()
+	}
+	if _tediSeed != 0 {
+		res.seed = _tediSeed
+	}
+	return res
+}
+
+// The values of -label-match.
+const (
+	labelMatchAny = "any"
+	labelMatchAll = "all"
+)
+
+// defaultLabelSep is the default of -label-sep.
+const defaultLabelSep = ","
+
+// defaultWeight is the weight of tests without Weight.
+const defaultWeight = 1
+
+// defaultGrace is the default of -tedi.grace.
+const defaultGrace = 5 * time.Second
+
+// parseShuffle returns whether the tests are shuffled by the value of the
+// -tedi.shuffle flag, and the seed of the order.
+func parseShuffle(value string) (bool, int64, error) {
+	switch value {
+	case "off":
+		return false, 0, nil
+	case "on":
+		return true, time.Now().UnixNano(), nil
+	}
+	seed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return false, 0, fmt.Errorf("invalid -tedi.shuffle %q; use on, off or a seed", value)
+	}
+	return true, seed, nil
+}
+
+// testTimeout returns the value of the -timeout flag of go test; 0 if there is no timeout.
+func testTimeout() time.Duration {
+	f := flag.Lookup("test.timeout")
+	if f == nil {
+		return 0
+	}
+	if getter, ok := f.Value.(flag.Getter); ok {
+		if timeout, ok := getter.Get().(time.Duration); ok {
+			return timeout
+		}
 	}
+	timeout, _ := time.ParseDuration(f.Value.String())
+	return timeout
+}
+
+// readRunLabels returns the labels of the -labels flag value. A label of the
+// form @file is replaced by the labels in the file, separated like the labels
+// of the flag. The file ends at the next sep, so its path may contain spaces.
+func readRunLabels(value, sep string) ([]string, error) {
+	var res []string
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(sep, r) }) {
+		labels, file := field, ""
+		if i := strings.Index(field, "@"); i == 0 || i > 0 && unicode.IsSpace(rune(field[i-1])) {
+			labels, file = field[:i], strings.TrimSpace(field[i+1:])
+		}
+		res = append(res, splitLabels(labels, sep)...)
+		if file == "" {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read labels of -labels @%s: %w", file, err)
+		}
+		res = append(res, splitLabels(string(content), sep)...)
+	}
+	return res, nil
+}
+
+// splitLabels splits a list of labels separated by sep, whitespace or both,
+// like "a, b c" with the separator ",", ignoring empty labels.
+func splitLabels(s, sep string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return strings.ContainsRune(sep, r) || unicode.IsSpace(r)
+	})
+}
 
+func newTedi(m *testing.M, runLabels ...string) *Tedi {
 	return &Tedi{
 		m:           m,
-		runLabels:   newStringSet(strings.Split(_tediTestLabels, ",")...),
-		beforeTests: []interface{}{},
-		afterTests:  []interface{}{},
+		runLabels:   newStringSet(runLabels...),
+		labelMatch:  labelMatchAny,
+		beforeTests: []hook{},
+		afterTests:  []hook{},
+		timeouts:    map[string]time.Duration{},
+		retries:     map[string]int{},
+		weights:     map[string]int{},
+		envs:        map[string][]envVar{},
+		compatErr:   CheckCompatibility(),
+		seed:        time.Now().UnixNano(),
+		grace:       defaultGrace,
 	}
 }
 
-// Run executes the Tedi test.
+// Run executes the Tedi test. The beforeAll hooks are executed before any
+// test and the afterAll hooks after all tests have been executed.
 func (t *Tedi) Run() int {
-	if len(t.runLabels.Intersect(t.labels)) == 0 {
+	t.warnUnknownLabels(os.Stdout)
+	if matched := t.runLabels.Intersect(t.labels); matched.Len() == 0 {
 		fmt.Println("tedi: warning: labels did not match any tests. Available labels:", strings.Join(t.labels.List(), ", "))
 	}
-	return t.m.Run()
+
+	if t.shuffle {
+		fmt.Printf("tedi: shuffling tests with -tedi.shuffle=%d\n", t.shuffleSeed)
+		t.shuffleTests(t.shuffleSeed)
+	}
+	if len(t.weights) > 0 {
+		t.sortByWeight()
+	}
+
+	if t.confirm && !t.confirmed(os.Stdin, os.Stdout) {
+		fmt.Println("tedi: aborted")
+		return 1
+	}
+
+	c, err := t.createPackageContainer()
+	if err != nil {
+		fmt.Println("tedi: failed to build package container:", err)
+		return 1
+	}
+
+	code := 0
+	if err := invokeAll(c, t.beforeAll); err != nil {
+		fmt.Println("tedi: failed to run BeforeAll:", err)
+		code = 1
+	} else {
+		code = t.m.Run()
+		if !t.runFallbackTests(regexp.MatchString) {
+			code = 1
+		}
+	}
+
+	if err := invokeAll(c, t.afterAll); err != nil {
+		fmt.Println("tedi: failed to run AfterAll:", err)
+		code = 1
+	}
+	return code
+}
+
+// RunLabels executes the tests having one of the labels, instead of the labels
+// given by the -labels flag, like Run.
+func (t *Tedi) RunLabels(labels ...string) int {
+	t.setRunLabels(labels...)
+	return t.Run()
+}
+
+// setRunLabels changes the labels to run and registers the tests again.
+func (t *Tedi) setRunLabels(labels ...string) {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	t.runLabels = newStringSet(labels...)
+	t.reregister()
+}
+
+// shuffleTests changes the order of the tests and examples to a random order
+// given by the seed, registering them again in that order.
+func (t *Tedi) shuffleTests(seed int64) {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	rand.New(rand.NewSource(seed)).Shuffle(len(t.registrations), func(i, j int) {
+		t.registrations[i], t.registrations[j] = t.registrations[j], t.registrations[i]
+	})
+	t.reregister()
+}
+
+// sortByWeight changes the order of the tests to start the tests with a higher
+// weight first, registering them again in that order. Tests of the same
+// weight keep their order.
+func (t *Tedi) sortByWeight() {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	sort.SliceStable(t.registrations, func(i, j int) bool {
+		return t.weight(t.registrations[i].name) > t.weight(t.registrations[j].name)
+	})
+	t.reregister()
+}
+
+// weight returns the weight of the test registered with name.
+func (t *Tedi) weight(name string) int {
+	if weight, ok := t.weights[name]; ok {
+		return weight
+	}
+	return defaultWeight
+}
+
+// registration registers the test or example named name.
+type registration struct {
+	name     string
+	register func()
+}
+
+// reregister registers the tests and examples again, replacing the ones added
+// to m. Callers must hold registerMu.
+func (t *Tedi) reregister() {
+	t.removeAdded()
+	t.tests = nil
+	for _, r := range t.registrations {
+		r.register()
+	}
+}
+
+// warnUnknownLabels prints a warning to out for every label to run which is
+// not defined, suggesting the closest defined label.
+func (t *Tedi) warnUnknownLabels(out io.Writer) {
+	runLabels := t.runLabels.List()
+	sort.Strings(runLabels)
+	for _, label := range runLabels {
+		t.warnUnknownLabel(out, label, "")
+	}
+}
+
+// warnUnknownHookLabels prints a warning to out for every label of the hook
+// which is not defined, like warnUnknownLabels, as the hook would never be
+// called for it.
+func (t *Tedi) warnUnknownHookLabels(out io.Writer, h hook) {
+	labels := h.labels.List()
+	sort.Strings(labels)
+	for _, label := range labels {
+		t.warnUnknownLabel(out, label, " of hook "+funcName(h.fn))
+	}
+}
+
+// warnUnknownLabel prints a warning to out if the label is not defined,
+// suggesting the closest defined label. The source, like the hook of the
+// label, follows the label in the warning.
+func (t *Tedi) warnUnknownLabel(out io.Writer, label, source string) {
+	if t.labels.Has(label) {
+		return
+	}
+
+	labels := t.labels.List()
+	sort.Strings(labels)
+	suggestion, distance := "", 0
+	for _, l := range labels {
+		if d := levenshtein(label, l); suggestion == "" || d < distance {
+			suggestion, distance = l, d
+		}
+	}
+	if suggestion != "" && distance <= maxSuggestionDistance && distance < len(label) {
+		fmt.Fprintf(out, "tedi: warning: unknown label '%s'%s, did you mean '%s'?\n", label, source, suggestion)
+	} else {
+		fmt.Fprintf(out, "tedi: warning: unknown label '%s'%s\n", label, source)
+	}
+}
+
+// maxSuggestionDistance is the largest edit distance of a suggested label.
+const maxSuggestionDistance = 2
+
+// levenshtein returns the number of single character edits needed to change a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func minInt(values ...int) int {
+	res := values[0]
+	for _, v := range values[1:] {
+		if v < res {
+			res = v
+		}
+	}
+	return res
+}
+
+// safeTestName is the name of the test running the tests as subtests with WithoutUnsafe.
+const safeTestName = "Tedi"
+
+// registerInM returns true if the tests and examples are added to m; false if
+// they are run by runFallbackTests.
+func (t *Tedi) registerInM() bool {
+	return t.compatErr == nil && !t.withoutUnsafe
+}
+
+// runFallbackTests runs the tests and examples which are not registered in m
+// and returns false if any of them failed.
+func (t *Tedi) runFallbackTests(matchString func(pat, str string) (bool, error)) bool {
+	tests := t.fallbackTests
+	if t.withoutUnsafe && len(tests) > 0 {
+		tests = []testing.InternalTest{{Name: safeTestName, F: func(test *testing.T) {
+			for _, subtest := range t.fallbackTests {
+				test.Run(subtest.Name, subtest.F)
+			}
+		}}}
+	}
+
+	ok := true
+	if len(tests) > 0 {
+		ok = testing.RunTests(matchString, tests)
+	}
+	if len(t.fallbackExamples) > 0 {
+		ok = testing.RunExamples(matchString, t.fallbackExamples) && ok
+	}
+	return ok
+}
+
+// confirmed prints the selected tests to out and returns true if the run is
+// confirmed by the -yes flag or by answering yes on in.
+func (t *Tedi) confirmed(in io.Reader, out io.Writer) bool {
+	fmt.Fprintln(out, "tedi: the following tests are selected:")
+	for _, name := range t.tests {
+		fmt.Fprintln(out, "\t"+name)
+	}
+	if t.yes {
+		return true
+	}
+
+	fmt.Fprint(out, "tedi: run these tests? [y/N] ")
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// BeforeAll registers a function to be called once before any test is executed.
+func (t *Tedi) BeforeAll(fn interface{}) {
+	t.beforeAll = append(t.beforeAll, fn)
+}
+
+// AfterAll registers a function to be called once after all tests have been executed.
+func (t *Tedi) AfterAll(fn interface{}) {
+	t.afterAll = append(t.afterAll, fn)
 }
 
 func (t *Tedi) TestLabel(name string) {
 	t.labels.Add(name)
 }
+
+// Fixtures returns the types provided by the registered fixtures, including
+// the once fixtures and the values provided to groups, in the order the
+// fixtures are registered.
+func (t *Tedi) Fixtures() []reflect.Type {
+	var res []reflect.Type
+	for _, f := range t.fixtures {
+		fnType := reflect.TypeOf(f.fn)
+		for i := 0; i < fnType.NumOut(); i++ {
+			if fnType.Out(i) != errorType {
+				res = append(res, fnType.Out(i))
+			}
+		}
+	}
+	return res
+}
+
+// Tests returns the names of the registered tests and examples which have one
+// of the labels to run, in the order they are registered.
+func (t *Tedi) Tests() []string {
+	return append([]string{}, t.tests...)
+}
+
+// SelectedLabels returns the sorted labels of the tests to run, given by the
+// -labels flag or RunLabels.
+func (t *Tedi) SelectedLabels() []string {
+	res := t.runLabels.List()
+	sort.Strings(res)
+	return res
+}
+
+// Labels returns the sorted names of the registered test labels.
+func (t *Tedi) Labels() []string {
+	res := t.labels.List()
+	sort.Strings(res)
+	return res
+}
+
+// Timeout sets the timeout of the test registered with name. The context
+// injected into the test will carry the corresponding deadline.
+func (t *Tedi) Timeout(name string, d time.Duration) {
+	t.timeouts[name] = d
+}
+
+// ExpectFailure marks the test registered with name as expected to fail. The
+// test passes if it fails and fails if it unexpectedly passes. The test runs as
+// its subtest xfail, whose failure is logged by the test instead of failing it,
+// so T.Parallel is ignored by it. Tests expected to fail are not retried.
+func (t *Tedi) ExpectFailure(name string) {
+	t.xfails.Add(name)
+}
+
+// Capture captures the standard output and error of the test registered with
+// name, which are written to <name>.log in the -outputdir of go test if the
+// test fails. The output is redirected for the whole process, so the test and
+// its subtests must not run in parallel with other tests; the output of these
+// would be captured as well. T.Parallel is ignored by the test and its subtests.
+func (t *Tedi) Capture(name string) {
+	t.captures.Add(name)
+}
+
+// LabelParallelism limits the number of parallel tests having the label which
+// run at the same time to n. A test is counted once it calls T.Parallel until it
+// and its subtests have finished. Only root tests are limited, and tests of
+// multiple limited labels must be within the limits of all of them.
+func (t *Tedi) LabelParallelism(label string, n int) {
+	if t.parallelism == nil {
+		t.parallelism = map[string]chan struct{}{}
+	}
+	t.parallelism[label] = make(chan struct{}, n)
+}
+
+// Env sets the environment variable key to value while the test registered
+// with name runs, restoring its previous value once the test and its subtests
+// have finished, like testing.T.Setenv. The environment is shared by the
+// process, so tests setting variables cannot run in parallel; T.Parallel panics.
+func (t *Tedi) Env(name, key, value string) {
+	t.envs[name] = append(t.envs[name], envVar{key: key, value: value})
+}
+
+// Weight sets the weight of the test registered with name; the default weight
+// is 1. Tests with a higher weight are registered, and so started, before the
+// others. With limited parallelism, like by -parallel or LabelParallelism,
+// giving long running tests a higher weight keeps them from starting last and
+// delaying the end of the run.
+func (t *Tedi) Weight(name string, weight int) {
+	t.weights[name] = weight
+}
+
+// Retry sets the number of times the test registered with name is retried
+// before it is reported as failed. Every attempt gets its own fixtures and is
+// only done once all of its subtests, including parallel ones, have finished.
+// Every attempt but the last runs as a subtest named attempt_<n>, whose failure
+// is logged by the test instead of failing it. Such an attempt cannot run in
+// parallel, so T.Parallel is ignored by it.
+func (t *Tedi) Retry(name string, retries int) {
+	t.retries[name] = retries
+}
@@ -1,20 +1,23 @@
-// Code generated by tedi; DO NOT EDIT.
-
 package tedi
 
 import (
-	"github.com/jstroem/tedi"
 	"os"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
-func TestMain(m *testing.M) {
-	t := tedi.New(m)
+var beforeAllCalls int
 
-	// TestLabels:
+func TestMain(m *testing.M) {
+	t := newTedi(m, "unit")
 	t.TestLabel("unit")
-	t.TestLabel("integration")
-	t.TestLabel("regression")
+	t.BeforeAll(func() {
+		beforeAllCalls++
+	})
+	t.Test("Test_BeforeAll", func(t *T) {
+		assert.Equal(t, 1, beforeAllCalls)
+	}, "unit")
 
 	os.Exit(t.Run())
 }
@@ -1,53 +1,714 @@
 package tedi
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 	"unsafe"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/dig"
 )
 
 // Test registers a function as a test.
 func (t *Tedi) Test(name string, fn interface{}, labels ...string) {
-	testsLabel := newStringSet(labels...)
+	registerMu.Lock()
+	defer registerMu.Unlock()
 
-	matchedLabels := testsLabel.Intersect(t.labels)
-	matchedLabels = matchedLabels.Intersect(t.runLabels)
-	if len(matchedLabels) > 0 {
-		// Ignore test if the groupset does not overlap with the running set.
-		testFn := t.wrapTest(name, fn, matchedLabels.List()...)
+	t.registrations = append(t.registrations, registration{name, func() { t.registerTest(name, fn, labels...) }})
+	t.registered = append(t.registered, registeredTest{name: name, fn: fn, labels: labels})
+	t.registerTest(name, fn, labels...)
+}
+
+// registerTest adds the test to m if its labels match the labels to run.
+func (t *Tedi) registerTest(name string, fn interface{}, labels ...string) {
+	if matchedLabels, ok := t.matchLabels(labels); ok {
+		testFn := t.wrapTest(nil, name, fn, matchedLabels...)
 		t.addTest(name, testFn)
+		t.tests = append(t.tests, name)
 	}
 }
 
-// BeforeTest registers a function as a beforeTest hook.
-func (t *Tedi) BeforeTest(fn interface{}) {
-	t.beforeTests = append(t.beforeTests, fn)
+// matchLabels returns the labels of a test which are defined and run, and
+// whether the test is run. With -label-match=any a test is run if it has any
+// of the labels to run, and with -label-match=all only if it has all of them,
+// like a test labeled integration and slow for -labels integration,slow.
+func (t *Tedi) matchLabels(labels []string) ([]string, bool) {
+	testLabels := newStringSet(labels...)
+
+	matchedLabels := testLabels.Intersect(t.labels)
+	matchedLabels = matchedLabels.Intersect(t.runLabels)
+	if t.labelMatch == labelMatchAll && matchedLabels.Len() != t.runLabels.Len() {
+		return nil, false
+	}
+	return matchedLabels.List(), matchedLabels.Len() > 0
+}
+
+// BeforeTest registers a function as a beforeTest hook. Hooks are invoked in
+// the container of the test, so the fixtures they depend on are the same
+// instances the test and the other hooks of the test get.
+func (t *Tedi) BeforeTest(fn interface{}, opts ...HookOption) {
+	h := newHook(fn, opts...)
+	t.warnUnknownHookLabels(os.Stdout, h)
+	t.beforeTests = addHook(t.beforeTests, h)
 }
 
 // AfterTest registers a function as a afterTest hook.
-func (t *Tedi) AfterTest(fn interface{}) {
-	t.afterTests = append(t.afterTests, fn)
+func (t *Tedi) AfterTest(fn interface{}, opts ...HookOption) {
+	h := newHook(fn, opts...)
+	t.warnUnknownHookLabels(os.Stdout, h)
+	t.afterTests = addHook(t.afterTests, h)
+}
+
+// HookOption changes when a hook is called.
+type HookOption func(*hook)
+
+// Order sets the order of a hook; the default order is 0. BeforeTest hooks
+// are called in increasing order and AfterTest hooks in decreasing order, so
+// the hooks are torn down in the reverse order of their setup. Hooks with the
+// same order are called in the order they are registered, respectively the
+// reverse order for AfterTest hooks.
+func Order(order int) HookOption {
+	return func(h *hook) {
+		h.order = order
+	}
+}
+
+// Labels limits a hook to the tests having one of the labels; by default a
+// hook is called for all tests. Registering the hook warns about the labels
+// not declared by TestLabel before, like the unknown labels to run.
+func Labels(labels ...string) HookOption {
+	return func(h *hook) {
+		h.labels = newStringSet(labels...)
+	}
+}
+
+type hook struct {
+	fn     interface{}
+	order  int
+	labels stringSet
+}
+
+// matches returns true if the hook is called for a test with the labels.
+func (h hook) matches(testLabels []string) bool {
+	if h.labels.Len() == 0 {
+		return true
+	}
+
+	matched := h.labels.Intersect(newStringSet(testLabels...))
+	return matched.Len() > 0
+}
+
+func newHook(fn interface{}, opts ...HookOption) hook {
+	res := hook{fn: fn}
+	for _, opt := range opts {
+		opt(&res)
+	}
+	return res
+}
+
+// addHook inserts h into hooks after the hooks with the same or a lower order.
+// The returned slice never shares its array with hooks.
+func addHook(hooks []hook, h hook) []hook {
+	i := sort.Search(len(hooks), func(i int) bool {
+		return hooks[i].order > h.order
+	})
+
+	res := make([]hook, 0, len(hooks)+1)
+	res = append(res, hooks[:i]...)
+	res = append(res, h)
+	return append(res, hooks[i:]...)
 }
 
 type testFunc func(t *testing.T)
 
-func (t *Tedi) wrapTest(name string, fn interface{}, labels ...string) testFunc {
+// Use registers a middleware wrapping every test and subtest, e.g. to log or
+// measure them. The middleware registered first is the outermost one. It
+// applies to the tests registered before as well, and is called once per test
+// including its retries. A middleware must call next to run the test; next
+// does not return if the test stops by FailNow or a panic.
+func (t *Tedi) Use(middleware func(next func(*testing.T)) func(*testing.T)) {
+	t.middleware = append(t.middleware, middleware)
+}
+
+// wrapTest returns the function running the test wrapped by the middleware.
+func (t *Tedi) wrapTest(parent *T, name string, fn interface{}, labels ...string) testFunc {
+	run := t.attemptTest(parent, name, fn, labels...)
+	return func(test *testing.T) {
+		atomic.AddInt32(&t.running, 1)
+		defer atomic.AddInt32(&t.running, -1)
+
+		var res func(*testing.T) = run
+		for i := len(t.middleware) - 1; i >= 0; i-- {
+			res = t.middleware[i](res)
+		}
+		res(test)
+	}
+}
+
+// attemptTest returns the function running the test, handling expected
+// failures and retries of root tests.
+func (t *Tedi) attemptTest(parent *T, name string, fn interface{}, labels ...string) testFunc {
+	run := t.runTest(parent, false, name, fn, labels...)
+	if parent != nil {
+		return run
+	}
+	runAttempt := t.runTest(parent, true, name, fn, labels...)
+
 	return func(test *testing.T) {
-		c, t, err := t.createContainer(test, name, labels...)
+		t.startTest(name)
+		if label, ok := t.failedFast(labels); ok {
+			test.Skipf("Skipped as a test with the label %s failed: %s", label, name)
+		}
+		// The cleanup runs once the parallel subtests have finished as well.
+		test.Cleanup(func() {
+			t.recordFailure(test, labels)
+		})
+		if t.captures.Has(name) {
+			defer t.captureOutput(test, name)()
+		}
+		for _, env := range t.envs[name] {
+			test.Setenv(env.key, env.value)
+		}
+
+		// The test runs as an attempt, so its failure does not fail the test.
+		if t.xfails.Has(name) {
+			res, err := runAsAttempt(test, "xfail", runAttempt)
+			switch {
+			case err != nil:
+				test.Errorf("Failed to run test expected to fail: %s: %s", name, err)
+			case res.failed:
+				test.Logf("Test failed as expected: %s%s", name, res.output)
+			case res.skipped:
+				test.SkipNow()
+			default:
+				test.Errorf("Test expected to fail but passed: %s", name)
+			}
+			return
+		}
+
+		// Every attempt but the last runs as a subtest whose failure does not
+		// fail the test. The attempt is done once it and all of its (parallel)
+		// subtests have finished.
+		retries := t.retries[name]
+		for attempt := 1; attempt <= retries; attempt++ {
+			res, err := runAsAttempt(test, fmt.Sprint("attempt_", attempt), runAttempt)
+			if err != nil {
+				test.Logf("Failed to retry test: %s: %s", name, err)
+				break
+			}
+			if !res.failed {
+				if res.skipped {
+					test.SkipNow()
+				}
+				return
+			}
+			test.Logf("Attempt %d of %d failed for test: %s%s", attempt, retries+1, name, res.output)
+		}
+		run(test)
+	}
+}
+
+// attemptResult is the outcome of a test run by runAsAttempt.
+type attemptResult struct {
+	failed, skipped bool
+	// output is the log of the attempt, starting with a newline, unless it
+	// was written already as go test runs verbosely.
+	output string
+}
+
+// runAsAttempt runs the attempt of test as its subtest with name, whose failure
+// does not fail test. The attempt is done once it and all of its subtests,
+// including parallel ones, have finished. testing.T cannot run such a subtest,
+// so the private fields of the testing package are changed: test is detached
+// from its parent while the attempt runs, so the failure does not reach the
+// parent tests, and the failures of the attempt and test are reset before the
+// attempt is reported. An error is returned if testing.T has no such fields.
+func runAsAttempt(test *testing.T, name string, run testFunc) (attemptResult, error) {
+	var res attemptResult
+	fields, err := attemptFields(test)
+	if err != nil {
+		return res, err
+	}
+
+	fields.mu.Lock()
+	parent := reflect.New(fields.parent.Type()).Elem()
+	parent.Set(fields.parent)
+	failed := fields.failed.Bool()
+	fields.parent.Set(reflect.Zero(parent.Type()))
+	fields.mu.Unlock()
+	defer func() {
+		fields.mu.Lock()
+		defer fields.mu.Unlock()
+		fields.parent.Set(parent)
+		fields.failed.SetBool(failed)
+	}()
+
+	test.Run(name, func(attempt *testing.T) {
+		// The cleanup registered first runs last, after the cleanups of the
+		// attempt and once its parallel subtests have finished.
+		attempt.Cleanup(func() {
+			res.failed, res.skipped = attempt.Failed(), attempt.Skipped()
+			attemptFields, err := attemptFields(attempt)
+			if err != nil || !res.failed {
+				return
+			}
+			attemptFields.mu.Lock()
+			defer attemptFields.mu.Unlock()
+			// The lines are indented by the testing package like the log of a subtest.
+			if output := strings.TrimRight(string(attemptFields.output.Bytes()), "\n"); output != "" {
+				res.output = strings.ReplaceAll("\n"+output, "\n    ", "\n")
+			}
+			attemptFields.output.SetBytes(nil)
+			attemptFields.failed.SetBool(false)
+		})
+		run(attempt)
+	})
+	return res, nil
+}
+
+// testFields are the private fields of a testing.T changed by runAsAttempt.
+type testFields struct {
+	mu                     *sync.RWMutex
+	parent, failed, output reflect.Value
+}
+
+// attemptFields returns the private fields of test changed by runAsAttempt.
+func attemptFields(test *testing.T) (testFields, error) {
+	var res testFields
+	value := reflect.ValueOf(test).Elem()
+	field := func(name string, kind reflect.Kind) (reflect.Value, error) {
+		f := value.FieldByName(name)
+		if !f.IsValid() || f.Kind() != kind {
+			return f, fmt.Errorf("%w (%s): testing.T has no %s field of kind %s", ErrIncompatibleGoVersion, runtime.Version(), name, kind)
+		}
+		return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem(), nil
+	}
+
+	mu, err := field("mu", reflect.Struct)
+	if err != nil {
+		return res, err
+	}
+	var ok bool
+	if res.mu, ok = mu.Addr().Interface().(*sync.RWMutex); !ok {
+		return res, fmt.Errorf("%w (%s): the mu field of testing.T is of type %v", ErrIncompatibleGoVersion, runtime.Version(), mu.Type())
+	}
+	if res.parent, err = field("parent", reflect.Ptr); err != nil {
+		return res, err
+	}
+	if res.failed, err = field("failed", reflect.Bool); err != nil {
+		return res, err
+	}
+	if res.output, err = field("output", reflect.Slice); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// captureOutput redirects the standard output and error to a pipe until the
+// returned function is called, which restores them and writes the captured
+// output to a file in the output dir if the test failed.
+func (t *Tedi) captureOutput(test *testing.T, name string) func() {
+	r, w, err := os.Pipe()
+	if err != nil {
+		test.Fatalf("Failed to capture the output of test: %s: %s", name, err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+
+	captured := make(chan []byte)
+	go func() {
+		out, _ := ioutil.ReadAll(r)
+		captured <- out
+	}()
+
+	return func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		w.Close()
+		out := <-captured
+		r.Close()
+		if !test.Failed() {
+			return
+		}
+
+		file := filepath.Join(t.outputDir, unsafeFileChars.ReplaceAllString(name, "_")+".log")
+		if err := ioutil.WriteFile(file, out, 0644); err != nil {
+			test.Errorf("Failed to write the output of test: %s: %s", name, err)
+			return
+		}
+		test.Logf("Output of the test written to %s", file)
+	}
+}
+
+// unsafeFileChars are the characters of test names replaced in file names.
+var unsafeFileChars = regexp.MustCompile(`[^\w.-]+`)
+
+// envVar is an environment variable set while a test runs.
+type envVar struct {
+	key, value string
+}
+
+// failedFast returns a label of the test given by -failfast-labels which
+// already has a failed test.
+func (t *Tedi) failedFast(labels []string) (string, bool) {
+	t.failedMu.Lock()
+	defer t.failedMu.Unlock()
+
+	for _, label := range labels {
+		if t.failedLabels.Has(label) {
+			return label, true
+		}
+	}
+	return "", false
+}
+
+// recordFailure records the labels of the failed test given by
+// -failfast-labels, so the tests having them which start later are skipped.
+// Parallel tests already running are not stopped.
+func (t *Tedi) recordFailure(test *testing.T, labels []string) {
+	if !test.Failed() {
+		return
+	}
+
+	t.failedMu.Lock()
+	defer t.failedMu.Unlock()
+	for _, label := range labels {
+		if t.failFastLabels.Has(label) {
+			t.failedLabels.Add(label)
+		}
+	}
+}
+
+// startTest marks the root test as started. go test runs every -count
+// iteration after the previous one has finished, so a test starting for the
+// second time starts a new iteration and the once fixtures and the failed
+// labels are reset.
+func (t *Tedi) startTest(name string) {
+	t.startedMu.Lock()
+	defer t.startedMu.Unlock()
+
+	if t.started.Has(name) {
+		for _, reset := range t.onceResets {
+			reset()
+		}
+		t.failedMu.Lock()
+		t.failedLabels = nil
+		t.failedMu.Unlock()
+		t.started = nil
+	}
+	t.started.Add(name)
+}
+
+// runTest returns the function running the test. An attempt runs as a
+// subtest of the test, so it cannot run in parallel.
+func (t *Tedi) runTest(parent *T, attempt bool, name string, fn interface{}, labels ...string) testFunc {
+	return func(test *testing.T) {
+		// The test is complete once the after hooks have run, as these may
+		// fail it as well.
+		var start, end time.Time
+		defer func() {
+			res := TestResult{Name: test.Name(), Labels: labels, Failed: test.Failed(), Skipped: test.Skipped()}
+			if !start.IsZero() {
+				// The invocation did not return if the test stopped it with FailNow.
+				if end.IsZero() {
+					end = time.Now()
+				}
+				res.Duration = end.Sub(start)
+			}
+			for _, fn := range t.onTestComplete {
+				fn(res)
+			}
+		}()
+
+		// Panics of fixtures, hooks and the test fail the test with their stack,
+		// which the failure of the invocation would not show. The recover
+		// covers building the container and the after hooks as well.
+		defer func() {
+			if r := recover(); r != nil {
+				test.Fatalf("Test panicked: %s: %v\n%s", name, r, debug.Stack())
+			}
+		}()
+
+		eager := t.eagerFixtures()
+		c, t, err := t.createContainer(test, parent, name, labels...)
 		require.NoError(test, err, "Failed to build container for test: %s", name)
-		require.NoError(test, t.onStart(), "Failed to run onStart for test: %s", name)
-		t.running = true
+		t.attempt = attempt
+		// Parallel subtests resume after the test function returned, so the
+		// context is only cancelled once they have finished.
+		test.Cleanup(t.cancel)
+		defer func() {
+			if t.seeded && test.Failed() {
+				test.Logf("Test depends on *rand.Rand seeded with %d; rerun it with -tedi.seed=%d", t.tedi.seed, t.tedi.seed)
+			}
+		}()
+		// The after hooks also run if a before hook fails, to clean up what
+		// the before hooks did until then. A failure does not stop the test,
+		// as it may be panicking still.
 		defer func() {
-			require.NoError(test, t.onEnd(), "Failed to run onEnd for test: %s", name)
+			assert.NoError(test, t.onEnd(), "Failed to run onEnd for test: %s", name)
 		}()
-		require.NoError(t, c.Invoke(fn), "Failed to Invoke test: %s", name)
+		if eager != nil {
+			require.NoError(test, c.Invoke(eager), "Failed to create eager fixtures for test: %s", name)
+		}
+		require.NoError(test, t.onStart(), "Failed to run onStart for test: %s", name)
+		t.running = true
+		start = time.Now()
+		err = t.invoke(fn)
+		end = time.Now()
+		if err != nil {
+			if t.tedi.trace {
+				t.Log(t.traceInvoke(fn))
+			}
+			require.NoError(t, err, "Failed to Invoke test: %s", name)
+		}
+		if t.ctx.Err() == context.DeadlineExceeded {
+			t.Errorf("Test exceeded its deadline: %s", name)
+		}
+	}
+}
+
+// OnTestComplete registers a function called with the result of every test
+// and subtest once it and its after hooks have finished. Every attempt of a
+// retried test is reported. The function is called by the goroutine of the
+// test, so it must be safe for concurrent use if tests run in parallel.
+func (t *Tedi) OnTestComplete(fn func(TestResult)) {
+	t.onTestComplete = append(t.onTestComplete, fn)
+}
+
+// TestResult is the outcome of a test given to the functions registered by
+// OnTestComplete.
+type TestResult struct {
+	// Name is the full name of the test as reported by testing.T.Name.
+	Name   string
+	Labels []string
+	// Duration is the time the test function ran without the hooks. It includes
+	// the fixtures first built for the test function, as these are built when
+	// it is invoked, but not the ones the before hooks built already.
+	Duration time.Duration
+	Failed   bool
+	Skipped  bool
+}
+
+// traceKey is a type in the container, optionally with a name.
+type traceKey struct {
+	typ  reflect.Type
+	name string
+}
+
+func (k traceKey) String() string {
+	if k.name != "" {
+		return fmt.Sprintf("%v[name=%q]", k.typ, k.name)
+	}
+	return k.typ.String()
+}
+
+// traceInvoke describes why fn cannot be invoked in the container of the test.
+// It lists the types requested by fn, and by the fixtures providing them, which
+// no fixture provides together with the types provided by every fixture.
+func (t *T) traceInvoke(fn interface{}) string {
+	providers := map[traceKey]string{}
+	inputs := map[traceKey][]traceKey{}
+	provide := func(fn interface{}, by string) {
+		fnType := reflect.TypeOf(fn)
+		for i := 0; i < fnType.NumOut(); i++ {
+			for _, key := range traceOutputs(fnType.Out(i)) {
+				providers[key] = by
+				inputs[key] = traceInputs(fnType)
+			}
+		}
+	}
+
+	overridden := map[reflect.Type]bool{}
+	for _, o := range t.overrides {
+		for _, typ := range o.outputs() {
+			overridden[typ] = true
+		}
+	}
+	priorities := t.tedi.asPriorities()
+	for _, f := range t.tedi.fixtures {
+		if f, ok := f.preferred(priorities).without(overridden); ok && f.group == "" {
+			provide(f.fn, f.funcName())
+			for _, iface := range f.as {
+				providers[traceKey{typ: reflect.TypeOf(iface).Elem()}] = f.funcName()
+			}
+		}
+	}
+	for _, o := range t.overrides {
+		provide(o.fn, "override "+funcName(o.fn))
 	}
+	for _, builtin := range builtinTypes {
+		if _, ok := providers[traceKey{typ: builtin}]; !ok {
+			providers[traceKey{typ: builtin}] = "tedi"
+		}
+	}
+	providers[traceKey{typ: testingTB}] = "tedi"
+
+	var missing []string
+	visited := map[traceKey]bool{}
+	var walk func(keys []traceKey, requestedBy string)
+	walk = func(keys []traceKey, requestedBy string) {
+		for _, key := range keys {
+			by, ok := providers[key]
+			if !ok {
+				missing = append(missing, fmt.Sprintf("%v requested by %s is not provided by any fixture", key, requestedBy))
+				continue
+			}
+			if !visited[key] {
+				visited[key] = true
+				walk(inputs[key], by)
+			}
+		}
+	}
+	walk(traceInputs(reflect.TypeOf(fn)), "test "+t.testName)
+
+	var provided []string
+	for key, by := range providers {
+		if by != "tedi" {
+			provided = append(provided, fmt.Sprintf("%v by %s", key, by))
+		}
+	}
+	sort.Strings(provided)
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "tedi trace of test: %s\n", t.testName)
+	for _, m := range missing {
+		fmt.Fprintf(&buf, "\tmissing: %s\n", m)
+	}
+	for _, p := range provided {
+		fmt.Fprintf(&buf, "\tprovided: %s\n", p)
+	}
+	return buf.String()
+}
+
+// traceInputs returns the types requested by the function, expanding dig.In
+// structs. Optional fields and value groups are left out as they are always
+// satisfied.
+func traceInputs(fnType reflect.Type) []traceKey {
+	var res []traceKey
+	var add func(typ reflect.Type, name string)
+	add = func(typ reflect.Type, name string) {
+		if !dig.IsIn(typ) {
+			res = append(res, traceKey{typ: typ, name: name})
+			return
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if f.Type == reflect.TypeOf(dig.In{}) {
+				continue
+			}
+			if f.Tag.Get("optional") == "true" || f.Tag.Get("group") != "" {
+				continue
+			}
+			add(f.Type, f.Tag.Get("name"))
+		}
+	}
+	for i := 0; i < fnType.NumIn(); i++ {
+		add(fnType.In(i), "")
+	}
+	return res
+}
+
+// traceOutputs returns the types provided by a fixture output, expanding
+// dig.Out structs.
+func traceOutputs(typ reflect.Type) []traceKey {
+	if typ == errorType {
+		return nil
+	}
+	if !dig.IsOut(typ) {
+		return []traceKey{{typ: typ}}
+	}
+
+	var res []traceKey
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Tag.Get("group") != "" {
+			continue
+		}
+		if f.Type == reflect.TypeOf(dig.Out{}) {
+			continue
+		}
+		if f.Anonymous && dig.IsOut(f.Type) {
+			res = append(res, traceOutputs(f.Type)...)
+			continue
+		}
+		res = append(res, traceKey{typ: f.Type, name: f.Tag.Get("name")})
+	}
+	return res
+}
+
+// funcName returns the name of the function, or its type if it is created by
+// reflection, like the functions of once fixtures.
+func funcName(fn interface{}) string {
+	if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil && !strings.HasPrefix(f.Name(), "reflect.") {
+		return f.Name()
+	}
+	return reflect.TypeOf(fn).String()
+}
+
+// ErrIncompatibleGoVersion returned if the testing package does not have the layout tedi relies on.
+var ErrIncompatibleGoVersion = errors.New("tedi is incompatible with this Go version")
+
+// CheckCompatibility returns an error if testing.M of the running Go version
+// does not have the private tests and examples fields tedi registers its tests
+// and examples in.
+func CheckCompatibility() error {
+	if err := checkField("tests", map[string]reflect.Type{
+		"Name": reflect.TypeOf(""),
+		"F":    reflect.TypeOf(testFunc(nil)),
+	}); err != nil {
+		return err
+	}
+	return checkField("examples", map[string]reflect.Type{
+		"Name":      reflect.TypeOf(""),
+		"F":         reflect.TypeOf(func() {}),
+		"Output":    reflect.TypeOf(""),
+		"Unordered": reflect.TypeOf(false),
+	})
 }
 
+// checkField returns an error if the field of testing.M is not a slice of
+// structs with the given fields.
+func checkField(name string, fields map[string]reflect.Type) error {
+	field := reflect.ValueOf(&testing.M{}).Elem().FieldByName(name)
+	if !field.IsValid() || field.Kind() != reflect.Slice {
+		return fmt.Errorf("%w (%s): testing.M has no %s slice", ErrIncompatibleGoVersion, runtime.Version(), name)
+	}
+
+	elemType := field.Type().Elem()
+	if elemType.Kind() != reflect.Struct {
+		return fmt.Errorf("%w (%s): the %s of testing.M are of type %v", ErrIncompatibleGoVersion, runtime.Version(), name, elemType)
+	}
+	for fieldName, typ := range fields {
+		f, ok := elemType.FieldByName(fieldName)
+		if !ok || !typ.AssignableTo(f.Type) {
+			return fmt.Errorf("%w (%s): %v has no field %s of type %v", ErrIncompatibleGoVersion, runtime.Version(), elemType, fieldName, typ)
+		}
+	}
+	return nil
+}
+
+// addTest adds the test to m. Callers must hold registerMu, as tests may be
+// registered concurrently.
 func (t *Tedi) addTest(name string, fn testFunc) {
+	if !t.registerInM() {
+		t.fallbackTests = append(t.fallbackTests, testing.InternalTest{Name: name, F: fn})
+		return
+	}
+
 	tests := reflect.ValueOf(t.m).Elem().FieldByName("tests")
 
 	// tests is a private field on the tesing.M struct so we need to do this trick in order to add new tests.
@@ -61,9 +722,26 @@ func (t *Tedi) addTest(name string, fn testFunc) {
 
 	res := reflect.Append(tests.Elem(), newTest.Elem())
 	tests.Elem().Set(res)
+	t.addedTests++
 }
 
-func (t *Tedi) createT(test *testing.T, container *dig.Container, testName string, testLabels ...string) *T {
+// removeAdded removes the tests and examples added to m by addTest and
+// addExample, leaving the ones of go test.
+func (t *Tedi) removeAdded() {
+	t.fallbackTests, t.fallbackExamples = nil, nil
+	if !t.registerInM() {
+		return
+	}
+
+	for field, added := range map[string]int{"tests": t.addedTests, "examples": t.addedExamples} {
+		value := reflect.ValueOf(t.m).Elem().FieldByName(field)
+		value = reflect.NewAt(value.Type(), unsafe.Pointer(value.UnsafeAddr())).Elem()
+		value.Set(value.Slice(0, value.Len()-added))
+	}
+	t.addedTests, t.addedExamples = 0, 0
+}
+
+func (t *Tedi) createT(test *testing.T, container container, testName string, testLabels ...string) *T {
 	res := &T{
 		T:           test,
 		tedi:        t,
@@ -71,8 +749,8 @@ func (t *Tedi) createT(test *testing.T, container *dig.Container, testName strin
 		running:     false,
 		testName:    testName,
 		testLabels:  testLabels,
-		beforeTests: t.beforeTests[:],
-		afterTests:  t.afterTests[:],
+		beforeTests: t.beforeTests,
+		afterTests:  t.afterTests,
 	}
 	return res
 }
@@ -83,50 +761,238 @@ func (t *Tedi) createT(test *testing.T, container *dig.Container, testName strin
 type T struct {
 	*testing.T
 	tedi       *Tedi
-	container  *dig.Container
+	container  container
+	ctx        context.Context
+	cancel     context.CancelFunc
 	running    bool
 	testName   string
 	testLabels []string
+	overrides  []fixture
+	// semaphores limit the parallelism of the labels of a root test.
+	semaphores []chan struct{}
+	// scope holds the values of the test scoped fixtures, shared with the subtests.
+	scope *testScope
+	// seeded is true if the test depends on the seeded *rand.Rand.
+	seeded bool
+	// captured is true if the output of the root test is captured, which
+	// parallel tests would write to as well.
+	captured bool
+	// attempt is true if the test is an attempt of a retried test or a test
+	// expected to fail, which runs as a subtest of the test.
+	attempt bool
+	// subtestFixtures are the fixtures prepared for the containers of the
+	// subtests, until the test overrides a fixture. They are guarded by
+	// subtestMu, as parallel subtests create their containers concurrently.
+	subtestFixtures []preparedFixture
+	subtestMu       sync.Mutex
+
+	beforeTests []hook
+	afterTests  []hook
+}
 
-	beforeTests []interface{}
-	afterTests  []interface{}
+// invoke calls fn with its parameters from the container of the test. Root
+// tests do not run at the same time as their subtests, but parallel subtests
+// do, so their parameters are resolved within the scope of the root test and
+// fn is called afterwards, leaving the scope to the other subtests.
+func (t *T) invoke(fn interface{}) error {
+	fnType := reflect.TypeOf(fn)
+	if _, ok := t.container.(*dig.Scope); !ok || fnType == nil || fnType.Kind() != reflect.Func {
+		return t.container.Invoke(fn)
+	}
+
+	args, err := t.scope.resolve(t.container, fn)
+	if err != nil {
+		return err
+	}
+	var res []reflect.Value
+	if fnType.IsVariadic() {
+		res = reflect.ValueOf(fn).CallSlice(args)
+	} else {
+		res = reflect.ValueOf(fn).Call(args)
+	}
+	if n := len(res); n > 0 && res[n-1].Type() == errorType && !res[n-1].IsNil() {
+		return res[n-1].Interface().(error)
+	}
+	return nil
 }
 
 func (t *T) onStart() error {
-	for _, fn := range t.beforeTests {
-		if err := t.container.Invoke(fn); err != nil {
+	for _, h := range t.beforeTests {
+		if !h.matches(t.testLabels) {
+			continue
+		}
+		if err := t.invoke(h.fn); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// onEnd runs the after hooks in reverse order. Every hook runs even if an
+// earlier one fails or panics, and the errors of all hooks are returned together.
 func (t *T) onEnd() error {
+	outcome := Outcome{Failed: t.T.Failed(), Skipped: t.T.Skipped()}
+	var errs []string
 	for i := range t.afterTests {
-		if err := t.container.Invoke(t.afterTests[len(t.afterTests)-i-1]); err != nil {
-			return err
+		h := t.afterTests[len(t.afterTests)-i-1]
+		if !h.matches(t.testLabels) {
+			continue
 		}
+		if err := t.invokeAfterTest(h, outcome); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
 	}
 	return nil
 }
 
+// invokeAfterTest invokes the after hook, returning a panic of the hook as error.
+func (t *T) invokeAfterTest(h hook, outcome Outcome) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("AfterTest %s panicked: %v", funcName(h.fn), r)
+		}
+	}()
+	return t.invoke(withOutcome(h.fn, outcome))
+}
+
+// Parallel signals that the test is to be run in parallel, like
+// testing.T.Parallel. If the parallelism of a label of the test is limited by
+// LabelParallelism, it also waits until the test is within the limit. Tests
+// whose output is captured, tests expected to fail and attempts of retried
+// tests but the last do not run in parallel, so Parallel only logs that it is
+// ignored.
+func (t *T) Parallel() {
+	if t.captured {
+		t.Logf("Parallel is ignored as the output of the test is captured: %s", t.testName)
+		return
+	}
+	if t.attempt {
+		t.Logf("Parallel is ignored as the test runs as an attempt: %s", t.testName)
+		return
+	}
+	t.T.Parallel()
+	for _, semaphore := range t.semaphores {
+		semaphore <- struct{}{}
+		semaphore := semaphore
+		t.Cleanup(func() { <-semaphore })
+	}
+}
+
+// semaphores returns the semaphores of the labels with limited parallelism,
+// in a fixed order so tests of multiple labels cannot deadlock.
+func (t *Tedi) semaphores(labels []string) []chan struct{} {
+	labels = append([]string{}, labels...)
+	sort.Strings(labels)
+
+	var res []chan struct{}
+	for _, label := range labels {
+		if semaphore, ok := t.parallelism[label]; ok {
+			res = append(res, semaphore)
+		}
+	}
+	return res
+}
+
 // BeforeTest register a function to be called before a test will run.
-func (t *T) BeforeTest(fn interface{}) {
+func (t *T) BeforeTest(fn interface{}, opts ...HookOption) {
+	h := newHook(fn, opts...)
 	if t.running {
-		require.NoError(t, t.container.Invoke(fn), "Failed to run BeforeTest for test: %s", t.testName)
+		if h.matches(t.testLabels) {
+			require.NoError(t, t.invoke(fn), "Failed to run BeforeTest for test: %s", t.testName)
+		}
 		return
 	}
-	t.beforeTests = append(t.beforeTests, fn)
+	t.beforeTests = addHook(t.beforeTests, h)
 }
 
 // AfterTest register a function to be called once the test was executed.
-func (t *T) AfterTest(fn interface{}) {
-	t.afterTests = append(t.afterTests, fn)
+func (t *T) AfterTest(fn interface{}, opts ...HookOption) {
+	t.afterTests = addHook(t.afterTests, newHook(fn, opts...))
+}
+
+// Override provides fn to the subtests of t run after the call, instead of
+// the fixtures providing the same types. Overrides are inherited by nested
+// subtests, and a later override of a type replaces the earlier one. The test
+// itself keeps the fixtures it has been started with.
+func (t *T) Override(fn interface{}) {
+	o := newFixture(fn)
+	require.NoError(t, o.validate(), "Failed to override fixture for test: %s", t.testName)
+
+	overridden := map[reflect.Type]bool{}
+	for _, typ := range o.outputs() {
+		overridden[typ] = true
+	}
+
+	var overrides []fixture
+	for _, f := range t.overrides {
+		if f, ok := f.without(overridden); ok {
+			overrides = append(overrides, f)
+		}
+	}
+
+	t.subtestMu.Lock()
+	defer t.subtestMu.Unlock()
+	t.overrides = append(overrides, o)
+	t.subtestFixtures = nil
+}
+
+// preparedSubtestFixtures returns the fixtures for the containers of the
+// subtests, which are prepared once for all subtests.
+func (t *T) preparedSubtestFixtures() []preparedFixture {
+	t.subtestMu.Lock()
+	defer t.subtestMu.Unlock()
+	if t.subtestFixtures == nil {
+		t.subtestFixtures = t.tedi.prepareFixtures(t)
+	}
+	return t.subtestFixtures
 }
 
 // Run fn as a subtest of t similar to how testing.T.Run would work.
 func (t *T) Run(name string, fn interface{}) bool {
-	return t.T.Run(name, t.tedi.wrapTest(name, fn, t.testLabels...))
+	return t.T.Run(name, t.tedi.wrapTest(t, name, fn, t.testLabels...))
+}
+
+// SubtestResult is the outcome of a subtest run by RunResult.
+type SubtestResult struct {
+	// Name is the full name of the subtest as reported by testing.T.Name.
+	Name   string
+	Passed bool
+	// Duration is the time the subtest ran, including its fixtures and hooks.
+	Duration time.Duration
+}
+
+// RunResult runs fn as a subtest like Run and returns its outcome, so the test
+// can act on it, like skipping the remaining steps once a step failed. Like
+// for Run, a subtest calling Parallel has not finished when RunResult returns,
+// so its result is that of the subtest until it called Parallel.
+func (t *T) RunResult(name string, fn interface{}) SubtestResult {
+	run := t.tedi.wrapTest(t, name, fn, t.testLabels...)
+	res := SubtestResult{Name: t.Name() + "/" + name}
+	start := time.Now()
+	res.Passed = t.T.Run(name, func(test *testing.T) {
+		res.Name = test.Name()
+		run(test)
+	})
+	res.Duration = time.Since(start)
+	return res
+}
+
+// RunWithLabels runs fn as a subtest like Run, adding the labels to the labels
+// inherited from t, so the hooks of the labels are called for the subtest.
+// Like for root tests only the labels which are defined and run are added.
+func (t *T) RunWithLabels(name string, labels []string, fn interface{}) bool {
+	added := newStringSet(labels...)
+	added = added.Intersect(t.tedi.labels)
+	added = added.Intersect(t.tedi.runLabels)
+
+	merged := newStringSet(t.testLabels...)
+	merged.Add(added.List()...)
+	testLabels := merged.List()
+	sort.Strings(testLabels)
+	return t.T.Run(name, t.tedi.wrapTest(t, name, fn, testLabels...))
 }
 
 func (t *T) Labels() []string {
@@ -134,10 +1000,118 @@ func (t *T) Labels() []string {
 }
 
 func (t *T) HasLabel(label string) bool {
-	for _, l := range t.testLabels {
+	return t.Info().HasLabel(label)
+}
+
+// Info returns the name and labels of the test.
+func (t *T) Info() TestInfo {
+	return TestInfo{Name: t.Name(), Labels: t.testLabels}
+}
+
+// TestInfo describes a running test. Fixtures can depend on it to get the name
+// and labels of the test they are created for without depending on *T.
+type TestInfo struct {
+	// Name is the full name of the test as reported by testing.T.Name.
+	Name   string
+	Labels []string
+}
+
+// HasLabel returns true if the test has the label.
+func (i TestInfo) HasLabel(label string) bool {
+	for _, l := range i.Labels {
 		if l == label {
 			return true
 		}
 	}
 	return false
 }
+
+// TempDir is a temporary directory created for the test by testing.T.TempDir,
+// which is removed with its content once the test and its subtests have
+// finished. Every test and subtest depending on it gets a new directory, which
+// is shared by the fixtures and hooks of the test.
+type TempDir string
+
+// Cleanup registers a function to be called after the test like an after test
+// hook. Fixtures can depend on it to tear down the resources they create
+// without depending on *T. Functions are called in the reverse order they are
+// registered, so before the after test hooks registered by the package.
+type Cleanup func(fn func())
+
+// Logger logs through the log of a test with every line prefixed by the name
+// of the test, so the logs of fixtures and tests are attributed to the test
+// even when tests run in parallel. It is an io.Writer, so it can back a
+// *log.Logger with log.New(logger, "", 0).
+type Logger struct {
+	test testing.TB
+}
+
+// Log formats its arguments like fmt.Sprintln and logs them.
+func (l *Logger) Log(args ...interface{}) {
+	l.test.Helper()
+	l.test.Log(l.prefix() + strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+
+// Logf formats its arguments like fmt.Sprintf and logs them.
+func (l *Logger) Logf(format string, args ...interface{}) {
+	l.test.Helper()
+	l.test.Log(l.prefix() + fmt.Sprintf(format, args...))
+}
+
+// Write logs p without its trailing newline.
+func (l *Logger) Write(p []byte) (int, error) {
+	l.test.Helper()
+	l.test.Log(l.prefix() + strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func (l *Logger) prefix() string {
+	return "[" + l.test.Name() + "] "
+}
+
+// Outcome is the outcome of a test. After test hooks can depend on it, e.g. to
+// capture logs only when the test failed. It is not provided to tests or fixtures.
+type Outcome struct {
+	Failed  bool
+	Skipped bool
+}
+
+// outcomeType is the type of Outcome parameters of after test hooks.
+var outcomeType = reflect.TypeOf(Outcome{})
+
+// withOutcome returns a function calling fn with outcome as its Outcome
+// parameters, so the outcome need not be provided by the container where it
+// would be cached before the test finished.
+func withOutcome(fn interface{}, outcome Outcome) interface{} {
+	fnType := reflect.TypeOf(fn)
+	if fnType == nil || fnType.Kind() != reflect.Func || fnType.IsVariadic() {
+		return fn
+	}
+
+	var in, out []reflect.Type
+	for i := 0; i < fnType.NumIn(); i++ {
+		if fnType.In(i) != outcomeType {
+			in = append(in, fnType.In(i))
+		}
+	}
+	if len(in) == fnType.NumIn() {
+		return fn
+	}
+	for i := 0; i < fnType.NumOut(); i++ {
+		out = append(out, fnType.Out(i))
+	}
+
+	fnValue := reflect.ValueOf(fn)
+	return reflect.MakeFunc(reflect.FuncOf(in, out, false), func(args []reflect.Value) []reflect.Value {
+		callArgs := make([]reflect.Value, 0, fnType.NumIn())
+		for i := 0; i < fnType.NumIn(); i++ {
+			if fnType.In(i) == outcomeType {
+				callArgs = append(callArgs, reflect.ValueOf(outcome))
+				continue
+			}
+			callArgs = append(callArgs, args[0])
+			args = args[1:]
+		}
+		return fnValue.Call(callArgs)
+	}).Interface()
+}
@@ -0,0 +1,864 @@
+package tedi
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type attempt struct {
+	number int
+}
+
+func Test_Retry(t *testing.T) {
+	var lock sync.Mutex
+	var events []string
+	record := func(event string) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	}
+
+	tedi := newTedi(&testing.M{})
+	tedi.Retry("retry", 2)
+	attempts := 0
+	require.NoError(t, tedi.Fixture(func() *attempt {
+		attempts++
+		return &attempt{number: attempts}
+	}))
+
+	ok := t.Run("retry", tedi.wrapTest(nil, "retry", func(t *T, a *attempt) {
+		record(fmt.Sprint("start ", a.number))
+		if a.number < 3 {
+			// The attempts run as subtests, which cannot run in parallel.
+			t.Parallel()
+		}
+		for i := 0; i < 3; i++ {
+			i := i
+			t.Run(fmt.Sprint(i), func(t *T) {
+				t.Parallel()
+				time.Sleep(10 * time.Millisecond)
+				record(fmt.Sprint("done ", a.number))
+				if a.number < 3 && i == 2 {
+					t.Fail()
+				}
+			})
+		}
+	}))
+
+	assert.True(t, ok, "the failed attempts do not fail the test")
+	assert.Equal(t, []string{
+		"start 1", "done 1", "done 1", "done 1",
+		"start 2", "done 2", "done 2", "done 2",
+		"start 3", "done 3", "done 3", "done 3",
+	}, events)
+}
+
+func Test_RetryFails(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	tedi.Retry("fails", 1)
+
+	var attempts []string
+	ok := runTestsOnce(t, []testing.InternalTest{
+		{Name: "fails", F: tedi.wrapTest(nil, "fails", func(t *T) {
+			attempts = append(attempts, t.Name())
+			t.Error("failure")
+		})},
+	})
+	assert.False(t, ok, "the last attempt fails the test")
+	assert.Equal(t, []string{"fails/attempt_1", "fails"}, attempts)
+}
+
+func matchAll(pat, str string) (bool, error) {
+	return true, nil
+}
+
+// runOnce calls fn with the -count, -run and -skip flags of go test reset, so
+// the testing.RunTests called by fn runs every test once and unfiltered.
+func runOnce(t *testing.T, fn func()) {
+	for name, value := range map[string]string{"test.count": "1", "test.run": "", "test.skip": ""} {
+		if f := flag.Lookup(name); f != nil {
+			prev := f.Value.String()
+			require.NoError(t, f.Value.Set(value))
+			defer f.Value.Set(prev)
+		}
+	}
+	fn()
+}
+
+// runTestsOnce runs the tests in their own testing.RunTests once and
+// unfiltered, regardless of the -count, -run and -skip flags of go test.
+func runTestsOnce(t *testing.T, tests []testing.InternalTest) bool {
+	var ok bool
+	runOnce(t, func() {
+		ok = testing.RunTests(matchAll, tests)
+	})
+	return ok
+}
+
+func Test_ExpectFailure(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	tedi.ExpectFailure("fails")
+	tedi.ExpectFailure("passes")
+	tedi.ExpectFailure("skips")
+
+	var failsSkipped bool
+	failsOk := t.Run("fails", func(test *testing.T) {
+		defer func() {
+			failsSkipped = test.Skipped()
+		}()
+		tedi.wrapTest(nil, "fails", func(t *T) {
+			t.Run("sub", func(t *T) {
+				t.Error("known bug")
+			})
+		})(test)
+	})
+
+	passesOk := runTestsOnce(t, []testing.InternalTest{
+		{Name: "passes", F: tedi.wrapTest(nil, "passes", func(t *T) {})},
+	})
+
+	skipped := false
+	t.Run("skips", func(test *testing.T) {
+		defer func() {
+			skipped = test.Skipped()
+		}()
+		tedi.wrapTest(nil, "skips", func(t *T) {
+			t.Skip("not supported")
+		})(test)
+	})
+	assert.True(t, failsOk, "expected failure should pass")
+	assert.False(t, passesOk, "unexpected pass should fail")
+	assert.False(t, failsSkipped, "expected failure should run")
+	assert.True(t, skipped, "a skipped test expected to fail is skipped")
+}
+
+func Test_Env(t *testing.T) {
+	require.NoError(t, os.Setenv("TEDI_ENV_SET", "before"))
+	defer os.Unsetenv("TEDI_ENV_SET")
+
+	tedi := newTedi(&testing.M{})
+	tedi.Env("env", "TEDI_ENV_SET", "during")
+	tedi.Env("env", "TEDI_ENV_UNSET", "during")
+
+	t.Run("env", tedi.wrapTest(nil, "env", func(t *T) {
+		assert.Equal(t, "during", os.Getenv("TEDI_ENV_SET"))
+		assert.Equal(t, "during", os.Getenv("TEDI_ENV_UNSET"))
+	}))
+
+	assert.Equal(t, "before", os.Getenv("TEDI_ENV_SET"))
+	_, ok := os.LookupEnv("TEDI_ENV_UNSET")
+	assert.False(t, ok)
+
+	// Like after testing.T.Setenv, the test cannot run in parallel.
+	tedi.Env("parallel", "TEDI_ENV_SET", "during")
+	ok = runTestsOnce(t, []testing.InternalTest{
+		{Name: "parallel", F: tedi.wrapTest(nil, "parallel", func(t *T) { t.Parallel() })},
+	})
+	assert.False(t, ok)
+	assert.Equal(t, "before", os.Getenv("TEDI_ENV_SET"))
+}
+
+func Test_CheckCompatibility(t *testing.T) {
+	assert.NoError(t, CheckCompatibility())
+	assert.NoError(t, newTedi(&testing.M{}).compatErr)
+}
+
+func Test_addTestFallback(t *testing.T) {
+	tedi := newTedi(&testing.M{}, "unit")
+	tedi.compatErr = ErrIncompatibleGoVersion
+	tedi.TestLabel("unit")
+
+	ran := false
+	tedi.Test("fallback", func() { ran = true }, "unit")
+	if assert.Len(t, tedi.fallbackTests, 1) {
+		assert.Equal(t, "fallback", tedi.fallbackTests[0].Name)
+	}
+
+	assert.True(t, tedi.runFallbackTests(matchAll))
+	assert.True(t, ran)
+}
+
+func Test_WithoutUnsafe(t *testing.T) {
+	m := &testing.M{}
+	tedi := newTedi(m, "unit")
+	WithoutUnsafe()(tedi)
+	tedi.TestLabel("unit")
+
+	var names []string
+	tedi.Test("first", func(t *testing.T) { names = append(names, t.Name()) }, "unit")
+	tedi.Test("second", func(t *testing.T) { names = append(names, t.Name()) }, "unit")
+	assert.Equal(t, 0, tedi.addedTests)
+	assert.Equal(t, 0, reflect.ValueOf(m).Elem().FieldByName("tests").Len())
+
+	runOnce(t, func() {
+		assert.True(t, tedi.runFallbackTests(matchAll))
+	})
+	assert.Equal(t, []string{"Tedi/first", "Tedi/second"}, names)
+
+	tedi.setRunLabels("unit")
+	assert.Len(t, tedi.fallbackTests, 2)
+}
+
+func Test_HookOrder(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	var calls []string
+	record := func(call string) func() {
+		return func() {
+			calls = append(calls, call)
+		}
+	}
+
+	tedi.BeforeTest(record("before 10"), Order(10))
+	tedi.BeforeTest(record("before -5"), Order(-5))
+	tedi.BeforeTest(record("before 0"))
+	tedi.BeforeTest(record("before 0 second"))
+	tedi.AfterTest(record("after 10"), Order(10))
+	tedi.AfterTest(record("after -5"), Order(-5))
+	tedi.AfterTest(record("after 0"))
+
+	tedi.wrapTest(nil, "order", func(t *T) {
+		t.BeforeTest(record("during"))
+		calls = append(calls, "test")
+	})(t)
+
+	assert.Equal(t, []string{
+		"before -5", "before 0", "before 0 second", "before 10",
+		"during", "test",
+		"after 10", "after 0", "after -5",
+	}, calls)
+}
+
+func Test_HookLabels(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	var calls []string
+	record := func(call string) func() {
+		return func() {
+			calls = append(calls, call)
+		}
+	}
+
+	tedi.BeforeTest(record("before all"))
+	tedi.BeforeTest(record("before integration"), Labels("integration"))
+	tedi.AfterTest(record("after integration"), Labels("integration", "regression"))
+
+	tedi.wrapTest(nil, "unit", func(t *T) {
+		t.BeforeTest(record("during integration"), Labels("integration"))
+	}, "unit")(t)
+	assert.Equal(t, []string{"before all"}, calls)
+
+	calls = nil
+	tedi.wrapTest(nil, "integration", func(t *T) {
+		t.BeforeTest(record("during integration"), Labels("integration"))
+	}, "integration")(t)
+	assert.Equal(t, []string{"before all", "before integration", "during integration", "after integration"}, calls)
+}
+
+func Test_Outcome(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	var captured []string
+	tedi.AfterTest(func(info TestInfo, outcome Outcome) {
+		if outcome.Failed {
+			captured = append(captured, info.Name)
+		}
+	})
+
+	ok := runTestsOnce(t, []testing.InternalTest{
+		{Name: "passes", F: tedi.wrapTest(nil, "passes", func(t *T) {})},
+		{Name: "fails", F: tedi.wrapTest(nil, "fails", func(t *T) { t.Error("failure") })},
+	})
+	assert.False(t, ok)
+	assert.Equal(t, []string{"fails"}, captured)
+}
+
+func Test_OnTestComplete(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	var results []TestResult
+	tedi.OnTestComplete(func(res TestResult) {
+		results = append(results, res)
+	})
+	var names []string
+	tedi.OnTestComplete(func(res TestResult) {
+		names = append(names, res.Name)
+	})
+
+	ok := runTestsOnce(t, []testing.InternalTest{
+		{Name: "passes", F: tedi.wrapTest(nil, "passes", func() { time.Sleep(10 * time.Millisecond) }, "unit")},
+		{Name: "fails", F: tedi.wrapTest(nil, "fails", func(t *T) { t.FailNow() }, "integration")},
+	})
+	assert.False(t, ok)
+	assert.Equal(t, []string{"passes", "fails"}, names)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "passes", results[0].Name)
+		assert.Equal(t, []string{"unit"}, results[0].Labels)
+		assert.False(t, results[0].Failed)
+		assert.True(t, results[0].Duration >= 10*time.Millisecond)
+
+		assert.Equal(t, "fails", results[1].Name)
+		assert.Equal(t, []string{"integration"}, results[1].Labels)
+		assert.True(t, results[1].Failed)
+		assert.True(t, results[1].Duration > 0)
+	}
+}
+
+func Test_RunResult(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	var passed, failed SubtestResult
+	ok := testing.RunTests(matchAll, []testing.InternalTest{
+		{Name: "steps", F: tedi.wrapTest(nil, "steps", func(t *T) {
+			passed = t.RunResult("passes", func() { time.Sleep(10 * time.Millisecond) })
+			failed = t.RunResult("fails", func(t *T) { t.FailNow() })
+		}, "unit")},
+	})
+	assert.False(t, ok)
+
+	assert.Equal(t, "steps/passes", passed.Name)
+	assert.True(t, passed.Passed)
+	assert.True(t, passed.Duration >= 10*time.Millisecond)
+
+	assert.Equal(t, "steps/fails", failed.Name)
+	assert.False(t, failed.Passed)
+	assert.True(t, failed.Duration > 0)
+}
+
+func Test_AfterTestFailures(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	var calls []string
+	record := func(call string) func() {
+		return func() {
+			calls = append(calls, call)
+		}
+	}
+
+	tedi.BeforeTest(func() error { return errors.New("before failed") })
+	tedi.AfterTest(record("after first"), Order(1))
+	tedi.AfterTest(func() { panic("after panicked") }, Order(2))
+	tedi.AfterTest(func() error { return errors.New("after failed") }, Order(3))
+	tedi.AfterTest(record("after last"), Order(4))
+
+	ok := runTestsOnce(t, []testing.InternalTest{
+		{Name: "fails", F: tedi.wrapTest(nil, "fails", func(t *T) { calls = append(calls, "test") })},
+	})
+	assert.False(t, ok)
+	assert.Equal(t, []string{"after last", "after first"}, calls)
+}
+
+// isolatedEnv is the environment variable naming the test an isolated test
+// process runs.
+const isolatedEnv = "TEDI_ISOLATED_TEST"
+
+// isolate runs the test in an isolated test process and reports whether the
+// caller is that process, which runs the test. Tests capturing os.Stdout are
+// isolated, so no other test writes to it meanwhile.
+func isolate(t *testing.T) bool {
+	if os.Getenv(isolatedEnv) == t.Name() {
+		return true
+	}
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	args := []string{"-test.run=" + runPattern(t.Name()), "-test.count=1", "-test.v=true"}
+	if timeout := flag.Lookup("test.timeout"); timeout != nil {
+		args = append(args, "-test.timeout="+timeout.Value.String())
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), isolatedEnv+"="+t.Name())
+	out, err := cmd.CombinedOutput()
+	switch {
+	case bytes.Contains(out, []byte("--- PASS: "+t.Name()+" (")):
+	case bytes.Contains(out, []byte("--- SKIP: "+t.Name()+" (")):
+		t.Skip(string(out))
+	default:
+		t.Errorf("Isolated test failed: %s: %v\n%s", t.Name(), err, out)
+	}
+	return false
+}
+
+// runPattern returns the -test.run pattern matching only the test with name.
+func runPattern(name string) string {
+	elems := strings.Split(name, "/")
+	for i, elem := range elems {
+		elems[i] = "^" + regexp.QuoteMeta(elem) + "$"
+	}
+	return strings.Join(elems, "/")
+}
+
+// captureStdout returns the output of fn to os.Stdout, like the output of the
+// tests run by fn. The test must be isolated, as os.Stdout is swapped.
+func captureStdout(t *testing.T, fn func()) string {
+	require.Equal(t, t.Name(), os.Getenv(isolatedEnv), "the test capturing os.Stdout is not isolated")
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan []byte)
+	go func() {
+		bytes, _ := ioutil.ReadAll(r)
+		out <- bytes
+	}()
+	fn()
+	w.Close()
+	return string(<-out)
+}
+
+type panicking struct{}
+
+func newPanicking() *panicking {
+	panic("fixture failed")
+}
+
+func Test_Panic(t *testing.T) {
+	if !isolate(t) {
+		return
+	}
+
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(newPanicking))
+
+	ended := false
+	tedi.AfterTest(func() { ended = true })
+
+	var ok bool
+	out := captureStdout(t, func() {
+		ok = runTestsOnce(t, []testing.InternalTest{
+			{Name: "panics", F: tedi.wrapTest(nil, "panics", func(p *panicking) {})},
+		})
+	})
+	assert.False(t, ok)
+	assert.True(t, ended)
+	assert.Contains(t, out, "Test panicked: panics: fixture failed")
+	assert.Contains(t, out, "tedi.newPanicking")
+
+	// A panic while building the container fails the test as well.
+	tedi = newTedi(&testing.M{})
+	tedi.fixtures = append(tedi.fixtures, fixture{fn: "not a function"})
+	out = captureStdout(t, func() {
+		ok = runTestsOnce(t, []testing.InternalTest{
+			{Name: "invalid", F: tedi.wrapTest(nil, "invalid", func() {})},
+		})
+	})
+	assert.False(t, ok)
+	assert.Contains(t, out, "Test panicked: invalid:")
+}
+
+type hookState struct {
+	events []string
+}
+
+func Test_HookFixtures(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(func() *hookState { return &hookState{} }))
+
+	var state *hookState
+	tedi.BeforeTest(func(s *hookState) {
+		s.events = append(s.events, "before")
+	})
+	tedi.AfterTest(func(s *hookState) {
+		s.events = append(s.events, "after")
+		state = s
+	})
+
+	tedi.wrapTest(nil, "hooks", func(s *hookState) {
+		assert.Equal(t, []string{"before"}, s.events)
+		s.events = append(s.events, "test")
+	})(t)
+	assert.Equal(t, []string{"before", "test", "after"}, state.events)
+}
+
+func Test_Use(t *testing.T) {
+	if !isolate(t) {
+		return
+	}
+
+	tedi := newTedi(&testing.M{})
+	var events []string
+	record := func(middleware string) func(next func(*testing.T)) func(*testing.T) {
+		return func(next func(*testing.T)) func(*testing.T) {
+			return func(test *testing.T) {
+				events = append(events, middleware+" start "+test.Name())
+				next(test)
+				events = append(events, middleware+" end "+test.Name())
+			}
+		}
+	}
+
+	test := tedi.wrapTest(nil, "middleware", func(t *T) {
+		events = append(events, "test")
+		t.Run("sub", func() {
+			events = append(events, "subtest")
+		})
+	})
+	tedi.Use(record("outer"))
+	tedi.Use(record("inner"))
+	test(t)
+
+	assert.Equal(t, []string{
+		"outer start Test_Use",
+		"inner start Test_Use",
+		"test",
+		"outer start Test_Use/sub",
+		"inner start Test_Use/sub",
+		"subtest",
+		"inner end Test_Use/sub",
+		"outer end Test_Use/sub",
+		"inner end Test_Use",
+		"outer end Test_Use",
+	}, events)
+
+	events = nil
+	captureStdout(t, func() {
+		assert.False(t, runTestsOnce(t, []testing.InternalTest{
+			{Name: "panics", F: tedi.wrapTest(nil, "panics", func() { panic("test panics") })},
+		}))
+	})
+	assert.Equal(t, []string{"outer start panics", "inner start panics"}, events)
+}
+
+func Test_RunWithLabels(t *testing.T) {
+	tedi := newTedi(&testing.M{}, "unit", "slow")
+	tedi.TestLabel("unit")
+	tedi.TestLabel("slow")
+	tedi.TestLabel("integration")
+
+	var calls []string
+	tedi.BeforeTest(func(t *T) {
+		calls = append(calls, t.Name())
+	}, Labels("slow", "integration"))
+
+	var labels [][]string
+	tedi.wrapTest(nil, "labels", func(t *T) {
+		t.Run("plain", func(t *T) {
+			labels = append(labels, t.Labels())
+		})
+		t.RunWithLabels("slow", []string{"slow", "undefined"}, func(t *T) {
+			labels = append(labels, t.Labels())
+			t.Run("nested", func(t *T) {
+				labels = append(labels, t.Labels())
+			})
+		})
+		t.RunWithLabels("integration", []string{"integration"}, func(t *T) {
+			labels = append(labels, t.Labels())
+		})
+	}, "unit")(t)
+
+	assert.Equal(t, []string{"Test_RunWithLabels/slow", "Test_RunWithLabels/slow/nested"}, calls)
+	assert.Equal(t, [][]string{{"unit"}, {"slow", "unit"}, {"slow", "unit"}, {"unit"}}, labels)
+}
+
+type service struct {
+	name string
+}
+
+type client struct {
+	name string
+}
+
+func Test_Override(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(func() (*service, *client) {
+		return &service{name: "real"}, &client{name: "real"}
+	}))
+
+	tedi.wrapTest(nil, "override", func(t *T, s *service) {
+		t.Run("before", func(s *service) {
+			assert.Equal(t, "real", s.name)
+		})
+
+		t.Override(func() *service { return &service{name: "mock"} })
+		assert.Equal(t, "real", s.name)
+
+		t.Run("mocked", func(t *T, s *service, c *client) {
+			assert.Equal(t, "mock", s.name)
+			assert.Equal(t, "real", c.name)
+
+			t.Run("nested", func(s *service) {
+				assert.Equal(t, "mock", s.name)
+			})
+
+			t.Override(func() *service { return &service{name: "nested mock"} })
+			t.Run("replaced", func(s *service) {
+				assert.Equal(t, "nested mock", s.name)
+			})
+		})
+	})(t)
+
+	tedi.wrapTest(nil, "other", func(t *T, s *service) {
+		assert.Equal(t, "real", s.name)
+		t.Run("sub", func(s *service) {
+			assert.Equal(t, "real", s.name)
+		})
+	})(t)
+}
+
+type traceA struct{}
+type traceB struct{}
+type traceC struct{}
+
+func newTraceA(b *traceB) *traceA {
+	return &traceA{}
+}
+
+func Test_traceInvoke(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(newTraceA))
+
+	_, test, err := tedi.createContainer(t, nil, "trace")
+	require.NoError(t, err)
+	defer test.cancel()
+
+	trace := test.traceInvoke(func(t *T, a *traceA, c *traceC) {})
+	assert.Contains(t, trace, "missing: *tedi.traceC requested by test trace is not provided by any fixture")
+	assert.Contains(t, trace, "missing: *tedi.traceB requested by github.com/jstroem/tedi.newTraceA is not provided by any fixture")
+	assert.Contains(t, trace, "provided: *tedi.traceA by github.com/jstroem/tedi.newTraceA")
+	assert.NotContains(t, trace, "*tedi.T ")
+}
+
+func Test_LabelParallelism(t *testing.T) {
+	tedi := newTedi(&testing.M{})
+	tedi.LabelParallelism("integration", 2)
+
+	var lock sync.Mutex
+	running, maxRunning, unitRunning := 0, 0, 0
+	integrationTest := func(t *T) {
+		t.Parallel()
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+	}
+
+	t.Run("group", func(test *testing.T) {
+		for i := 0; i < 6; i++ {
+			name := fmt.Sprint("integration", i)
+			test.Run(name, tedi.wrapTest(nil, name, integrationTest, "integration"))
+		}
+		for i := 0; i < 3; i++ {
+			name := fmt.Sprint("unit", i)
+			test.Run(name, tedi.wrapTest(nil, name, func(t *T) {
+				t.Parallel()
+				lock.Lock()
+				unitRunning++
+				lock.Unlock()
+			}, "unit"))
+		}
+	})
+
+	// Fewer tests run at the same time if go test runs with -parallel below 2.
+	assert.True(t, maxRunning > 0 && maxRunning <= 2, "max running: %d", maxRunning)
+	assert.Equal(t, 3, unitRunning)
+}
+
+type loggingFixture struct{}
+
+func newLoggingFixture(logger *Logger) *loggingFixture {
+	logger.Logf("fixture created")
+	return &loggingFixture{}
+}
+
+func Test_Logger(t *testing.T) {
+	if !isolate(t) {
+		return
+	}
+
+	tedi := newTedi(&testing.M{})
+	require.NoError(t, tedi.Fixture(newLoggingFixture))
+
+	// The test fails, so its log is printed without -v as well.
+	out := captureStdout(t, func() {
+		runTestsOnce(t, []testing.InternalTest{
+			{Name: "logs", F: tedi.wrapTest(nil, "logs", func(t *testing.T, f *loggingFixture, logger *Logger) {
+				logger.Log("from", "test")
+				log.New(logger, "", 0).Printf("from %s", "log.Logger")
+				t.Fail()
+			})},
+		})
+	})
+	assert.Contains(t, out, "[logs] fixture created")
+	assert.Contains(t, out, "[logs] from test")
+	assert.Contains(t, out, "[logs] from log.Logger")
+}
+
+func Test_Assertions(t *testing.T) {
+	if !isolate(t) {
+		return
+	}
+
+	tedi := newTedi(&testing.M{})
+
+	tedi.wrapTest(nil, "asserts", func(req *require.Assertions, is *assert.Assertions) {
+		req.True(true)
+		is.Equal(1, 1)
+	})(t)
+
+	var subFailed, parentContinued bool
+	captureStdout(t, func() {
+		runTestsOnce(t, []testing.InternalTest{
+			{Name: "parent", F: tedi.wrapTest(nil, "parent", func(t *T, req *require.Assertions) {
+				// The assertions of the subtest fail the subtest, so the parent continues.
+				subFailed = !t.Run("sub", func(sub *T, req *require.Assertions) {
+					req.Fail("sub failed")
+				})
+				parentContinued = true
+			})},
+		})
+	})
+	assert.True(t, subFailed)
+	assert.True(t, parentContinued)
+}
+
+func Test_FailFastLabels(t *testing.T) {
+	if !isolate(t) {
+		return
+	}
+
+	tedi := newTedi(&testing.M{}, "integration", "unit")
+	tedi.failFastLabels = newStringSet("integration")
+
+	var ran []string
+	tests := []testing.InternalTest{
+		{Name: "firstIntegration", F: tedi.wrapTest(nil, "firstIntegration", func(t *T) {
+			ran = append(ran, "firstIntegration")
+			// The failure of a parallel subtest fails the test as well.
+			t.Run("parallel", func(t *T) {
+				t.Parallel()
+				time.Sleep(10 * time.Millisecond)
+				t.Fail()
+			})
+		}, "integration")},
+		{Name: "unit", F: tedi.wrapTest(nil, "unit", func(t *testing.T) {
+			ran = append(ran, "unit")
+			t.Fail()
+		}, "unit")},
+		{Name: "secondIntegration", F: tedi.wrapTest(nil, "secondIntegration", func() {
+			ran = append(ran, "secondIntegration")
+		}, "integration")},
+		{Name: "secondUnit", F: tedi.wrapTest(nil, "secondUnit", func() {
+			ran = append(ran, "secondUnit")
+		}, "unit")},
+	}
+	captureStdout(t, func() {
+		runTestsOnce(t, tests)
+	})
+	// The unit tests keep running after a unit test failed.
+	assert.Equal(t, []string{"firstIntegration", "unit", "secondUnit"}, ran)
+
+	// Running the tests again starts a new iteration, like -count does.
+	ran = nil
+	captureStdout(t, func() {
+		runTestsOnce(t, tests)
+	})
+	assert.Equal(t, []string{"firstIntegration", "unit", "secondUnit"}, ran)
+}
+
+func Test_Capture(t *testing.T) {
+	if !isolate(t) {
+		return
+	}
+
+	tedi := newTedi(&testing.M{})
+	tedi.outputDir = t.TempDir()
+	tedi.Capture("fails/captured")
+	tedi.Capture("passes")
+
+	captureStdout(t, func() {
+		runTestsOnce(t, []testing.InternalTest{
+			{Name: "fails/captured", F: tedi.wrapTest(nil, "fails/captured", func(t *testing.T) {
+				fmt.Println("to stdout")
+				fmt.Fprintln(os.Stderr, "to stderr")
+				t.Fail()
+			})},
+			{Name: "passes", F: tedi.wrapTest(nil, "passes", func() {
+				fmt.Println("passing")
+			})},
+		})
+	})
+
+	out, err := ioutil.ReadFile(filepath.Join(tedi.outputDir, "fails_captured.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "to stdout\nto stderr\n", string(out))
+
+	_, err = os.Stat(filepath.Join(tedi.outputDir, "passes.log"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_CaptureParallel(t *testing.T) {
+	if !isolate(t) {
+		return
+	}
+
+	tedi := newTedi(&testing.M{})
+	tedi.outputDir = t.TempDir()
+	tedi.Capture("fails")
+
+	captureStdout(t, func() {
+		runTestsOnce(t, []testing.InternalTest{
+			{Name: "fails", F: tedi.wrapTest(nil, "fails", func(t *T) {
+				t.Parallel()
+				t.Run("sub", func(t *T) {
+					t.Parallel()
+					fmt.Println("from parallel subtest")
+				})
+				t.Fail()
+			})},
+		})
+	})
+
+	out, err := ioutil.ReadFile(filepath.Join(tedi.outputDir, "fails.log"))
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "from parallel subtest")
+}
+
+// BenchmarkSubtests measures the containers created for the subtests of a
+// test, which reuse the fixtures prepared for the first subtest but create
+// new values of them.
+func BenchmarkSubtests(b *testing.B) {
+	tedi := newTedi(&testing.M{})
+	// Arrays of different lengths are fixtures of distinct types, each
+	// depending on the previous one.
+	array := func(n int) reflect.Type { return reflect.ArrayOf(n, reflect.TypeOf(0)) }
+	require.NoError(b, tedi.Value([0]int{}))
+	for i := 1; i < 20; i++ {
+		typ := array(i)
+		fn := reflect.MakeFunc(reflect.FuncOf([]reflect.Type{array(i - 1)}, []reflect.Type{typ}, false), func([]reflect.Value) []reflect.Value {
+			return []reflect.Value{reflect.New(typ).Elem()}
+		})
+		require.NoError(b, tedi.Fixture(fn.Interface()))
+	}
+	require.NoError(b, tedi.Fixture(func(info TestInfo) *session { return &session{test: info.Name} }, TestScope()))
+
+	b.ReportAllocs()
+	testing.RunTests(matchAll, []testing.InternalTest{{Name: "root", F: tedi.wrapTest(nil, "root", func(t *T) {
+		// go test -count also runs the root test again, after the timer was stopped.
+		b.StartTimer()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			t.Run("sub", func(s *session, v [19]int) {})
+		}
+		b.StopTimer()
+	})}})
+}
@@ -0,0 +1,97 @@
+package tedi
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.uber.org/dig"
+)
+
+// registeredTest is a test as registered by Test.
+type registeredTest struct {
+	name   string
+	fn     interface{}
+	labels []string
+}
+
+// Validate checks that every registered test and the hooks called for it can
+// be invoked with the registered fixtures, without running them. It returns an
+// error naming the first test with a parameter no fixture provides. The
+// fixtures are not called, so their errors, like the ones of fixtures of
+// disabled modules, are not found.
+func (t *Tedi) Validate() error {
+	c, err := t.createValidationContainer()
+	if err != nil {
+		return err
+	}
+
+	for _, test := range t.registered {
+		if err := c.Invoke(noop(test.fn)); err != nil {
+			return fmt.Errorf("test %s cannot be invoked: %w", test.name, err)
+		}
+		for _, h := range t.beforeTests {
+			if h.matches(test.labels) {
+				if err := c.Invoke(noop(h.fn)); err != nil {
+					return fmt.Errorf("before test hook %s of test %s cannot be invoked: %w", funcName(h.fn), test.name, err)
+				}
+			}
+		}
+		for _, h := range t.afterTests {
+			if h.matches(test.labels) {
+				if err := c.Invoke(noop(withOutcome(h.fn, Outcome{}))); err != nil {
+					return fmt.Errorf("after test hook %s of test %s cannot be invoked: %w", funcName(h.fn), test.name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// createValidationContainer creates a container like the one of a test where
+// the fixtures and the types provided by tedi are replaced by functions
+// producing zero values, so resolving the parameters of a test has no effects.
+func (t *Tedi) createValidationContainer() (*dig.Container, error) {
+	res := dig.New()
+	priorities := t.asPriorities()
+	for i, f := range t.fixtures {
+		f = f.preferred(priorities)
+		f.fn = noop(f.fn)
+		if err := f.provide(res); err != nil {
+			return nil, t.duplicateFixture(i, err)
+		}
+	}
+
+	provided := []reflect.Type{testingTB}
+	replaced := t.fixtureTypes(nil)
+	for _, builtin := range builtinTypes {
+		if builtin != outcomeType && !replaced[builtin] {
+			provided = append(provided, builtin)
+		}
+	}
+	for _, typ := range provided {
+		if err := res.Provide(zeroFunc(reflect.FuncOf(nil, []reflect.Type{typ}, false))); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// noop returns a function of the same type as fn returning zero values.
+func noop(fn interface{}) interface{} {
+	fnType := reflect.TypeOf(fn)
+	if fnType == nil || fnType.Kind() != reflect.Func {
+		return fn
+	}
+	return zeroFunc(fnType)
+}
+
+// zeroFunc returns a function of the type returning zero values.
+func zeroFunc(fnType reflect.Type) interface{} {
+	return reflect.MakeFunc(fnType, func([]reflect.Value) []reflect.Value {
+		res := make([]reflect.Value, fnType.NumOut())
+		for i := range res {
+			res[i] = reflect.Zero(fnType.Out(i))
+		}
+		return res
+	}).Interface()
+}
@@ -0,0 +1,43 @@
+package tedi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type validated struct{}
+
+type missing struct{}
+
+func Test_Validate(t *testing.T) {
+	tedi := newTedi(&testing.M{}, "unit")
+	tedi.TestLabel("unit")
+	tedi.TestLabel("integration")
+	require.NoError(t, tedi.Fixture(func(ctx context.Context) (*validated, error) {
+		panic("fixtures are not called")
+	}))
+
+	tedi.Test("valid", func(t *T, v *validated) {}, "unit")
+	tedi.AfterTest(func(v *validated, o Outcome) {})
+	assert.NoError(t, tedi.Validate())
+
+	// Tests not having the labels to run are validated as well.
+	tedi.Test("invalid", func(v *validated, m *missing) {}, "integration")
+	err := tedi.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "test invalid cannot be invoked")
+		assert.Contains(t, err.Error(), "*tedi.missing")
+	}
+
+	hooked := newTedi(&testing.M{}, "unit")
+	hooked.TestLabel("unit")
+	hooked.Test("valid", func() {}, "unit")
+	hooked.BeforeTest(func(m *missing) {})
+	err = hooked.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "of test valid cannot be invoked")
+	}
+}